@@ -3,10 +3,10 @@ package main
 import (
 	"embed"
 	"fmt"
+	"io/fs"
 	"os"
 
 	"travel-map/run"
-	"travel-map/server"
 )
 
 //go:embed travel-map-react/dist
@@ -16,9 +16,16 @@ var distFS embed.FS
 var templateHTML string
 
 func main() {
-	server.Init(distFS, templateHTML)
+	dist, err := fs.Sub(distFS, "travel-map-react/dist")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 
-	err := run.Run(os.Args[1:])
+	err = run.Run(os.Args[1:], run.Assets{
+		Dist:         dist,
+		TemplateHTML: templateHTML,
+	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
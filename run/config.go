@@ -0,0 +1,303 @@
+package run
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"travel-map/server"
+	"travel-map/server/store"
+
+	"github.com/xhd2015/less-gen/flags"
+)
+
+// Environment variables read by the config
+const (
+	envConfig  = "TRAVEL_MAP_CONFIG"
+	envDataDir = "TRAVEL_MAP_DATA"
+	envAMapKey = "AMAP_KEY"
+)
+
+// defaultConfigFile is loaded from the working directory when no config
+// file is given explicitly
+const defaultConfigFile = "travel-map.json"
+
+// Config is the effective configuration of a travel-map instance.
+// Values are resolved with the precedence
+//
+//	flags > environment > config file > defaults
+type Config struct {
+	DataDir        string `json:"data_dir"`
+	Backend        string `json:"backend"`
+	Host           string `json:"host"`
+	Port           int    `json:"port"` // 0 picks the first free port from 8080
+	APIPrefix      string `json:"api_prefix"`
+	AppPrefix      string `json:"app_prefix"`
+	AMapKey        string `json:"amap_key"`
+	MaxUploadBytes int64  `json:"max_upload_bytes"`
+	MaxImportBytes int64  `json:"max_import_bytes"`
+	OnDelete       string `json:"on_delete"` // cascade or restrict, see server.Options.OnDelete
+	OpenBrowser    bool   `json:"open_browser"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		DataDir:        server.DefaultDataDir,
+		Backend:        "file",
+		APIPrefix:      "/api",
+		MaxUploadBytes: server.DefaultMaxUploadBytes,
+		MaxImportBytes: server.DefaultMaxImportBytes,
+		OnDelete:       store.DefaultDeletePolicy,
+		OpenBrowser:    true,
+	}
+}
+
+// configLayer is what one source (file, environment, flags) sets;
+// nil fields are left to lower-precedence sources
+type configLayer struct {
+	DataDir        *string `json:"data_dir"`
+	Backend        *string `json:"backend"`
+	Host           *string `json:"host"`
+	Port           *int    `json:"port"`
+	APIPrefix      *string `json:"api_prefix"`
+	AppPrefix      *string `json:"app_prefix"`
+	AMapKey        *string `json:"amap_key"`
+	MaxUploadBytes *int64  `json:"max_upload_bytes"`
+	MaxImportBytes *int64  `json:"max_import_bytes"`
+	OnDelete       *string `json:"on_delete"`
+	OpenBrowser    *bool   `json:"open_browser"`
+}
+
+// configSources maps each config key to where its value came from
+type configSources map[string]string
+
+func setIf[T any](dst *T, v *T, key string, source string, sources configSources) {
+	if v == nil {
+		return
+	}
+	*dst = *v
+	sources[key] = source
+}
+
+func (l *configLayer) applyTo(cfg *Config, source string, sources configSources) {
+	setIf(&cfg.DataDir, l.DataDir, "data_dir", source, sources)
+	setIf(&cfg.Backend, l.Backend, "backend", source, sources)
+	setIf(&cfg.Host, l.Host, "host", source, sources)
+	setIf(&cfg.Port, l.Port, "port", source, sources)
+	setIf(&cfg.APIPrefix, l.APIPrefix, "api_prefix", source, sources)
+	setIf(&cfg.AppPrefix, l.AppPrefix, "app_prefix", source, sources)
+	setIf(&cfg.AMapKey, l.AMapKey, "amap_key", source, sources)
+	setIf(&cfg.MaxUploadBytes, l.MaxUploadBytes, "max_upload_bytes", source, sources)
+	setIf(&cfg.MaxImportBytes, l.MaxImportBytes, "max_import_bytes", source, sources)
+	setIf(&cfg.OnDelete, l.OnDelete, "on_delete", source, sources)
+	setIf(&cfg.OpenBrowser, l.OpenBrowser, "open_browser", source, sources)
+}
+
+// configFlags are the command line flags shared by every command that
+// needs the effective config
+type configFlags struct {
+	file  string
+	layer configLayer
+}
+
+func (f *configFlags) register(b *flags.Builder) *flags.Builder {
+	return b.
+		String("--config", &f.file).
+		String("--data-dir", &f.layer.DataDir).
+		String("--backend", &f.layer.Backend).
+		String("--host", &f.layer.Host).
+		Int("--port", &f.layer.Port).
+		String("--api-prefix", &f.layer.APIPrefix).
+		String("--app-prefix", &f.layer.AppPrefix).
+		String("--amap-key", &f.layer.AMapKey).
+		Int("--max-upload-bytes", &f.layer.MaxUploadBytes).
+		Int("--max-import-bytes", &f.layer.MaxImportBytes).
+		String("--on-delete", &f.layer.OnDelete).
+		Bool("--open-browser", &f.layer.OpenBrowser)
+}
+
+// registerStore registers only the flags that locate the data, for
+// commands that work on the store without serving it
+func (f *configFlags) registerStore(b *flags.Builder) *flags.Builder {
+	return b.
+		String("--config", &f.file).
+		String("--data-dir", &f.layer.DataDir).
+		String("--backend", &f.layer.Backend)
+}
+
+const storeFlagsHelp = `  --config <file>            config file (default: $TRAVEL_MAP_CONFIG or ./travel-map.json if present)
+  --data-dir <dir>           data directory (default: $TRAVEL_MAP_DATA or travel-data)
+  --backend <kind>           storage backend: file (default), sqlite (one-file
+                             key-value store, one process at a time) or memory`
+
+// openStore resolves the config and opens the store it points to, which
+// must not need migrating; the returned func closes the backend
+func (f *configFlags) openStore() (*store.GlobalStore, func(), error) {
+	cfg, _, err := f.resolve()
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := store.OpenBackend(cfg.Backend, cfg.DataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	st := store.NewGlobalStoreWithBackend(b)
+	// Image URLs in the data embed the prefix the server runs with
+	st.SetAPIPrefix(cfg.APIPrefix)
+	if err := st.CheckLayout(); err != nil {
+		b.Close()
+		return nil, nil, err
+	}
+	return st, func() { b.Close() }, nil
+}
+
+const configFlagsHelp = storeFlagsHelp + `
+  --host <host>              bind host (default: all interfaces)
+  --port <port>              port (default: first free port from 8080)
+  --api-prefix <prefix>      API URL prefix (default: /api)
+  --app-prefix <prefix>      app URL prefix
+  --amap-key <key>           AMAP (Gaode) web service key (default: $AMAP_KEY)
+  --max-upload-bytes <n>     upload size limit in bytes (default: 10MB)
+  --max-import-bytes <n>     import request size limit in bytes (default: 256MB)
+  --on-delete <policy>       deleting a spot routes use: cascade (default) drops it
+                             from the routes, restrict refuses
+  --open-browser=false       do not open a browser on start`
+
+// resolve loads the config file and environment and layers the flags
+// on top
+func (f *configFlags) resolve() (Config, configSources, error) {
+	cfg := defaultConfig()
+	sources := configSources{}
+
+	file := f.file
+	explicit := file != ""
+	if !explicit {
+		file = os.Getenv(envConfig)
+		explicit = file != ""
+	}
+	if !explicit {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			file = defaultConfigFile
+		}
+	}
+	if file != "" {
+		layer, err := readConfigFile(file)
+		if err != nil {
+			return Config{}, nil, err
+		}
+		layer.applyTo(&cfg, "file "+file, sources)
+	}
+
+	var env configLayer
+	if v := os.Getenv(envDataDir); v != "" {
+		env.DataDir = &v
+	}
+	if v := os.Getenv(envAMapKey); v != "" {
+		env.AMapKey = &v
+	}
+	env.applyTo(&cfg, "env", sources)
+
+	f.layer.applyTo(&cfg, "flag", sources)
+
+	if cfg.MaxUploadBytes <= 0 {
+		return Config{}, nil, fmt.Errorf("max_upload_bytes must be positive, got %d", cfg.MaxUploadBytes)
+	}
+	if cfg.MaxImportBytes <= 0 {
+		return Config{}, nil, fmt.Errorf("max_import_bytes must be positive, got %d", cfg.MaxImportBytes)
+	}
+	if err := store.CheckDeletePolicy(cfg.OnDelete); err != nil {
+		return Config{}, nil, fmt.Errorf("on_delete: %w", err)
+	}
+	return cfg, sources, nil
+}
+
+func readConfigFile(file string) (configLayer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return configLayer{}, fmt.Errorf("read config: %w", err)
+	}
+	var layer configLayer
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&layer); err != nil {
+		return configLayer{}, fmt.Errorf("parse config %s: %w", file, err)
+	}
+	return layer, nil
+}
+
+const configHelp = `
+Usage: travel-map config print [options]
+
+Print the effective configuration and where each value comes from.
+Precedence: flags > environment > config file > defaults.
+
+Options:
+  --json                     print as JSON
+` + configFlagsHelp + `
+`
+
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("usage: travel-map config print [options]")
+	}
+	var jsonOutput bool
+	var cf configFlags
+	args, err := cf.register(flags.Bool("--json", &jsonOutput)).
+		Help("-h,--help", configHelp).
+		Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unrecognized extra args: %s", strings.Join(args, " "))
+	}
+	cfg, sources, err := cf.resolve()
+	if err != nil {
+		return err
+	}
+	cfg.AMapKey = maskSecret(cfg.AMapKey)
+
+	if jsonOutput {
+		data, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	var values map[string]interface{}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		source := sources[k]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Printf("%-18s %-24v %s\n", k, values[k], source)
+	}
+	return nil
+}
+
+// maskSecret keeps only the last 4 characters of a secret
+func maskSecret(s string) string {
+	if len(s) <= 4 {
+		return strings.Repeat("*", len(s))
+	}
+	return strings.Repeat("*", len(s)-4) + s[len(s)-4:]
+}
@@ -0,0 +1,63 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+
+	"travel-map/server/store"
+
+	"github.com/xhd2015/less-gen/flags"
+)
+
+const convertHelp = `
+Usage: travel-map convert --from <kind:location> --to <kind:location>
+
+Copy every plan, destination, section and image from one storage
+backend to another. Existing keys in the target are overwritten.
+
+Backends:
+  file:<dir>             plain JSON files under <dir>
+  sqlite:<dir>           <dir>/travel-map.db
+  sqlite:<path>.db       the given database file
+
+Examples:
+  travel-map convert --from file:travel-data --to sqlite:travel-data
+  travel-map convert --from sqlite:travel-data --to file:travel-data-export
+`
+
+func runConvert(args []string) error {
+	var from string
+	var to string
+	args, err := flags.
+		String("--from", &from).
+		String("--to", &to).
+		Help("-h,--help", convertHelp).
+		Parse(args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unrecognized extra args: %s", strings.Join(args, " "))
+	}
+	if from == "" || to == "" {
+		return fmt.Errorf("requires --from and --to")
+	}
+
+	src, err := store.ParseBackendSpec(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := store.ParseBackendSpec(to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	n, err := store.CopyBackend(dst, src)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Copied %d files from %s to %s\n", n, from, to)
+	return nil
+}
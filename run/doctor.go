@@ -0,0 +1,93 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xhd2015/less-gen/flags"
+)
+
+const doctorHelp = `
+Usage: travel-map doctor [options]
+
+Check that the data is consistent and report each problem with its path:
+  unreadable            a JSON file that does not parse
+  duplicate-id          two plans or destinations with the same ID
+  missing-dir           a listed plan or destination without a directory
+  unlisted-dir          a directory that no plan or destination lists
+  missing-image         an image URL whose file does not exist
+  unreferenced-image    an image file that nothing refers to
+  unresolved-image      an image URL shaped like a stored image that names
+                        none; gc refuses to run while there are any
+  dangling-route-spot   a route naming a spot that does not exist
+
+Options:
+  --fix                      repair the safe problems: create missing
+                             directories and drop dangling route spots
+  --json                     print JSON
+` + storeFlagsHelp + `
+
+The other problems are left alone; travel-map gc removes unreferenced
+images. The exit status is non-zero while
+problems remain. The server offers the same check at GET /api/admin/check,
+and POST /api/admin/check?fix=true.
+`
+
+func runDoctor(args []string) error {
+	var fix bool
+	var jsonOut bool
+	var cf configFlags
+	args, err := cf.registerStore(flags.
+		Bool("--fix", &fix).
+		Bool("--json", &jsonOut)).
+		Help("-h,--help", doctorHelp).
+		Parse(args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unrecognized extra args: %s", strings.Join(args, " "))
+	}
+
+	st, closeStore, err := cf.openStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	report, err := st.Check(fix)
+	if err != nil {
+		return err
+	}
+	if jsonOut {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range report.Problems {
+			path := p.Path
+			if p.Field != "" {
+				path += " " + p.Field
+			}
+			status := ""
+			if p.Fixed {
+				status = " (fixed)"
+			} else if p.Fixable {
+				status = " (fixable with --fix)"
+			}
+			fmt.Printf("%s: %s: %s: %s%s\n", p.Severity, p.Code, path, p.Message, status)
+		}
+		fmt.Printf("Checked %d plans, %d destinations, %d images\n", report.Plans, report.Destinations, report.Images)
+	}
+
+	remaining := len(report.Problems) - report.Fixed()
+	if remaining > 0 {
+		return fmt.Errorf("%d problems found", remaining)
+	}
+	if !jsonOut && len(report.Problems) > 0 {
+		fmt.Printf("Fixed %d problems\n", report.Fixed())
+	} else if !jsonOut {
+		fmt.Println("No problems found")
+	}
+	return nil
+}
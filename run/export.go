@@ -0,0 +1,352 @@
+package run
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"travel-map/server/store"
+
+	"github.com/xhd2015/less-gen/flags"
+)
+
+const exportHelp = `
+Usage: travel-map export [options]
+
+Export plans with all destinations, sections and images. Works offline
+against the data directory, no server needed.
+
+Formats:
+  zip    a manifest plus the original image files, streamed
+  json   legacy single JSON file with base64 images, the same as the
+         web UI downloads from /export
+
+Options:
+  --plan <plan-id>           export only this plan, can be repeated (default: all)
+  -o,--output <file>         output file, "-" for stdout (default: stdout)
+  --format <zip|json>        (default: json if the output ends in .json, else zip)
+` + storeFlagsHelp + `
+
+Examples:
+  travel-map export -o backup.zip
+  travel-map export -o backup.json
+  travel-map export | ssh host travel-map import -
+  travel-map export --plan 1700000000000 -o kyoto.json
+`
+
+const importHelp = `
+Usage: travel-map import [options] <file>|-
+
+Import plans from a zip or json export file, or from stdin with "-".
+Every plan is created anew with fresh IDs; existing plans are left
+untouched.
+
+The whole file is validated first and nothing is written if it has
+errors. If writing fails midway, the plans created so far are removed.
+
+With --into, the single plan of the file is merged into an existing plan
+instead: destinations are matched by name, spots and foods by name and
+coordinates, other items by their name or text. Unknown items are added,
+and matched items that differ are updated or kept per --on-conflict.
+
+Options:
+  --dry-run                  validate and report what would be imported
+  --into <plan-id>           merge into this existing plan
+  --on-conflict <policy>     theirs (default): take the incoming version,
+                             ours: keep the existing one and report it
+` + storeFlagsHelp + `
+
+Examples:
+  travel-map import backup.zip
+  travel-map import --into 1700000000000 --dry-run kyoto-from-alice.zip
+  curl -s http://host/api/export | travel-map import -
+`
+
+func runExport(args []string) error {
+	var planIDs []string
+	var output string
+	var format string
+	var cf configFlags
+	args, err := cf.registerStore(flags.
+		StringSlice("--plan", &planIDs).
+		String("-o,--output", &output).
+		String("--format", &format)).
+		Help("-h,--help", exportHelp).
+		Parse(args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unrecognized extra args: %s", strings.Join(args, " "))
+	}
+	toStdout := output == "" || output == "-"
+	if format == "" {
+		format = "zip"
+		if strings.HasSuffix(strings.ToLower(output), ".json") {
+			format = "json"
+		}
+	}
+	if format != "zip" && format != "json" {
+		return fmt.Errorf("unknown format %q, expecting zip or json", format)
+	}
+
+	st, closeStore, err := cf.openStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	// ExportPlans skips unknown IDs, which would make a typo look like
+	// a successful backup
+	for _, id := range planIDs {
+		if _, err := findPlan(st, id); err != nil {
+			return err
+		}
+	}
+
+	target := output
+	if toStdout {
+		target = "stdout"
+	}
+	if format == "zip" {
+		return exportArchive(st, planIDs, output, target)
+	}
+
+	fullPlans, err := st.ExportPlans(planIDs)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(store.NewExport(fullPlans))
+	if err != nil {
+		return err
+	}
+
+	if toStdout {
+		if _, err := os.Stdout.Write(data); err != nil {
+			return err
+		}
+	} else if err := writeFileReplace(output, data); err != nil {
+		return err
+	}
+
+	// The summary goes to stderr so stdout stays a clean export
+	for _, fp := range fullPlans {
+		fmt.Fprintf(os.Stderr, "Exported plan %q: %d destinations, %d images\n", fp.Plan.Name, len(fp.Destinations), countEmbeddedImages(fp))
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d plans (%d bytes) to %s\n", len(fullPlans), len(data), target)
+	return nil
+}
+
+func runImport(args []string) error {
+	// A lone "-" means stdin; take it out before the flag parser sees it
+	stdin := false
+	rest := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "-" {
+			stdin = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+
+	var dryRun bool
+	var into string
+	var onConflict string
+	var cf configFlags
+	args, err := cf.registerStore(flags.
+		Bool("--dry-run", &dryRun).
+		String("--into", &into).
+		String("--on-conflict", &onConflict)).
+		Help("-h,--help", importHelp).
+		Parse(rest)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader
+	source := "stdin"
+	switch {
+	case stdin && len(args) == 0:
+		r = os.Stdin
+	case !stdin && len(args) == 1:
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+		source = args[0]
+	default:
+		return fmt.Errorf("requires exactly one <file> or -")
+	}
+
+	st, closeStore, err := cf.openStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	opts := store.ImportOptions{DryRun: dryRun, PlanID: into, OnConflict: onConflict}
+	var report store.ImportReport
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(4)
+	if store.IsArchive(head) {
+		if f, ok := r.(*os.File); ok && f != os.Stdin {
+			var info os.FileInfo
+			info, err = f.Stat()
+			if err != nil {
+				return err
+			}
+			report, err = st.ImportArchive(f, info.Size(), opts)
+		} else {
+			report, err = st.ImportArchiveFrom(br, opts)
+		}
+	} else {
+		var data []byte
+		data, err = io.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		var exp store.Export
+		var version int
+		exp, version, err = store.DecodeExport(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+		report, err = st.Import(exp.Plans, opts)
+		report.SourceVersion = version
+	}
+	if report.SourceVersion != 0 && report.SourceVersion < store.ExportVersion {
+		fmt.Printf("Upgraded %s from export schema version %d to %d\n", source, report.SourceVersion, store.ExportVersion)
+	}
+	printImportReport(report)
+	if err != nil {
+		return err
+	}
+	switch {
+	case into != "" && dryRun:
+		fmt.Printf("Dry run: would merge %d changes from %s into plan %s\n", len(report.Changes), source, into)
+	case into != "":
+		fmt.Printf("Merged %d changes from %s into plan %s\n", len(report.Changes), source, into)
+	case dryRun:
+		fmt.Printf("Dry run: would import %d plans from %s\n", len(report.Plans), source)
+	default:
+		fmt.Printf("Imported %d plans from %s\n", len(report.Plans), source)
+	}
+	return nil
+}
+
+func printImportReport(report store.ImportReport) {
+	for i, p := range report.Plans {
+		id := p.ID
+		if id == "" {
+			id = "-"
+		}
+		fmt.Printf("[%d/%d] plan %q (%s): %d destinations, %d images\n", i+1, len(report.Plans), p.Name, id, p.Destinations, p.Images)
+	}
+	for _, c := range report.Changes {
+		what := c.Destination
+		if c.Section != "" {
+			what += " / " + c.Section
+		}
+		if c.Item != "" {
+			what += " / " + c.Item
+		}
+		line := fmt.Sprintf("%-9s %s", c.Action, what)
+		if c.Detail != "" {
+			line += ": " + c.Detail
+		}
+		fmt.Println(line)
+	}
+	for _, p := range report.Problems {
+		fmt.Printf("%s: %s: %s\n", p.Severity, p.Path, p.Message)
+	}
+}
+
+// exportArchive streams a zip export to output, or to stdout
+func exportArchive(st *store.GlobalStore, planIDs []string, output string, target string) error {
+	var w io.Writer = os.Stdout
+	var tmp *os.File
+	if target != "stdout" {
+		// Stream into a temp file next to output and rename it into
+		// place once complete
+		var err error
+		tmp, err = os.CreateTemp(filepath.Dir(output), "."+filepath.Base(output)+"-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		w = tmp
+	}
+	cw := &countingWriter{w: w}
+	stats, err := st.ExportArchive(cw, planIDs)
+	if err != nil {
+		return err
+	}
+	if tmp != nil {
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(tmp.Name(), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), output); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d plans, %d destinations, %d images (%d bytes) to %s\n", stats.Plans, stats.Destinations, stats.Images, cw.n, target)
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countEmbeddedImages counts the base64 images carried by an exported plan
+func countEmbeddedImages(fp store.FullPlan) int {
+	n := 0
+	for i := range fp.Destinations {
+		n += fp.Destinations[i].EmbeddedImages()
+	}
+	return n
+}
+
+// writeFileReplace writes data next to file and renames it into place, so
+// an interrupted run never leaves a truncated backup behind
+func writeFileReplace(file string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+"-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"travel-map/server/store"
+
+	"github.com/xhd2015/less-gen/flags"
+)
+
+const gcHelp = `
+Usage: travel-map gc [options]
+
+Remove uploaded images that no spot, reference, guide image or map image
+refers to any more, e.g. after an image was replaced or its item deleted.
+Destinations with a section file that does not parse are left alone.
+
+Options:
+  --dry-run                  report the images and bytes that would be
+                             removed without removing anything
+  --grace <duration>         keep images modified within this period, as
+                             uploads are referenced only once the item is
+                             saved (default: 24h, 0 keeps none)
+  --quarantine               move the images below <data-dir>/quarantine
+                             instead of deleting them
+  --json                     print JSON
+` + storeFlagsHelp + `
+
+The server offers the same at POST /api/admin/gc?dryRun=true.
+`
+
+func runGC(args []string) error {
+	var dryRun bool
+	var grace string
+	var quarantine bool
+	var jsonOut bool
+	var cf configFlags
+	args, err := cf.registerStore(flags.
+		Bool("--dry-run", &dryRun).
+		String("--grace", &grace).
+		Bool("--quarantine", &quarantine).
+		Bool("--json", &jsonOut)).
+		Help("-h,--help", gcHelp).
+		Parse(args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unrecognized extra args: %s", strings.Join(args, " "))
+	}
+	opts := store.GCOptions{DryRun: dryRun, Quarantine: quarantine}
+	if grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil {
+			return fmt.Errorf("--grace: %w", err)
+		}
+		if d == 0 {
+			d = -1
+		}
+		opts.GracePeriod = d
+	}
+
+	st, closeStore, err := cf.openStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	report, err := st.CollectGarbage(opts)
+	if jsonOut {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+		return err
+	}
+	kept := 0
+	for _, img := range report.Orphans {
+		if img.Action == store.GCKept {
+			kept++
+			continue
+		}
+		line := fmt.Sprintf("%-12s %s (%d bytes)", img.Action, img.Path, img.Size)
+		if img.MovedTo != "" {
+			line += " -> " + img.MovedTo
+		}
+		fmt.Println(line)
+	}
+	for _, dir := range report.Skipped {
+		fmt.Printf("skipped      %s: a section file does not parse, see travel-map doctor\n", dir)
+	}
+	if err != nil {
+		return err
+	}
+	verb := "Reclaimed"
+	if report.DryRun {
+		verb = "Would reclaim"
+	}
+	fmt.Printf("Scanned %d images: %d orphaned, %d kept within the grace period. %s %d bytes\n", report.Scanned, len(report.Orphans), kept, verb, report.Reclaimed)
+	return nil
+}
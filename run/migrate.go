@@ -0,0 +1,171 @@
+package run
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"travel-map/server/store"
+
+	"github.com/xhd2015/less-gen/flags"
+)
+
+const migrateHelp = `
+Usage: travel-map migrate --check|--apply [options]
+
+Check or upgrade the layout of the data directory. The layout version is
+kept in <data-dir>/VERSION; data written before it existed is version 1.
+The server runs --apply by itself on start; the other commands refuse to
+work on data that needs migrating.
+
+Options:
+  --check                    list the pending migrations, exit with an
+                             error if there are any
+  --apply                    back up the data, then run the pending
+                             migrations
+  --backup-dir <dir>         where --apply copies the data first
+                             (default: <data-dir>.backup-<timestamp>)
+  --json                     print JSON
+` + storeFlagsHelp + `
+
+A backup is a plain file data directory, whatever the backend. To go
+back, point --data-dir at it, or convert it back for sqlite:
+  travel-map convert --from file:<backup-dir> --to sqlite:travel-data
+`
+
+func runMigrate(args []string) error {
+	var check bool
+	var apply bool
+	var backupDir string
+	var jsonOut bool
+	var cf configFlags
+	args, err := cf.registerStore(flags.
+		Bool("--check", &check).
+		Bool("--apply", &apply).
+		String("--backup-dir", &backupDir).
+		Bool("--json", &jsonOut)).
+		Help("-h,--help", migrateHelp).
+		Parse(args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unrecognized extra args: %s", strings.Join(args, " "))
+	}
+	if check == apply {
+		return fmt.Errorf("requires one of --check or --apply")
+	}
+
+	cfg, _, err := cf.resolve()
+	if err != nil {
+		return err
+	}
+	b, err := store.OpenBackend(cfg.Backend, cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	st := store.NewGlobalStoreWithBackend(b)
+	st.SetAPIPrefix(cfg.APIPrefix)
+
+	status, err := st.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	if check {
+		if jsonOut {
+			if err := printJSON(status); err != nil {
+				return err
+			}
+		} else {
+			printMigrationStatus(status)
+		}
+		if status.Pending() {
+			return fmt.Errorf("%d pending migrations, run: travel-map migrate --apply", len(status.Steps))
+		}
+		return nil
+	}
+
+	status, backupDir, err = migrateData(st, cfg, status, backupDir)
+	if jsonOut {
+		if err := printJSON(status); err != nil {
+			return err
+		}
+	} else {
+		printMigration(status, backupDir)
+	}
+	if err != nil {
+		return err
+	}
+	if !jsonOut {
+		fmt.Printf("Data is at layout version %d\n", status.Version)
+	}
+	return nil
+}
+
+// migrateData backs up the data to backupDir, by default
+// <data-dir>.backup-<timestamp>, if status has migrations pending, and
+// migrates it. It returns the backup directory, empty if none was made.
+func migrateData(st *store.GlobalStore, cfg Config, status store.MigrationStatus, backupDir string) (store.MigrationStatus, string, error) {
+	var backup store.Backend
+	if status.Pending() && cfg.Backend != store.BackendMemory {
+		if backupDir == "" {
+			backupDir = fmt.Sprintf("%s.backup-%s", filepath.Clean(cfg.DataDir), time.Now().Format("20060102-150405"))
+		}
+		backup = store.NewFileBackend(backupDir)
+	} else {
+		backupDir = ""
+	}
+	status, err := st.Migrate(backup)
+	if err != nil && backup != nil {
+		return status, backupDir, fmt.Errorf("%w; the data before migrating is in %s", err, backupDir)
+	}
+	return status, backupDir, err
+}
+
+// migrateOnStart brings data of an older layout to the current one
+// before it is served, backing it up first
+func migrateOnStart(st *store.GlobalStore, cfg Config) error {
+	status, err := st.MigrationStatus()
+	if err != nil || !status.Pending() {
+		return err
+	}
+	fmt.Printf("Data in %s is at layout version %d, current is %d. Migrating, as travel-map migrate --apply --data-dir %s would:\n", cfg.DataDir, status.Version, status.Target, cfg.DataDir)
+	status, backupDir, err := migrateData(st, cfg, status, "")
+	printMigration(status, backupDir)
+	if err != nil {
+		return fmt.Errorf("migrate data: %w", err)
+	}
+	fmt.Printf("Data is at layout version %d\n", status.Version)
+	return nil
+}
+
+// printMigration prints what Migrate did
+func printMigration(status store.MigrationStatus, backupDir string) {
+	if status.Backup > 0 {
+		fmt.Printf("Backed up %d files to %s\n", status.Backup, backupDir)
+	}
+	for _, step := range status.Steps {
+		if len(step.Actions) == 0 && step.From < status.Version {
+			fmt.Printf("%d -> %d %s: nothing to do\n", step.From, step.To, step.Description)
+		}
+		for _, action := range step.Actions {
+			fmt.Printf("%d -> %d %s: %s\n", step.From, step.To, step.Description, action)
+		}
+	}
+}
+
+func printMigrationStatus(status store.MigrationStatus) {
+	switch {
+	case status.Version == 0:
+		fmt.Printf("No data yet, it will start at layout version %d\n", status.Target)
+	case !status.Pending():
+		fmt.Printf("Data is at layout version %d, up to date\n", status.Version)
+	default:
+		fmt.Printf("Data is at layout version %d, current is %d. Pending migrations:\n", status.Version, status.Target)
+		for _, step := range status.Steps {
+			fmt.Printf("  %d -> %d  %s\n", step.From, step.To, step.Description)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package run
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"travel-map/server/store"
+
+	"github.com/xhd2015/less-gen/flags"
+)
+
+const planHelp = `
+Usage: travel-map plan <command> [options]
+
+Commands:
+  list                       list all plans
+  create <name>              create a plan
+  rename <plan-id> <name>    rename a plan
+  delete <plan-id>           delete a plan and all its destinations
+
+Options:
+  --json                     print JSON instead of a table
+` + storeFlagsHelp + `
+
+Examples:
+  travel-map plan create "Kyoto 2025"
+  travel-map plan list --json
+`
+
+const destHelp = `
+Usage: travel-map dest <command> --plan <plan-id> [options]
+
+Commands:
+  list                       list the destinations of a plan in order
+  add <name>                 append a destination
+  reorder <dest-id>...       move the given destinations to the front,
+                             in the given order; the rest follow
+  remove <dest-id>           delete a destination and all its data
+
+Options:
+  --plan <plan-id>           the plan to work on (required)
+  --json                     print JSON instead of a table
+` + storeFlagsHelp + `
+
+Examples:
+  travel-map dest add --plan 1700000000000 Arashiyama
+  travel-map dest reorder --plan 1700000000000 1700000000002 1700000000001
+`
+
+func runPlan(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: travel-map plan list|create|rename|delete, see --help")
+	}
+	cmd := args[0]
+	if cmd == "-h" || cmd == "--help" {
+		fmt.Print(strings.TrimPrefix(planHelp, "\n"))
+		return nil
+	}
+
+	var jsonOutput bool
+	var cf configFlags
+	args, err := cf.registerStore(flags.Bool("--json", &jsonOutput)).
+		Help("-h,--help", planHelp).
+		Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	st, closeStore, err := cf.openStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	switch cmd {
+	case "list":
+		if err := expectArgs(args); err != nil {
+			return err
+		}
+		plans, err := st.ListPlans()
+		if err != nil {
+			return err
+		}
+		return printPlans(plans, jsonOutput)
+	case "create":
+		if err := expectArgs(args, "name"); err != nil {
+			return err
+		}
+		plan, err := st.CreatePlan(args[0])
+		if err != nil {
+			return err
+		}
+		return printPlans([]store.Plan{plan}, jsonOutput)
+	case "rename":
+		if err := expectArgs(args, "plan-id", "name"); err != nil {
+			return err
+		}
+		if err := st.UpdatePlan(args[0], store.Plan{Name: args[1]}); err != nil {
+			return err
+		}
+		plan, err := findPlan(st, args[0])
+		if err != nil {
+			return err
+		}
+		return printPlans([]store.Plan{plan}, jsonOutput)
+	case "delete":
+		if err := expectArgs(args, "plan-id"); err != nil {
+			return err
+		}
+		plan, err := findPlan(st, args[0])
+		if err != nil {
+			return err
+		}
+		if err := st.DeletePlan(plan.ID); err != nil {
+			return err
+		}
+		if jsonOutput {
+			return printJSON(plan)
+		}
+		fmt.Printf("Deleted plan %s (%s)\n", plan.ID, plan.Name)
+		return nil
+	default:
+		return fmt.Errorf("unknown plan command: %s", cmd)
+	}
+}
+
+func runDest(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: travel-map dest list|add|reorder|remove --plan <plan-id>, see --help")
+	}
+	cmd := args[0]
+	if cmd == "-h" || cmd == "--help" {
+		fmt.Print(strings.TrimPrefix(destHelp, "\n"))
+		return nil
+	}
+
+	var planID string
+	var jsonOutput bool
+	var cf configFlags
+	args, err := cf.registerStore(flags.
+		String("--plan", &planID).
+		Bool("--json", &jsonOutput)).
+		Help("-h,--help", destHelp).
+		Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if planID == "" {
+		return fmt.Errorf("requires --plan")
+	}
+	st, closeStore, err := cf.openStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	if _, err := findPlan(st, planID); err != nil {
+		return err
+	}
+	planStore, err := st.GetPlanStore(planID)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "list":
+		if err := expectArgs(args); err != nil {
+			return err
+		}
+		dests, err := planStore.ListDestinations()
+		if err != nil {
+			return err
+		}
+		return printDestinations(dests, jsonOutput)
+	case "add":
+		if err := expectArgs(args, "name"); err != nil {
+			return err
+		}
+		dest, err := planStore.CreateDestination(args[0])
+		if err != nil {
+			return err
+		}
+		return printDestinations([]store.Destination{dest}, jsonOutput)
+	case "reorder":
+		if len(args) == 0 {
+			return fmt.Errorf("requires at least one <dest-id>")
+		}
+		dests, err := planStore.ReorderDestinations(args)
+		if err != nil {
+			return err
+		}
+		return printDestinations(dests, jsonOutput)
+	case "remove":
+		if err := expectArgs(args, "dest-id"); err != nil {
+			return err
+		}
+		dests, err := planStore.ListDestinations()
+		if err != nil {
+			return err
+		}
+		var dest *store.Destination
+		for i := range dests {
+			if dests[i].ID == args[0] {
+				dest = &dests[i]
+				break
+			}
+		}
+		if dest == nil {
+			return fmt.Errorf("%w: %s", store.ErrDestinationNotFound, args[0])
+		}
+		if err := planStore.DeleteDestination(dest.ID); err != nil {
+			return err
+		}
+		if jsonOutput {
+			return printJSON(dest)
+		}
+		fmt.Printf("Removed destination %s (%s)\n", dest.ID, dest.Name)
+		return nil
+	default:
+		return fmt.Errorf("unknown dest command: %s", cmd)
+	}
+}
+
+// expectArgs checks that exactly the named positional args were given
+func expectArgs(args []string, names ...string) error {
+	if len(args) == len(names) {
+		return nil
+	}
+	if len(args) < len(names) {
+		missing := names[len(args):]
+		return fmt.Errorf("requires <%s>", strings.Join(missing, "> <"))
+	}
+	return fmt.Errorf("unrecognized extra args: %s", strings.Join(args[len(names):], " "))
+}
+
+func findPlan(st *store.GlobalStore, id string) (store.Plan, error) {
+	plans, err := st.ListPlans()
+	if err != nil {
+		return store.Plan{}, err
+	}
+	for _, p := range plans {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return store.Plan{}, fmt.Errorf("%w: %s", store.ErrPlanNotFound, id)
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func printPlans(plans []store.Plan, jsonOutput bool) error {
+	if jsonOutput {
+		return printJSON(plans)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tCREATED")
+	for _, p := range plans {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", p.ID, p.Name, p.CreatedAt)
+	}
+	return tw.Flush()
+}
+
+func printDestinations(dests []store.Destination, jsonOutput bool) error {
+	sort.SliceStable(dests, func(i, j int) bool { return dests[i].Order < dests[j].Order })
+	if jsonOutput {
+		return printJSON(dests)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORDER\tID\tNAME\tCREATED")
+	for _, d := range dests {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", d.Order, d.ID, d.Name, d.CreatedAt)
+	}
+	return tw.Flush()
+}
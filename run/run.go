@@ -2,33 +2,75 @@ package run
 
 import (
 	"fmt"
+	"io/fs"
 	"strings"
 
 	"travel-map/server"
+	"travel-map/server/store"
 
 	"github.com/xhd2015/kool/pkgs/web"
 	"github.com/xhd2015/less-gen/flags"
 )
 
 const help = `
-Usage: travel-map <subcommand>
+Usage: travel-map [options]
+       travel-map <subcommand>
 
 Subcommands:
-  create    Create a new presentation
+  plan      List, create, rename and delete plans
+  dest      List, add, reorder and remove destinations of a plan
+  export    Export plans to a zip or JSON file (--format zip|json)
+  import    Import plans from a zip or JSON file, or stdin
+  convert   Copy all data between storage backends
+  migrate   Check or upgrade the layout of the data directory
+  doctor    Check the data for inconsistencies and fix the safe ones
+  gc        Remove uploaded images nothing refers to
+  config    Print the effective configuration
+
+Run 'travel-map <subcommand> --help' for details.
+
+Options:
+  --dev                      proxy the app to the frontend dev server
+  --component <name>         serve a single component ("list" to list them)
+` + configFlagsHelp + `
 `
 
-func Run(args []string) error {
+// Assets are the embedded frontend files passed in by main
+type Assets struct {
+	Dist         fs.FS  // React build, rooted at travel-map-react/dist
+	TemplateHTML string // component page template
+}
+
+func Run(args []string, assets Assets) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "convert":
+			return runConvert(args[1:])
+		case "migrate":
+			return runMigrate(args[1:])
+		case "doctor":
+			return runDoctor(args[1:])
+		case "gc":
+			return runGC(args[1:])
+		case "config":
+			return runConfig(args[1:])
+		case "plan":
+			return runPlan(args[1:])
+		case "dest":
+			return runDest(args[1:])
+		case "export":
+			return runExport(args[1:])
+		case "import":
+			return runImport(args[1:])
+		}
+	}
+
 	var devFlag bool
 	var component string
-	var apiPrefix string
-	var appPrefix string
-	var port int
-	args, err := flags.
+	var cf configFlags
+	args, err := cf.register(flags.
 		Bool("--dev", &devFlag).
-		String("--component", &component).
-		String("--api-prefix", &apiPrefix).
-		String("--app-prefix", &appPrefix).
-		Int("--port", &port).
+		String("--component", &component)).
 		Help("-h,--help", help).
 		Parse(args)
 	if err != nil {
@@ -44,6 +86,24 @@ func Run(args []string) error {
 		return nil
 	}
 
+	cfg, _, err := cf.resolve()
+	if err != nil {
+		return err
+	}
+
+	b, err := store.OpenBackend(cfg.Backend, cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	st := store.NewGlobalStoreWithBackend(b)
+	// Image URLs in the data embed the prefix the server runs with
+	st.SetAPIPrefix(cfg.APIPrefix)
+	if err := migrateOnStart(st, cfg); err != nil {
+		return err
+	}
+
+	port := cfg.Port
 	if port == 0 {
 		// next port
 		var err error
@@ -53,10 +113,22 @@ func Run(args []string) error {
 		}
 	}
 
+	serverOpts := server.Options{
+		Store:          st,
+		APIPrefix:      cfg.APIPrefix,
+		AppPrefix:      cfg.AppPrefix,
+		Assets:         assets.Dist,
+		AMapKey:        cfg.AMapKey,
+		MaxUploadBytes: cfg.MaxUploadBytes,
+		MaxImportBytes: cfg.MaxImportBytes,
+		OnDelete:       cfg.OnDelete,
+		Dev:            devFlag,
+	}
+
 	if component != "" {
-		var html string
 		if !devFlag {
-			html, err = server.FormatTemplateHtml(server.FormatOptions{
+			serverOpts.IndexHtml, err = server.FormatTemplateHtml(server.FormatOptions{
+				Template:  assets.TemplateHTML,
 				Component: component,
 			})
 			if err != nil {
@@ -64,10 +136,9 @@ func Run(args []string) error {
 			}
 		}
 		return server.ServeComponent(port, server.ServeOptions{
-			Dev: devFlag,
-			Static: server.StaticOptions{
-				IndexHtml: html,
-			},
+			Server:        serverOpts,
+			Host:          cfg.Host,
+			NoOpenBrowser: !cfg.OpenBrowser,
 			OpenBrowserUrl: func(port int, url string) string {
 				if devFlag {
 					return fmt.Sprintf("%s/?component=%s", url, component)
@@ -77,5 +148,9 @@ func Run(args []string) error {
 		})
 	}
 
-	return server.Serve(port, devFlag, apiPrefix, appPrefix)
+	return server.Serve(port, server.ServeOptions{
+		Server:        serverOpts,
+		Host:          cfg.Host,
+		NoOpenBrowser: !cfg.OpenBrowser,
+	})
 }
@@ -10,11 +10,11 @@ import (
 )
 
 type ServeOptions struct {
-	Static         StaticOptions
+	Server         Options
+	Host           string // Bind host; empty listens on all interfaces
 	NoOpenBrowser  bool
 	OpenBrowserUrl func(port int, url string) string
 	Route          func(mux *http.ServeMux) error // Optional custom route registration
-	Dev            bool
 }
 
 func ServeComponent(port int, opts ServeOptions) error {
@@ -26,34 +26,20 @@ func ServeComponent(port int, opts ServeOptions) error {
 		}
 	}
 
-	mux := http.NewServeMux()
+	srv, err := New(opts.Server)
+	if err != nil {
+		return err
+	}
 	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
+		Addr:         fmt.Sprintf("%s:%d", opts.Host, port),
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
-		Handler:      mux,
-	}
-
-	if opts.Dev {
-		err := ProxyDev(mux)
-		if err != nil {
-			return err
-		}
-	} else {
-		err := Static(mux, opts.Static)
-		if err != nil {
-			return err
-		}
-	}
-
-	err := RegisterAPI(mux, "")
-	if err != nil {
-		return err
+		Handler:      srv.Handler(),
 	}
 
 	// Register custom routes if provided
 	if opts.Route != nil {
-		err = opts.Route(mux)
+		err = opts.Route(srv.mux)
 		if err != nil {
 			return err
 		}
@@ -79,6 +65,7 @@ func ServeComponent(port int, opts ServeOptions) error {
 
 // FormatOptions contains the options for formatting the template HTML
 type FormatOptions struct {
+	Template       string // template HTML containing the placeholders (mandatory)
 	Title          string // __TITLE__ placeholder
 	Render         string // __RENDER__ placeholder (default: "renderComponent")
 	Component      string // __COMPONENT__ placeholder (mandatory)
@@ -91,6 +78,9 @@ func FormatTemplateHtml(opts FormatOptions) (string, error) {
 	if opts.Component == "" {
 		return "", fmt.Errorf("requires component")
 	}
+	if opts.Template == "" {
+		return "", fmt.Errorf("requires template")
+	}
 
 	// Set defaults
 	title := opts.Title
@@ -109,7 +99,7 @@ func FormatTemplateHtml(opts FormatOptions) (string, error) {
 	}
 
 	// Replace placeholders
-	result := templateHTML
+	result := opts.Template
 	result = strings.ReplaceAll(result, "__TITLE__", title)
 	result = strings.ReplaceAll(result, "__RENDER__", render)
 	result = strings.ReplaceAll(result, "__COMPONENT__", opts.Component)
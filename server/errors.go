@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"travel-map/server/store"
+)
+
+// Error codes of failed API requests, the "code" of the error envelope
+const (
+	CodeBadRequest          = "bad_request"
+	CodeInvalidID           = "invalid_id"
+	CodeInvalidContent      = "invalid_content"
+	CodeInvalidImport       = "invalid_import"
+	CodeNotFound            = "not_found"
+	CodePlanNotFound        = "plan_not_found"
+	CodeDestinationNotFound = "destination_not_found"
+	CodeItemNotFound        = "item_not_found"
+	CodeConflict            = "conflict" // a stale If-Match
+	CodeDuplicateID         = "duplicate_id"
+	CodeReferenced          = "referenced" // removing an item others refer to
+	CodeMethodNotAllowed    = "method_not_allowed"
+	CodeTooLarge            = "too_large"
+	CodeUnsupportedType     = "unsupported_type"
+	CodeAMapKeyMissing      = "amap_key_missing"
+	CodeUpstream            = "upstream_error"
+	CodeInternal            = "internal"
+)
+
+// RequestIDHeader carries the request ID. A client may send its own,
+// otherwise one is made; either way it is sent back and appears in
+// errors and the server log.
+const RequestIDHeader = "X-Request-ID"
+
+// apiError is the body of every failed API request:
+//
+//	{"error": {"code": "plan_not_found", "message": "plan not found: 01J...", "field": "planId", "request_id": "..."}}
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Field     string `json:"field,omitempty"` // the query parameter or content field at fault
+	RequestID string `json:"request_id"`
+	// Current is the content a stale save conflicted with, for sections
+	Current interface{} `json:"current,omitempty"`
+}
+
+// errMissingParam is the error of a required query or form value left out
+var errMissingParam = errors.New("missing parameter")
+
+type requestIDKey struct{}
+
+// withRequestID gives the request an ID
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID accepts client IDs of up to 64 visible ASCII characters,
+// so they are safe to log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func requestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// writeError answers a failed request with the error envelope. Server
+// errors are logged with the request ID.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, field string, message string) {
+	id := requestID(r)
+	if status >= http.StatusInternalServerError {
+		fmt.Printf("Error: %s %s %s [%s]: %s\n", r.Method, r.URL.Path, code, id, message)
+	}
+	writeEnvelope(w, status, apiError{Code: code, Message: message, Field: field, RequestID: id})
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, e apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error apiError `json:"error"`
+	}{e})
+}
+
+// writeConflict answers a save made against a stale revision with the
+// current content and its revision in the ETag header, so the client can
+// merge without another request
+func writeConflict(w http.ResponseWriter, r *http.Request, err error, rev string, current interface{}) {
+	w.Header().Set("ETag", rev)
+	writeEnvelope(w, http.StatusConflict, apiError{Code: CodeConflict, Message: err.Error(), RequestID: requestID(r), Current: current})
+}
+
+// writeStoreError answers err, choosing status and code by the store
+// errors it wraps. Other errors get status, with the code that goes with
+// it. The field is taken from a store.FieldError in err.
+func writeStoreError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	var field string
+	var fe *store.FieldError
+	if errors.As(err, &fe) {
+		field = fe.Field
+	}
+	code := statusCode(status)
+	switch {
+	case errors.Is(err, store.ErrInvalidID):
+		status, code = http.StatusBadRequest, CodeInvalidID
+	case errors.Is(err, store.ErrInvalidContent):
+		status, code = http.StatusBadRequest, CodeInvalidContent
+	case errors.Is(err, store.ErrInvalidImport), errors.Is(err, store.ErrExportTooNew):
+		status, code = http.StatusBadRequest, CodeInvalidImport
+	case errors.Is(err, store.ErrPlanNotFound):
+		status, code = http.StatusNotFound, CodePlanNotFound
+	case errors.Is(err, store.ErrDestinationNotFound):
+		status, code = http.StatusNotFound, CodeDestinationNotFound
+	case errors.Is(err, store.ErrItemNotFound):
+		status, code = http.StatusNotFound, CodeItemNotFound
+	case errors.Is(err, store.ErrConflict):
+		status, code = http.StatusConflict, CodeConflict
+	case errors.Is(err, store.ErrDuplicateItemID):
+		status, code = http.StatusConflict, CodeDuplicateID
+	case errors.Is(err, store.ErrReferenced):
+		status, code = http.StatusConflict, CodeReferenced
+	case errors.Is(err, store.ErrTooLarge):
+		status, code = http.StatusRequestEntityTooLarge, CodeTooLarge
+	case errors.Is(err, store.ErrUnsupportedImage):
+		status, code = http.StatusUnsupportedMediaType, CodeUnsupportedType
+	}
+	writeError(w, r, status, code, field, err.Error())
+}
+
+// statusCode is the code of errors that are known only by their status
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeTooLarge
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedType
+	case http.StatusBadGateway:
+		return CodeUpstream
+	}
+	return CodeInternal
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "", "Method not allowed")
+}
+
+// missingParam answers a request without a required query or form value
+func missingParam(w http.ResponseWriter, r *http.Request, name string) {
+	writeStoreError(w, r, http.StatusBadRequest, &store.FieldError{Field: name, Err: errMissingParam})
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"travel-map/server/store"
+)
+
+// itemHandlers serve one list section item by item
+type itemHandlers struct {
+	// collection serves path: POST with a JSON object adds one item, anything
+	// else goes to the whole-section handler, so POST with an array still
+	// replaces the section
+	collection http.HandlerFunc
+	// item serves path/{id}: GET, PUT, PATCH and DELETE, which takes
+	// ?onDelete= like a POST of the whole section
+	item http.HandlerFunc
+}
+
+// serveItems builds the item handlers of a list section. section is the
+// handler of the whole section. Revisions are those of the section file,
+// sent in the ETag header and checked against If-Match like for the whole
+// section.
+func serveItems(a *api, items store.Items, section http.HandlerFunc) itemHandlers {
+	collection := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			section(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeStoreError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if trimmed := bytes.TrimSpace(body); len(trimmed) == 0 || trimmed[0] != '{' {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			section(w, r)
+			return
+		}
+		s, err := a.getDestinationStore(r)
+		if err != nil {
+			writeStoreError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		item, rev, err := items.AddItem(s, body, r.Header.Get("If-Match"))
+		if err != nil {
+			writeItemError(w, r, err, rev)
+			return
+		}
+		writeItem(w, http.StatusCreated, item, rev)
+	}
+
+	item := func(w http.ResponseWriter, r *http.Request) {
+		s, err := a.getDestinationStore(r)
+		if err != nil {
+			writeStoreError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		id := r.PathValue("id")
+		ifMatch := r.Header.Get("If-Match")
+		switch r.Method {
+		case http.MethodGet:
+			item, rev, err := items.GetItem(s, id)
+			if err != nil {
+				writeItemError(w, r, err, rev)
+				return
+			}
+			writeItem(w, http.StatusOK, item, rev)
+		case http.MethodPut, http.MethodPatch:
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeStoreError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			var item interface{}
+			var rev string
+			if r.Method == http.MethodPut {
+				item, rev, err = items.PutItem(s, id, body, ifMatch)
+			} else {
+				item, rev, err = items.PatchItem(s, id, body, ifMatch)
+			}
+			if err != nil {
+				writeItemError(w, r, err, rev)
+				return
+			}
+			writeItem(w, http.StatusOK, item, rev)
+		case http.MethodDelete:
+			onDelete, err := a.deletePolicy(r)
+			if err != nil {
+				writeStoreError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			rev, err := items.DeleteItem(s, id, ifMatch, onDelete)
+			if err != nil {
+				writeItemError(w, r, err, rev)
+				return
+			}
+			w.Header().Set("ETag", rev)
+			w.WriteHeader(http.StatusOK)
+		default:
+			methodNotAllowed(w, r)
+		}
+	}
+	return itemHandlers{collection: collection, item: item}
+}
+
+func writeItem(w http.ResponseWriter, status int, item interface{}, rev string) {
+	w.Header().Set("ETag", rev)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(item)
+}
+
+// writeItemError answers a failed item operation. On a conflict the
+// current revision is sent so the client can reload and retry.
+func writeItemError(w http.ResponseWriter, r *http.Request, err error, rev string) {
+	if errors.Is(err, store.ErrConflict) {
+		w.Header().Set("ETag", rev)
+	}
+	if errors.Is(err, store.ErrItemNotFound) {
+		err = &store.FieldError{Field: "id", Err: err}
+	}
+	writeStoreError(w, r, http.StatusInternalServerError, err)
+}
+
+// sectionDoc describes one section in the API listing
+type sectionDoc struct {
+	Name      string   `json:"name"`
+	File      string   `json:"file"`
+	Doc       string   `json:"doc"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// handleSections lists the destination sections and their endpoints
+func (a *api) handleSections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	const query = "?planId={planId}&destId={destId}"
+	docs := make([]sectionDoc, 0, len(store.Sections))
+	for _, sec := range store.Sections {
+		path := a.prefix + sec.Path()
+		doc := sectionDoc{
+			Name: sec.Name(),
+			File: sec.File(),
+			Doc:  sec.Doc(),
+			Endpoints: []string{
+				"GET " + path + query,
+				"POST " + path + query,
+			},
+		}
+		if sec.Items() != nil {
+			doc.Endpoints = append(doc.Endpoints,
+				"GET "+path+"/{id}"+query,
+				"PUT "+path+"/{id}"+query,
+				"PATCH "+path+"/{id}"+query,
+				"DELETE "+path+"/{id}"+query,
+			)
+		}
+		docs = append(docs, doc)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(docs)
+}
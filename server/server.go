@@ -1,9 +1,10 @@
 package server
 
 import (
+	"bufio"
 	"context"
-	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -15,27 +16,128 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"travel-map/server/store"
 
 	"github.com/xhd2015/kool/pkgs/web"
 )
 
-var distFS embed.FS
-var templateHTML string
-var globalStore *store.GlobalStore
+// DefaultDataDir is where the file store lives unless configured otherwise
+const DefaultDataDir = "travel-data"
+
+// DefaultMaxUploadBytes limits uploaded files unless configured otherwise
+const DefaultMaxUploadBytes = 10 << 20
+
+// DefaultMaxImportBytes limits import requests unless configured otherwise
+const DefaultMaxImportBytes = 256 << 20
+
+// Options configures a Server
+type Options struct {
+	Store      *store.GlobalStore // Store to serve; defaults to a file store in DataDir
+	DataDir    string             // Data directory used when Store is nil (default: DefaultDataDir)
+	APIPrefix  string             // URL prefix for the API (default: "/api")
+	AppPrefix  string             // URL prefix for the app
+	Assets     fs.FS              // React build (travel-map-react/dist); nil serves the API only
+	IndexHtml  string             // Custom HTML content to serve instead of the embedded index.html
+	HTTPClient *http.Client       // Client for outbound calls such as the map search proxy (default: http.DefaultClient)
+	AMapKey    string             // AMAP (Gaode) web service key for the search proxy
+
+	MaxUploadBytes int64 // Upload size limit (default: DefaultMaxUploadBytes)
+	MaxImportBytes int64 // Import request size limit (default: DefaultMaxImportBytes)
+	Dev            bool  // Proxy the app to the frontend dev server instead of serving Assets
+	// OnDelete is what removing a spot that routes refer to does:
+	// store.DeleteCascade (default) or store.DeleteRestrict. Requests may
+	// override it with ?onDelete=.
+	OnDelete string
+}
+
+// Server is one travel-map instance. Several can be mounted in the same
+// process, each with its own store and prefixes.
+type Server struct {
+	opts  Options
+	store *store.GlobalStore
+	mux   *http.ServeMux
+}
+
+// New builds a Server and registers all its routes
+func New(opts Options) (*Server, error) {
+	if opts.APIPrefix == "" {
+		opts.APIPrefix = "/api"
+	}
+	st := opts.Store
+	if st == nil {
+		dataDir := opts.DataDir
+		if dataDir == "" {
+			dataDir = DefaultDataDir
+		}
+		st = store.NewGlobalStore(dataDir)
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if opts.MaxUploadBytes <= 0 {
+		opts.MaxUploadBytes = DefaultMaxUploadBytes
+	}
+	if opts.MaxImportBytes <= 0 {
+		opts.MaxImportBytes = DefaultMaxImportBytes
+	}
+	if err := store.CheckDeletePolicy(opts.OnDelete); err != nil {
+		return nil, err
+	}
+	if opts.OnDelete == "" {
+		opts.OnDelete = store.DefaultDeletePolicy
+	}
 
-func init() {
-	globalStore = store.NewGlobalStore("travel-data")
+	s := &Server{
+		opts:  opts,
+		store: st,
+		mux:   http.NewServeMux(),
+	}
+	if opts.Dev {
+		if err := ProxyDev(s.mux); err != nil {
+			return nil, err
+		}
+	} else if opts.Assets != nil {
+		err := Static(s.mux, StaticOptions{
+			Assets:    opts.Assets,
+			IndexHtml: opts.IndexHtml,
+			AppPrefix: opts.AppPrefix,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	a := &api{
+		store:          st,
+		client:         client,
+		amapKey:        opts.AMapKey,
+		maxUploadBytes: opts.MaxUploadBytes,
+		maxImportBytes: opts.MaxImportBytes,
+		onDelete:       opts.OnDelete,
+	}
+	if err := registerAPI(s.mux, opts.APIPrefix, a); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-func Init(fs embed.FS, tmpl string) {
-	distFS = fs
-	templateHTML = tmpl
+// Handler returns the http.Handler serving the app and its API
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Store returns the store the server serves
+func (s *Server) Store() *store.GlobalStore {
+	return s.store
 }
 
 func checkPort(port int) bool {
@@ -95,16 +197,15 @@ func EnsureFrontendDevServer(ctx context.Context, apiPrefix string, appPrefix st
 	return nil, fmt.Errorf("frontend server failed to start within timeout")
 }
 
-func Serve(port int, dev bool, apiPrefix string, appPrefix string) error {
-	mux := http.NewServeMux()
+func Serve(port int, serveOpts ServeOptions) error {
+	opts := serveOpts.Server
 	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
+		Addr:         fmt.Sprintf("%s:%d", serveOpts.Host, port),
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
-		Handler:      mux,
 	}
 
-	if dev {
+	if opts.Dev {
 		if !checkPort(5173) {
 			// Create context for managing subprocesses
 			ctx, cancel := context.WithCancel(context.Background())
@@ -123,7 +224,7 @@ func Serve(port int, dev bool, apiPrefix string, appPrefix string) error {
 				}
 			}()
 
-			subProcessDone, err := EnsureFrontendDevServer(ctx, apiPrefix, appPrefix)
+			subProcessDone, err := EnsureFrontendDevServer(ctx, opts.APIPrefix, opts.AppPrefix)
 			if err != nil {
 				return err
 			}
@@ -134,38 +235,29 @@ func Serve(port int, dev bool, apiPrefix string, appPrefix string) error {
 				}()
 			}
 		}
-
-		err := ProxyDev(mux)
-		if err != nil {
-			return err
-		}
-	} else {
-		err := Static(mux, StaticOptions{
-			AppPrefix: appPrefix,
-		})
-		if err != nil {
-			return err
-		}
 	}
 
-	err := RegisterAPI(mux, apiPrefix)
+	srv, err := New(opts)
 	if err != nil {
 		return err
 	}
+	server.Handler = srv.Handler()
 
 	serveURL := fmt.Sprintf("http://localhost:%d", port)
-	if appPrefix != "" {
-		if !strings.HasPrefix(appPrefix, "/") {
+	if opts.AppPrefix != "" {
+		if !strings.HasPrefix(opts.AppPrefix, "/") {
 			serveURL += "/"
 		}
-		serveURL += appPrefix
+		serveURL += opts.AppPrefix
 	}
 	fmt.Printf("Serving directory preview at %s\n", serveURL)
 
-	go func() {
-		time.Sleep(1 * time.Second)
-		web.OpenBrowser(serveURL)
-	}()
+	if !serveOpts.NoOpenBrowser {
+		go func() {
+			time.Sleep(1 * time.Second)
+			web.OpenBrowser(serveURL)
+		}()
+	}
 
 	return server.ListenAndServe()
 }
@@ -186,15 +278,16 @@ func ProxyDev(mux *http.ServeMux) error {
 }
 
 type StaticOptions struct {
+	Assets    fs.FS  // React build (travel-map-react/dist)
 	IndexHtml string // Custom HTML content to serve instead of embedded index.html
 	AppPrefix string // URL prefix for the app
 }
 
 func Static(mux *http.ServeMux, opts StaticOptions) error {
 	// Serve static files from the embedded React build
-	reactFileSystem, err := fs.Sub(distFS, "travel-map-react/dist")
-	if err != nil {
-		return fmt.Errorf("failed to create react file system: %v", err)
+	reactFileSystem := opts.Assets
+	if reactFileSystem == nil {
+		return fmt.Errorf("missing react assets")
 	}
 
 	// Create sub-filesystem for assets
@@ -261,60 +354,175 @@ func Static(mux *http.ServeMux, opts StaticOptions) error {
 	return nil
 }
 
-func RegisterAPI(mux *http.ServeMux, prefix string) error {
+// api holds the dependencies of the HTTP handlers
+type api struct {
+	store          *store.GlobalStore
+	prefix         string // API URL prefix, set by registerAPI
+	client         *http.Client
+	amapKey        string
+	maxUploadBytes int64
+	maxImportBytes int64
+	onDelete       string // default delete policy, see Options.OnDelete
+}
+
+// RegisterAPIWithStore registers only the API handlers serving st, e.g. a
+// store.NewMemoryStore() for tests and ephemeral instances.
+func RegisterAPIWithStore(mux *http.ServeMux, prefix string, st *store.GlobalStore) error {
 	if prefix == "" {
 		prefix = "/api"
 	}
-	globalStore.SetAPIPrefix(prefix)
+	return registerAPI(mux, prefix, &api{
+		store:          st,
+		client:         http.DefaultClient,
+		amapKey:        os.Getenv("AMAP_KEY"),
+		maxUploadBytes: DefaultMaxUploadBytes,
+		maxImportBytes: DefaultMaxImportBytes,
+		onDelete:       store.DefaultDeletePolicy,
+	})
+}
+
+func registerAPI(mux *http.ServeMux, prefix string, a *api) error {
+	a.prefix = prefix
+	a.store.SetAPIPrefix(prefix)
 
 	// Ensure directory exists
-	if err := globalStore.EnsureDir(); err != nil {
+	if err := a.store.EnsureDir(); err != nil {
 		fmt.Printf("Warning: Failed to ensure data directory: %v\n", err)
 	}
 
+	// Repair or quarantine files left half-written by a crash
+	actions, err := a.store.Recover()
+	if err != nil {
+		fmt.Printf("Warning: Failed to recover data directory: %v\n", err)
+	}
+	for _, action := range actions {
+		fmt.Printf("Recovery: %s %s %s\n", action.Action, action.Path, action.Detail)
+	}
+
+	// Refuse data of another layout version rather than misreading it
+	if err := a.store.CheckLayout(); err != nil {
+		return err
+	}
+
 	// Serve user data
 	dataPath := prefix
 	if !strings.HasSuffix(dataPath, "/") {
 		dataPath += "/"
 	}
 	dataPath += "data/"
-	mux.Handle(dataPath, http.StripPrefix(dataPath, http.FileServer(http.Dir(globalStore.Dir))))
+	mux.Handle(dataPath, withRequestID(http.StripPrefix(dataPath, a.dataHandler())))
 
 	// Helper to handle paths with prefix
 	handleFunc := func(path string, handler func(http.ResponseWriter, *http.Request)) {
 		// path is like "/plans"
 		fullPath := prefix + path
-		mux.HandleFunc(fullPath, handler)
+		mux.Handle(fullPath, withRequestID(http.HandlerFunc(handler)))
 	}
 
 	// API endpoints
-	handleFunc("/plans", handlePlans)
-	handleFunc("/destinations", handleDestinations)
-	handleFunc("/spots", handleSpots)
-	handleFunc("/foods", handleFoods)
-	handleFunc("/routes", handleRoutes)
-	handleFunc("/questions", handleQuestions)
-	handleFunc("/references", handleReferences)
-	handleFunc("/config", handleConfig)
-	handleFunc("/guide-images", handleGuideImages)
-	handleFunc("/schedules", handleSchedules)
-	handleFunc("/itineraries", handleItineraries)
-	handleFunc("/upload-guide-image", handleUploadGuideImage)
-	handleFunc("/proxy/search", handleProxySearch)
-	handleFunc("/export", handleExport)
-	handleFunc("/import", handleImport)
+	handleFunc("/plans", a.handlePlans)
+	handleFunc("/destinations", a.handleDestinations)
+	// Destination sections, see store.Sections. List sections are also
+	// served item by item under path/{id}.
+	for _, sec := range store.Sections {
+		section := func(w http.ResponseWriter, r *http.Request) { a.serveSection(w, r, sec) }
+		if items := sec.Items(); items != nil {
+			h := serveItems(a, items, section)
+			handleFunc(sec.Path(), h.collection)
+			handleFunc(sec.Path()+"/{id}", h.item)
+		} else {
+			handleFunc(sec.Path(), section)
+		}
+	}
+	handleFunc("/sections", a.handleSections)
+	handleFunc("/upload-guide-image", a.handleUploadGuideImage)
+	handleFunc("/proxy/search", a.handleProxySearch)
+	handleFunc("/export", a.handleExport)
+	handleFunc("/import", a.handleImport)
+	handleFunc("/admin/check", a.handleAdminCheck)
+	handleFunc("/admin/gc", a.handleAdminGC)
 	mux.HandleFunc("/ping", handlePing)
 
 	return nil
 }
 
+// dataHandler serves the stored files. Images take ?w=<pixels> to get a
+// resized variant instead, made on first request and cached.
+func (a *api) dataHandler() http.Handler {
+	files := http.FileServer(http.FS(a.store.Backend))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Serve stored files as inert data: no type guessing by the browser,
+		// and no scripts should an imported SVG carry any
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		if key == "" {
+			key = "."
+		}
+		// Missing files get the error envelope, not the file server's
+		// plain-text 404
+		serveFile := func() {
+			if _, err := fs.Stat(a.store.Backend, key); err != nil {
+				writeDataError(w, r, key, err)
+				return
+			}
+			files.ServeHTTP(w, r)
+		}
+		width := r.URL.Query().Get("w")
+		if width == "" {
+			serveFile()
+			return
+		}
+		n, err := strconv.Atoi(width)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "w", "Invalid w")
+			return
+		}
+		thumb, err := a.store.Thumbnail(key, n)
+		if errors.Is(err, store.ErrNoThumbnail) {
+			serveFile()
+			return
+		}
+		if err != nil {
+			writeDataError(w, r, key, err)
+			return
+		}
+		f, err := a.store.Backend.Open(thumb)
+		if err != nil {
+			writeStoreError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			writeStoreError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		rs, ok := f.(io.ReadSeeker)
+		if !ok {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "", "thumbnail not seekable")
+			return
+		}
+		http.ServeContent(w, r, path.Base(thumb), info.ModTime(), rs)
+	})
+}
+
+// writeDataError answers a failed read of the stored file at key
+func writeDataError(w http.ResponseWriter, r *http.Request, key string, err error) {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "", "file not found: "+key)
+		return
+	}
+	writeStoreError(w, r, http.StatusInternalServerError, err)
+}
+
 func handlePing(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("pong"))
 }
 
-func handleExport(w http.ResponseWriter, r *http.Request) {
+func (a *api) handleExport(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
 		return
 	}
 
@@ -324,38 +532,207 @@ func handleExport(w http.ResponseWriter, r *http.Request) {
 		planIds = strings.Split(idsParam, ",")
 	}
 
-	fullPlans, err := globalStore.ExportPlans(planIds)
+	// format=zip streams an archive with the raw image files; the
+	// default JSON with base64 images is kept for older clients
+	out := streamWriter(w)
+	if r.URL.Query().Get("format") == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename=travel-map-export.zip")
+		if _, err := a.store.ExportArchive(out, planIds); err != nil {
+			// Headers are gone already; the truncated archive will not open
+			fmt.Printf("Export archive failed: %v\n", err)
+		}
+		return
+	}
+
+	fullPlans, err := a.store.ExportPlans(planIds)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeStoreError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Content-Disposition", "attachment; filename=travel-map-export.json")
-	json.NewEncoder(w).Encode(fullPlans)
+	json.NewEncoder(out).Encode(store.NewExport(fullPlans))
+}
+
+// streamIdleTimeout is how long a streamed export or import may stall.
+// Large archives take longer than the server's read and write timeouts,
+// so these requests push their deadlines forward as data moves instead.
+var streamIdleTimeout = 30 * time.Second
+
+// deadlineWriter extends the write deadline of a response on every write
+type deadlineWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func streamWriter(w http.ResponseWriter) io.Writer {
+	return deadlineWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+func (d deadlineWriter) Write(p []byte) (int, error) {
+	// Not every ResponseWriter supports deadlines; those have none to extend
+	d.rc.SetWriteDeadline(time.Now().Add(streamIdleTimeout))
+	return d.w.Write(p)
+}
+
+// deadlineReader extends the read deadline of a request body on every
+// read, and the write deadline too, so the response can still be sent
+// after a long upload
+type deadlineReader struct {
+	io.ReadCloser
+	rc *http.ResponseController
+}
+
+func streamBody(w http.ResponseWriter, r *http.Request) io.ReadCloser {
+	return deadlineReader{ReadCloser: r.Body, rc: http.NewResponseController(w)}
 }
 
-func handleImport(w http.ResponseWriter, r *http.Request) {
+func (d deadlineReader) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(streamIdleTimeout)
+	d.rc.SetReadDeadline(deadline)
+	d.rc.SetWriteDeadline(deadline)
+	return d.ReadCloser.Read(p)
+}
+
+func (a *api) handleImport(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
 		return
 	}
-	var fullPlans []store.FullPlan
-	if err := json.NewDecoder(r.Body).Decode(&fullPlans); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	query := r.URL.Query()
+	opts := store.ImportOptions{
+		DryRun:     query.Get("dryRun") == "true",
+		PlanID:     query.Get("planId"),
+		OnConflict: query.Get("onConflict"),
+	}
+	if err := store.CheckConflictPolicy(opts.OnConflict); err != nil {
+		writeStoreError(w, r, http.StatusBadRequest, &store.FieldError{Field: "onConflict", Err: err})
 		return
 	}
-	if err := globalStore.ImportPlans(fullPlans); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+	// Accept both a ZIP archive and a JSON export of any schema version
+	var report store.ImportReport
+	var err error
+	body := bufio.NewReader(http.MaxBytesReader(w, streamBody(w, r), a.maxImportBytes))
+	head, _ := body.Peek(4)
+	if store.IsArchive(head) {
+		report, err = a.store.ImportArchiveFrom(body, opts)
+	} else {
+		var data []byte
+		data, err = io.ReadAll(body)
+		if err != nil {
+			writeImportReadError(w, r, a.maxImportBytes, err)
+			return
+		}
+		var exp store.Export
+		var version int
+		exp, version, err = store.DecodeExport(data)
+		if err != nil {
+			writeStoreError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		report, err = a.store.Import(exp.Plans, opts)
+		report.SourceVersion = version
+	}
+	// Storing the images may have taken a while since the last read
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(streamIdleTimeout))
+
+	if errors.Is(err, store.ErrExportTooNew) {
+		writeStoreError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeImportReadError(w, r, a.maxImportBytes, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, store.ErrInvalidImport) {
+		// The report lists the problems; an unreadable archive has none
+		if len(report.Problems) == 0 {
+			writeStoreError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
 }
 
-func handlePlans(w http.ResponseWriter, r *http.Request) {
+// writeImportReadError answers an import whose body could not be read
+func writeImportReadError(w http.ResponseWriter, r *http.Request, limit int64, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, CodeTooLarge, "", fmt.Sprintf("Import too large, the limit is %d bytes", limit))
+		return
+	}
+	writeStoreError(w, r, http.StatusBadRequest, err)
+}
+
+// handleAdminCheck reports inconsistencies of the data; POST with fix=true
+// also repairs the safe ones
+func (a *api) handleAdminCheck(w http.ResponseWriter, r *http.Request) {
+	fix := r.URL.Query().Get("fix") == "true"
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+	if fix && r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "fix", "fix=true requires POST")
+		return
+	}
+	report, err := a.store.Check(fix)
+	if err != nil {
+		writeStoreError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleAdminGC removes unreferenced images. Query: dryRun=true,
+// quarantine=true, grace=<duration> (default 24h).
+func (a *api) handleAdminGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+	q := r.URL.Query()
+	opts := store.GCOptions{
+		DryRun:     q.Get("dryRun") == "true",
+		Quarantine: q.Get("quarantine") == "true",
+	}
+	if grace := q.Get("grace"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "grace", "Invalid grace: "+err.Error())
+			return
+		}
+		if d == 0 {
+			d = -1
+		}
+		opts.GracePeriod = d
+	}
+	report, err := a.store.CollectGarbage(opts)
+	if err != nil {
+		writeStoreError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (a *api) handlePlans(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		plans, err := globalStore.ListPlans()
+		plans, err := a.store.ListPlans()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, r, http.StatusInternalServerError, err)
 			return
 		}
 		json.NewEncoder(w).Encode(plans)
@@ -366,12 +743,12 @@ func handlePlans(w http.ResponseWriter, r *http.Request) {
 			Name string `json:"name"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeStoreError(w, r, http.StatusBadRequest, err)
 			return
 		}
-		newPlan, err := globalStore.CreatePlan(payload.Name)
+		newPlan, err := a.store.CreatePlan(payload.Name)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, r, http.StatusInternalServerError, err)
 			return
 		}
 		json.NewEncoder(w).Encode(newPlan)
@@ -380,16 +757,16 @@ func handlePlans(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPut {
 		id := r.URL.Query().Get("id")
 		if id == "" {
-			http.Error(w, "Missing id", http.StatusBadRequest)
+			missingParam(w, r, "id")
 			return
 		}
 		var update store.Plan
 		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeStoreError(w, r, http.StatusBadRequest, err)
 			return
 		}
-		if err := globalStore.UpdatePlan(id, update); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := a.store.UpdatePlan(id, update); err != nil {
+			writeStoreError(w, r, http.StatusInternalServerError, &store.FieldError{Field: "id", Err: err})
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -398,37 +775,43 @@ func handlePlans(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodDelete {
 		id := r.URL.Query().Get("id")
 		if id == "" {
-			http.Error(w, "Missing id", http.StatusBadRequest)
+			missingParam(w, r, "id")
 			return
 		}
-		if err := globalStore.DeletePlan(id); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := a.store.DeletePlan(id); err != nil {
+			writeStoreError(w, r, http.StatusInternalServerError, &store.FieldError{Field: "id", Err: err})
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	methodNotAllowed(w, r)
 }
 
-func getPlanStore(r *http.Request) (*store.PlanStore, error) {
+// getPlanStore returns the store of the plan named by ?planId=, which must
+// exist. Errors name the parameter.
+func (a *api) getPlanStore(r *http.Request) (*store.PlanStore, error) {
 	planID := r.URL.Query().Get("planId")
 	if planID == "" {
-		return nil, fmt.Errorf("missing planId query parameter")
+		return nil, &store.FieldError{Field: "planId", Err: errMissingParam}
 	}
-	return globalStore.GetPlanStore(planID), nil
+	planStore, err := a.store.OpenPlan(planID)
+	if err != nil {
+		return nil, &store.FieldError{Field: "planId", Err: err}
+	}
+	return planStore, nil
 }
 
-func handleDestinations(w http.ResponseWriter, r *http.Request) {
-	s, err := getPlanStore(r)
+func (a *api) handleDestinations(w http.ResponseWriter, r *http.Request) {
+	s, err := a.getPlanStore(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeStoreError(w, r, http.StatusBadRequest, err)
 		return
 	}
 	if r.Method == http.MethodGet {
 		dests, err := s.ListDestinations()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, r, http.StatusInternalServerError, err)
 			return
 		}
 		json.NewEncoder(w).Encode(dests)
@@ -439,12 +822,12 @@ func handleDestinations(w http.ResponseWriter, r *http.Request) {
 			Name string `json:"name"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeStoreError(w, r, http.StatusBadRequest, err)
 			return
 		}
 		newDest, err := s.CreateDestination(payload.Name)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, r, http.StatusInternalServerError, err)
 			return
 		}
 		json.NewEncoder(w).Encode(newDest)
@@ -453,16 +836,16 @@ func handleDestinations(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPut {
 		id := r.URL.Query().Get("id")
 		if id == "" {
-			http.Error(w, "Missing id", http.StatusBadRequest)
+			missingParam(w, r, "id")
 			return
 		}
 		var update store.Destination
 		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeStoreError(w, r, http.StatusBadRequest, err)
 			return
 		}
 		if err := s.UpdateDestination(id, update); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, r, http.StatusInternalServerError, &store.FieldError{Field: "id", Err: err})
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -471,395 +854,247 @@ func handleDestinations(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodDelete {
 		id := r.URL.Query().Get("id")
 		if id == "" {
-			http.Error(w, "Missing id", http.StatusBadRequest)
+			missingParam(w, r, "id")
 			return
 		}
 		if err := s.DeleteDestination(id); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, r, http.StatusInternalServerError, &store.FieldError{Field: "id", Err: err})
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	methodNotAllowed(w, r)
 }
 
-func getDestinationStore(r *http.Request) (*store.DestinationStore, error) {
+func (a *api) getDestinationStore(r *http.Request) (*store.DestinationStore, error) {
 	planID := r.URL.Query().Get("planId")
 	if planID == "" {
-		return nil, fmt.Errorf("missing planId query parameter")
+		return nil, &store.FieldError{Field: "planId", Err: errMissingParam}
 	}
 	destID := r.URL.Query().Get("destId")
 	if destID == "" {
-		return nil, fmt.Errorf("missing destId query parameter")
+		return nil, &store.FieldError{Field: "destId", Err: errMissingParam}
 	}
-	return globalStore.GetPlanStore(planID).GetDestinationStore(destID), nil
+	return a.destinationStore(planID, destID)
 }
 
-func handleSpots(w http.ResponseWriter, r *http.Request) {
-	s, err := getDestinationStore(r)
+// destinationStore returns the store of a destination named by a request,
+// which must exist in the plan. Errors name the parameter at fault.
+func (a *api) destinationStore(planID string, destID string) (*store.DestinationStore, error) {
+	planStore, err := a.store.OpenPlan(planID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	if r.Method == http.MethodGet {
-		spots, err := s.LoadSpots()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		json.NewEncoder(w).Encode(spots)
-		return
+		return nil, &store.FieldError{Field: "planId", Err: err}
 	}
-	if r.Method == http.MethodPost {
-		var spots []store.Spot
-		if err := json.NewDecoder(r.Body).Decode(&spots); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		if err := s.SaveSpots(spots); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-}
-
-func handleFoods(w http.ResponseWriter, r *http.Request) {
-	s, err := getDestinationStore(r)
+	destStore, err := planStore.OpenDestination(destID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	if r.Method == http.MethodGet {
-		foods, err := s.LoadFoods()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		json.NewEncoder(w).Encode(foods)
-		return
+		return nil, &store.FieldError{Field: "destId", Err: err}
 	}
-	if r.Method == http.MethodPost {
-		var foods []store.Food
-		if err := json.NewDecoder(r.Body).Decode(&foods); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		if err := s.SaveFoods(foods); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return destStore, nil
 }
 
-func handleRoutes(w http.ResponseWriter, r *http.Request) {
-	s, err := getDestinationStore(r)
+// serveSection serves GET and POST for one destination section file.
+// GET returns the section with its revision in the ETag header. POST
+// replaces the whole section after validating it and giving items without
+// an ID, or with a duplicate one, a new ID; it responds with the content
+// as saved. If If-Match is given and stale, it responds 409 with the
+// current content as error.current and its revision as the ETag, so the
+// client can merge. Dropping spots that routes refer to follows the
+// delete policy.
+func (a *api) serveSection(w http.ResponseWriter, r *http.Request, sec store.Section) {
+	filename := sec.File()
+	newValue := sec.New
+	s, err := a.getDestinationStore(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeStoreError(w, r, http.StatusBadRequest, err)
 		return
 	}
 	if r.Method == http.MethodGet {
-		routes, err := s.LoadRoutes()
+		v := newValue()
+		rev, err := s.LoadSection(filename, v)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, r, http.StatusInternalServerError, err)
 			return
 		}
-		json.NewEncoder(w).Encode(routes)
+		w.Header().Set("ETag", rev)
+		json.NewEncoder(w).Encode(v)
 		return
 	}
 	if r.Method == http.MethodPost {
-		var routes []store.Route
-		if err := json.NewDecoder(r.Body).Decode(&routes); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		v := newValue()
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			writeStoreError(w, r, http.StatusBadRequest, err)
 			return
 		}
-		if err := s.SaveRoutes(routes); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-}
-
-func handleQuestions(w http.ResponseWriter, r *http.Request) {
-	s, err := getDestinationStore(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	if r.Method == http.MethodGet {
-		questions, err := s.LoadQuestions()
+		onDelete, err := a.deletePolicy(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, r, http.StatusBadRequest, err)
 			return
 		}
-		json.NewEncoder(w).Encode(questions)
-		return
-	}
-	if r.Method == http.MethodPost {
-		var questions []store.Question
-		if err := json.NewDecoder(r.Body).Decode(&questions); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+		rev, err := sec.Replace(s, v, r.Header.Get("If-Match"), onDelete)
+		if errors.Is(err, store.ErrConflict) {
+			// Content and revision are read together, a save since the
+			// conflict may have moved both
+			current := newValue()
+			if rev, err := s.LoadSection(filename, current); err == nil {
+				writeConflict(w, r, store.ErrConflict, rev, current)
+				return
+			}
 		}
-		if err := s.SaveQuestions(questions); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err != nil {
+			writeStoreError(w, r, http.StatusInternalServerError, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
+		w.Header().Set("ETag", rev)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
 		return
 	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	methodNotAllowed(w, r)
 }
 
-func handleReferences(w http.ResponseWriter, r *http.Request) {
-	s, err := getDestinationStore(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// deletePolicy returns the delete policy of the request, ?onDelete= or
+// the configured one
+func (a *api) deletePolicy(r *http.Request) (string, error) {
+	policy := r.URL.Query().Get("onDelete")
+	if policy == "" {
+		return a.onDelete, nil
 	}
-	if r.Method == http.MethodGet {
-		references, err := s.LoadReferences()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		json.NewEncoder(w).Encode(references)
-		return
-	}
-	if r.Method == http.MethodPost {
-		var references []store.Reference
-		if err := json.NewDecoder(r.Body).Decode(&references); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		if err := s.SaveReferences(references); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		return
+	if err := store.CheckDeletePolicy(policy); err != nil {
+		return "", &store.FieldError{Field: "onDelete", Err: err}
 	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return policy, nil
 }
 
-func handleConfig(w http.ResponseWriter, r *http.Request) {
-	s, err := getDestinationStore(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	if r.Method == http.MethodGet {
-		config, err := s.LoadConfig()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		json.NewEncoder(w).Encode(config)
+func (a *api) handleUploadGuideImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
 		return
 	}
-	if r.Method == http.MethodPost {
-		var config store.Config
-		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		if err := s.SaveConfig(config); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+	// Limit upload size
+	r.Body = http.MaxBytesReader(w, r.Body, a.maxUploadBytes)
+	if err := r.ParseMultipartForm(a.maxUploadBytes); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, CodeTooLarge, "file", fmt.Sprintf("File too large, the limit is %d bytes", a.maxUploadBytes))
 			return
 		}
-		w.WriteHeader(http.StatusOK)
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "", "Invalid multipart form: "+err.Error())
 		return
 	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-}
+	defer r.MultipartForm.RemoveAll()
 
-func handleGuideImages(w http.ResponseWriter, r *http.Request) {
-	s, err := getDestinationStore(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	planID := r.FormValue("planId")
+	destID := r.FormValue("destId")
+	if planID == "" {
+		missingParam(w, r, "planId")
 		return
 	}
-	if r.Method == http.MethodGet {
-		images, err := s.LoadGuideImages()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		json.NewEncoder(w).Encode(images)
+	if destID == "" {
+		missingParam(w, r, "destId")
 		return
 	}
-	if r.Method == http.MethodPost {
-		var images []store.GuideImage
-		if err := json.NewDecoder(r.Body).Decode(&images); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		if err := s.SaveGuideImages(images); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
+	destStore, err := a.destinationStore(planID, destID)
+	if err != nil {
+		writeStoreError(w, r, http.StatusBadRequest, err)
 		return
 	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-}
 
-func handleSchedules(w http.ResponseWriter, r *http.Request) {
-	s, err := getDestinationStore(r)
+	file, handler, err := r.FormFile("file")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	if r.Method == http.MethodGet {
-		schedules, err := s.LoadSchedules()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		json.NewEncoder(w).Encode(schedules)
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "file", "Error retrieving file")
 		return
 	}
-	if r.Method == http.MethodPost {
-		var schedules []store.Schedule
-		if err := json.NewDecoder(r.Body).Decode(&schedules); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		if err := s.SaveSchedules(schedules); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-}
+	defer file.Close()
 
-func handleItineraries(w http.ResponseWriter, r *http.Request) {
-	s, err := getDestinationStore(r)
+	data, err := io.ReadAll(file)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	if r.Method == http.MethodGet {
-		itineraries, err := s.LoadItineraries()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		json.NewEncoder(w).Encode(itineraries)
-		return
-	}
-	if r.Method == http.MethodPost {
-		var itineraries []store.ItineraryItem
-		if err := json.NewDecoder(r.Body).Decode(&itineraries); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		if err := s.SaveItineraries(itineraries); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "file", "Failed to read file")
 		return
 	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-}
-
-func handleUploadGuideImage(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// Stored once by content, served from {prefix}/data/blobs/...
+	url, err := a.store.SaveUpload(data)
+	if errors.Is(err, store.ErrUnsupportedImage) {
+		writeStoreError(w, r, http.StatusUnsupportedMediaType, &store.FieldError{Field: "file", Err: err})
 		return
 	}
-
-	// Limit upload size (e.g. 10MB)
-	r.ParseMultipartForm(10 << 20)
-
-	file, handler, err := r.FormFile("file")
 	if err != nil {
-		http.Error(w, "Error retrieving file", http.StatusBadRequest)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "", "Failed to save file: "+err.Error())
 		return
 	}
-	defer file.Close()
 
-	planID := r.FormValue("planId")
-	destID := r.FormValue("destId")
-	if planID == "" || destID == "" {
-		http.Error(w, "Missing planId or destId", http.StatusBadRequest)
-		return
-	}
-
-	destStore := globalStore.GetPlanStore(planID).GetDestinationStore(destID)
-	if err := destStore.EnsureDir(); err != nil {
-		http.Error(w, "Failed to ensure destination directory", http.StatusInternalServerError)
-		return
+	resp := map[string]interface{}{
+		"url": url,
 	}
-
-	// Create images directory if not exists
-	imagesDir := filepath.Join(destStore.Dir, "images")
-	if err := os.MkdirAll(imagesDir, 0755); err != nil {
-		http.Error(w, "Failed to create images directory", http.StatusInternalServerError)
-		return
+	// Photos with EXIF data tell where and when they were taken; the
+	// client keeps this on the GuideImage and may add a spot there
+	if info, err := store.ReadPhotoInfo(data); err == nil {
+		if info.TakenAt != "" {
+			resp["taken_at"] = info.TakenAt
+		}
+		if info.HasGPS {
+			resp["lat"] = info.Lat
+			resp["lng"] = info.Lng
+			name := uploadName(handler.Filename)
+			if name == "" {
+				name = info.TakenAt
+			}
+			spot := store.Spot{Name: name, Lat: info.Lat, Lng: info.Lng, Icon: "default"}
+			if r.FormValue("createSpot") == "true" {
+				spot, _, err = store.SpotSection.Add(destStore, spot, "")
+				if err != nil {
+					writeError(w, r, http.StatusInternalServerError, CodeInternal, "", "Failed to add spot: "+err.Error())
+					return
+				}
+				resp["spot"] = spot
+			} else {
+				resp["suggested_spot"] = spot
+			}
+		}
 	}
 
-	// Generate a unique filename to avoid collisions
-	filename := fmt.Sprintf("%d-%s", time.Now().UnixMilli(), handler.Filename)
-	// Sanitize filename
-	filename = strings.ReplaceAll(filename, " ", "_")
-	dstPath := filepath.Join(imagesDir, filename)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
 
-	dst, err := os.Create(dstPath)
-	if err != nil {
-		http.Error(w, "Failed to create destination file", http.StatusInternalServerError)
-		return
-	}
-	defer dst.Close()
+// maxUploadNameLength bounds the names taken from uploaded file names
+const maxUploadNameLength = 80
 
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
+// uploadName turns the name a file was uploaded with into a display name:
+// the base name without extension, whatever the client's path separator,
+// with control characters dropped and spaces collapsed
+func uploadName(filename string) string {
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
 	}
-
-	// Construct URL
-	// Serving from {prefix}/data/plans/{planId}/destinations/{destId}/images/{filename}
-	dataPrefix := globalStore.APIPrefix
-	if !strings.HasSuffix(dataPrefix, "/") {
-		dataPrefix += "/"
+	filename = strings.TrimSuffix(filename, path.Ext(filename))
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, filename)
+	filename = strings.Join(strings.Fields(filename), " ")
+	if utf8.RuneCountInString(filename) > maxUploadNameLength {
+		filename = string([]rune(filename)[:maxUploadNameLength])
 	}
-	dataPrefix += "data/"
-	url := fmt.Sprintf("%splans/%s/destinations/%s/images/%s", dataPrefix, planID, destID, filename)
-
-	json.NewEncoder(w).Encode(map[string]string{
-		"url": url,
-	})
+	return filename
 }
 
-func handleProxySearch(w http.ResponseWriter, r *http.Request) {
+func (a *api) handleProxySearch(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 	keywords := query.Get("keywords")
 	if keywords == "" {
-		http.Error(w, "Missing keywords", http.StatusBadRequest)
+		missingParam(w, r, "keywords")
 		return
 	}
 
-	// Check for AMAP_KEY env var
-	key := os.Getenv("AMAP_KEY")
+	// The key comes from config, --amap-key or the AMAP_KEY env var
+	key := a.amapKey
 	if key == "" {
-		// Try to look for a key file? No, just use env.
-		// If no key, maybe return a helpful error so frontend can show it.
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": "AMAP_KEY not configured in backend",
-		})
+		// The client tells the user how to configure it
+		writeError(w, r, http.StatusUnauthorized, CodeAMapKeyMissing, "", "AMAP_KEY not configured in backend")
 		return
 	}
 
@@ -867,9 +1102,9 @@ func handleProxySearch(w http.ResponseWriter, r *http.Request) {
 	// https://restapi.amap.com/v3/place/text?keywords=...&key=...&offset=20&page=1&extensions=all
 	apiURL := fmt.Sprintf("https://restapi.amap.com/v3/place/text?keywords=%s&key=%s&offset=20&page=1&extensions=all", url.QueryEscape(keywords), key)
 
-	resp, err := http.Get(apiURL)
+	resp, err := a.client.Get(apiURL)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to call Gaode API: %v", err), http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadGateway, CodeUpstream, "", fmt.Sprintf("Failed to call Gaode API: %v", err))
 		return
 	}
 	defer resp.Body.Close()
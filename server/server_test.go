@@ -0,0 +1,383 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"travel-map/server/store"
+)
+
+// testAPI serves the API of a fresh memory store under /api
+type testAPI struct {
+	t      *testing.T
+	store  *store.GlobalStore
+	server *httptest.Server
+	planID string
+	destID string
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	st := store.NewMemoryStore()
+	mux := http.NewServeMux()
+	if err := RegisterAPIWithStore(mux, "/api", st); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	plan, err := st.CreatePlan("Trip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := st.OpenPlan(plan.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := ps.CreateDestination("Kyoto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAPI{t: t, store: st, server: srv, planID: plan.ID, destID: dest.ID}
+}
+
+// dest returns the URL of a destination endpoint
+func (a *testAPI) dest(endpoint string) string {
+	return "/api/" + endpoint + "?planId=" + a.planID + "&destId=" + a.destID
+}
+
+// do sends a request, with body as JSON unless it is a string or a reader
+func (a *testAPI) do(method string, url string, body interface{}, header map[string]string) *http.Response {
+	a.t.Helper()
+	var r io.Reader
+	if rd, ok := body.(io.Reader); ok {
+		r = rd
+	} else if s, ok := body.(string); ok {
+		r = strings.NewReader(s)
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			a.t.Fatal(err)
+		}
+		r = strings.NewReader(string(data))
+	}
+	req, err := http.NewRequest(method, a.server.URL+url, r)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	a.t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+// decode reads the JSON body of res into v, failing on an unexpected status
+func (a *testAPI) decode(res *http.Response, status int, v interface{}) {
+	a.t.Helper()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	if res.StatusCode != status {
+		a.t.Fatalf("%s %s: got %d, want %d: %s", res.Request.Method, res.Request.URL.Path, res.StatusCode, status, data)
+	}
+	if v != nil {
+		if err := json.Unmarshal(data, v); err != nil {
+			a.t.Fatalf("%s: %v", data, err)
+		}
+	}
+}
+
+// errorCode returns the code of an error envelope with the given status
+func (a *testAPI) errorCode(res *http.Response, status int) string {
+	a.t.Helper()
+	var body struct{ Error apiError }
+	a.decode(res, status, &body)
+	if body.Error.RequestID == "" {
+		a.t.Errorf("error without request ID: %+v", body.Error)
+	}
+	return body.Error.Code
+}
+
+func TestDataNotFound(t *testing.T) {
+	a := newTestAPI(t)
+	for _, url := range []string{
+		"/api/data/blobs/ab/missing.png",
+		"/api/data/blobs/ab/missing.png?w=320",
+	} {
+		if code := a.errorCode(a.do("GET", url, nil, nil), http.StatusNotFound); code != CodeNotFound {
+			t.Errorf("%s: code %q, want %q", url, code, CodeNotFound)
+		}
+	}
+}
+
+func TestSectionConflict(t *testing.T) {
+	a := newTestAPI(t)
+	res := a.do("GET", a.dest("spots"), nil, nil)
+	a.decode(res, http.StatusOK, nil)
+	stale := res.Header.Get("ETag")
+
+	res = a.do("POST", a.dest("spots"), []store.Spot{{Name: "Kinkaku-ji"}}, map[string]string{"If-Match": stale})
+	a.decode(res, http.StatusOK, nil)
+	current := res.Header.Get("ETag")
+	if current == stale {
+		t.Fatalf("revision unchanged by a save: %s", current)
+	}
+
+	res = a.do("POST", a.dest("spots"), []store.Spot{{Name: "Ginkaku-ji"}}, map[string]string{"If-Match": stale})
+	var conflict struct {
+		Error struct {
+			Code    string       `json:"code"`
+			Current []store.Spot `json:"current"`
+		} `json:"error"`
+	}
+	a.decode(res, http.StatusConflict, &conflict)
+	if conflict.Error.Code != CodeConflict {
+		t.Errorf("stale save: code %q, want %q", conflict.Error.Code, CodeConflict)
+	}
+	if c := conflict.Error.Current; len(c) != 1 || c[0].Name != "Kinkaku-ji" {
+		t.Errorf("stale save: current %+v, want the saved spots", c)
+	}
+	if got := res.Header.Get("ETag"); got != current {
+		t.Errorf("stale save: ETag %q, want the current revision %q", got, current)
+	}
+	var spots []store.Spot
+	a.decode(a.do("GET", a.dest("spots"), nil, nil), http.StatusOK, &spots)
+	if len(spots) != 1 || spots[0].Name != "Kinkaku-ji" {
+		t.Errorf("stale save changed the spots: %+v", spots)
+	}
+}
+
+func TestImportTooLarge(t *testing.T) {
+	srv, err := New(Options{Store: store.NewMemoryStore(), MaxImportBytes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	a := &testAPI{t: t, server: ts}
+	body := `{"version":2,"plans":[{"plan":{"name":"` + strings.Repeat("x", 100) + `"}}]}`
+	for _, prefix := range []string{"", "PK\x03\x04"} {
+		if code := a.errorCode(a.do("POST", "/api/import", prefix+body, nil), http.StatusRequestEntityTooLarge); code != CodeTooLarge {
+			t.Errorf("code %q, want %q", code, CodeTooLarge)
+		}
+	}
+}
+
+// slowAPI serves the API of a fresh memory store with the given read and
+// write timeouts
+func slowAPI(t *testing.T, timeout time.Duration) (*testAPI, *store.GlobalStore) {
+	t.Helper()
+	st := store.NewMemoryStore()
+	mux := http.NewServeMux()
+	if err := RegisterAPIWithStore(mux, "/api", st); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(mux)
+	ts.Config.ReadTimeout = timeout
+	ts.Config.WriteTimeout = timeout
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return &testAPI{t: t, store: st, server: ts}, st
+}
+
+func TestStreamsOutlastTimeouts(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	a, st := slowAPI(t, timeout)
+
+	// An upload trickling in for several times the read timeout
+	body, w := io.Pipe()
+	go func() {
+		doc := `{"version":2,"plans":[{"plan":{"name":"Slow"}}]}`
+		for i := 0; i < len(doc); i += 5 {
+			time.Sleep(timeout / 4)
+			w.Write([]byte(doc[i:min(i+5, len(doc))]))
+		}
+		w.Close()
+	}()
+	var report store.ImportReport
+	a.decode(a.do("POST", "/api/import", body, nil), http.StatusOK, &report)
+	if len(report.Plans) != 1 || report.Plans[0].ID == "" {
+		t.Fatalf("slow import: %+v", report)
+	}
+
+	// A download read for several times the write timeout: more image
+	// data than socket buffers hold, read slowly
+	fd := store.FullDestination{Destination: store.Destination{Name: "Kyoto"}}
+	rnd := rand.New(rand.NewSource(1))
+	var images []store.GuideImage
+	for i := 0; i < 4; i++ {
+		data := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 4<<20)...)
+		rnd.Read(data[8:])
+		images = append(images, store.GuideImage{ID: string(rune('a' + i)), Base64Data: base64.StdEncoding.EncodeToString(data)})
+	}
+	*store.GuideImageSection.List(&fd) = images
+	if _, err := st.Import([]store.FullPlan{{Plan: store.Plan{Name: "Big"}, Destinations: []store.FullDestination{fd}}}, store.ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	res := a.do("GET", "/api/export?format=zip", nil, nil)
+	var archive bytes.Buffer
+	buf := make([]byte, 256<<10)
+	for {
+		n, err := res.Body.Read(buf)
+		archive.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("export cut off after %d bytes: %v", archive.Len(), err)
+		}
+		time.Sleep(timeout / 10)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatalf("export of %d bytes: %v", archive.Len(), err)
+	}
+	if len(zr.File) != 1+len(images) {
+		t.Errorf("export has %d entries, want the manifest and %d images", len(zr.File), len(images))
+	}
+}
+
+func TestImportStatus(t *testing.T) {
+	a := newTestAPI(t)
+	valid := `{"version":2,"plans":[{"plan":{"name":"Imported"},"destinations":[{"destination":{"name":"Osaka"}}]}]}`
+
+	var report store.ImportReport
+	a.decode(a.do("POST", "/api/import?dryRun=true", valid, nil), http.StatusOK, &report)
+	if !report.DryRun || len(report.Plans) != 1 || report.Plans[0].ID != "" {
+		t.Errorf("dry run: %+v", report)
+	}
+	a.decode(a.do("POST", "/api/import", valid, nil), http.StatusOK, &report)
+	if len(report.Plans) != 1 || report.Plans[0].ID == "" || report.SourceVersion != 2 {
+		t.Errorf("import: %+v", report)
+	}
+
+	// Validation problems come back in the report
+	invalid := `{"version":2,"plans":[{"plan":{"name":""}}]}`
+	a.decode(a.do("POST", "/api/import", invalid, nil), http.StatusUnprocessableEntity, &report)
+	if len(report.Problems) != 1 || report.Problems[0].Path != "plans[0].plan.name" {
+		t.Errorf("invalid import: %+v", report.Problems)
+	}
+
+	for _, tt := range []struct {
+		url  string
+		body string
+		code string
+	}{
+		{"/api/import", "not json", CodeBadRequest},
+		{"/api/import", `{"version":99,"plans":[]}`, CodeInvalidImport},
+		{"/api/import", "PK\x03\x04 not a zip", CodeInvalidImport},
+		{"/api/import?onConflict=mine", valid, CodeBadRequest},
+		{"/api/import?planId=01J0000000000000000000000X", valid, CodePlanNotFound},
+	} {
+		status := http.StatusBadRequest
+		if tt.code == CodePlanNotFound {
+			status = http.StatusNotFound
+		}
+		if code := a.errorCode(a.do("POST", tt.url, tt.body, nil), status); code != tt.code {
+			t.Errorf("%s %.20q: code %q, want %q", tt.url, tt.body, code, tt.code)
+		}
+	}
+
+	var plans []store.Plan
+	a.decode(a.do("GET", "/api/plans", nil, nil), http.StatusOK, &plans)
+	if len(plans) != 2 {
+		t.Errorf("got %d plans, want the one from newTestAPI and the one imported", len(plans))
+	}
+}
+
+func TestMergeImport(t *testing.T) {
+	a := newTestAPI(t)
+	a.decode(a.do("POST", a.dest("spots"), []store.Spot{{Name: "Tower", Lat: 35, Lng: 135}}, nil), http.StatusOK, nil)
+
+	res := a.do("GET", "/api/export?planIds="+a.planID, nil, nil)
+	var exp store.Export
+	a.decode(res, http.StatusOK, &exp)
+	*store.SpotSection.List(&exp.Plans[0].Destinations[0]) = []store.Spot{
+		{Name: "Tower", Lat: 35, Lng: 135, Story: "updated"},
+		{Name: "Temple", Lat: 35.01, Lng: 135.01},
+	}
+
+	var report store.ImportReport
+	a.decode(a.do("POST", "/api/import?planId="+a.planID, exp, nil), http.StatusOK, &report)
+	if len(report.Changes) != 2 {
+		t.Errorf("changes %+v, want the story updated and a spot added", report.Changes)
+	}
+	var spots []store.Spot
+	a.decode(a.do("GET", a.dest("spots"), nil, nil), http.StatusOK, &spots)
+	if len(spots) != 2 || spots[0].Story != "updated" || spots[1].Name != "Temple" {
+		t.Errorf("spots after merge: %+v", spots)
+	}
+}
+
+func TestItemEndpoints(t *testing.T) {
+	a := newTestAPI(t)
+	item := func(id string) string {
+		return "/api/spots/" + id + "?planId=" + a.planID + "&destId=" + a.destID
+	}
+
+	var spot store.Spot
+	res := a.do("POST", a.dest("spots"), store.Spot{Name: "Tower"}, nil)
+	a.decode(res, http.StatusCreated, &spot)
+	rev := res.Header.Get("ETag")
+	if spot.ID == "" || rev == "" {
+		t.Fatalf("added %+v with revision %q", spot, rev)
+	}
+
+	res = a.do("GET", item(spot.ID), nil, nil)
+	a.decode(res, http.StatusOK, &spot)
+	if spot.Name != "Tower" || res.Header.Get("ETag") != rev {
+		t.Errorf("get: %+v, revision %q", spot, res.Header.Get("ETag"))
+	}
+
+	res = a.do("PATCH", item(spot.ID), `{"story":"tall"}`, map[string]string{"If-Match": rev})
+	a.decode(res, http.StatusOK, &spot)
+	if spot.Name != "Tower" || spot.Story != "tall" {
+		t.Errorf("patch: %+v", spot)
+	}
+	current := res.Header.Get("ETag")
+
+	// The revision before the patch is stale; the conflict names the current one
+	res = a.do("PUT", item(spot.ID), store.Spot{Name: "Tower 2"}, map[string]string{"If-Match": rev})
+	if code := a.errorCode(res, http.StatusConflict); code != CodeConflict || res.Header.Get("ETag") != current {
+		t.Errorf("stale put: code %q, ETag %q, want %q", code, res.Header.Get("ETag"), current)
+	}
+	res = a.do("PUT", item(spot.ID), store.Spot{Name: "Tower 2"}, map[string]string{"If-Match": current})
+	a.decode(res, http.StatusOK, &spot)
+	if spot.Name != "Tower 2" || spot.Story != "" {
+		t.Errorf("put: %+v", spot)
+	}
+
+	// A route on the spot keeps it unless the references go too
+	a.decode(a.do("POST", a.dest("routes"), store.Route{Name: "Day 1", Spots: []string{spot.ID}}, nil), http.StatusCreated, nil)
+	if code := a.errorCode(a.do("DELETE", item(spot.ID)+"&onDelete=restrict", nil, nil), http.StatusConflict); code != CodeReferenced {
+		t.Errorf("restricted delete: code %q, want %q", code, CodeReferenced)
+	}
+	a.decode(a.do("DELETE", item(spot.ID), nil, nil), http.StatusOK, nil)
+	var routes []store.Route
+	a.decode(a.do("GET", a.dest("routes"), nil, nil), http.StatusOK, &routes)
+	if len(routes) != 1 || len(routes[0].Spots) != 0 {
+		t.Errorf("routes after cascading delete: %+v", routes)
+	}
+
+	if code := a.errorCode(a.do("GET", item(spot.ID), nil, nil), http.StatusNotFound); code != CodeItemNotFound {
+		t.Errorf("deleted spot: code %q, want %q", code, CodeItemNotFound)
+	}
+	a.decode(a.do("POST", a.dest("spots"), store.Spot{ID: "x", Name: "A"}, nil), http.StatusCreated, nil)
+	if code := a.errorCode(a.do("POST", a.dest("spots"), store.Spot{ID: "x", Name: "B"}, nil), http.StatusConflict); code != CodeDuplicateID {
+		t.Errorf("add with a taken ID: code %q, want %q", code, CodeDuplicateID)
+	}
+}
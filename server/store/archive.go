@@ -0,0 +1,303 @@
+package store
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// An export archive is a ZIP file with
+//
+//	manifest.json       the Export of the JSON format, except that image
+//	                    fields hold archive paths instead of base64 data
+//	images/<name>       the original image files; blobs keep their
+//	                    content-hash name, others are named <n>-<name>
+//
+// Images are copied between the backend and the archive one at a time, so
+// neither export nor import holds more than one image in memory. Import
+// only hashes the blobs the store has already, to check that the entry
+// holds what its name says.
+const (
+	ArchiveManifest = "manifest.json"
+	archiveImageDir = "images/"
+)
+
+// Limits on what import reads from an archive, whatever the sizes in
+// its headers claim
+const (
+	maxManifestBytes     = 64 << 20
+	maxArchiveImageBytes = 64 << 20
+)
+
+// ErrTooLarge is returned for archive entries over the import limits
+var ErrTooLarge = errors.New("too large")
+
+// archiveMagic starts every ZIP file
+var archiveMagic = []byte("PK\x03\x04")
+
+// IsArchive reports whether data starts like a ZIP export rather than a
+// JSON one
+func IsArchive(head []byte) bool {
+	return bytes.HasPrefix(head, archiveMagic)
+}
+
+// ArchiveStats summarizes what an archive export moved
+type ArchiveStats struct {
+	Plans        int `json:"plans"`
+	Destinations int `json:"destinations"`
+	Images       int `json:"images"`
+}
+
+// ExportArchive streams the given plans (all if planIds is empty) as a
+// ZIP archive to w.
+func (s *GlobalStore) ExportArchive(w io.Writer, planIds []string) (ArchiveStats, error) {
+	var stats ArchiveStats
+	zw := zip.NewWriter(w)
+
+	// An image referenced twice is stored once
+	entries := make(map[string]string)
+	plans, err := s.exportPlans(planIds, func(url *string, b64 *string) error {
+		key, ok := s.keyFromURL(*url)
+		if !ok {
+			return nil
+		}
+		if name, ok := entries[key]; ok {
+			*url = name
+			return nil
+		}
+		f, err := s.Backend.Open(key)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+				// Dangling reference, keep the URL as it is
+				return nil
+			}
+			return err
+		}
+		defer f.Close()
+
+		name := archiveImageDir + path.Base(key)
+		if !isBlobKey(key) {
+			name = fmt.Sprintf("%s%d-%s", archiveImageDir, len(entries)+1, path.Base(key))
+		}
+		// Images are compressed already
+		ew, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Store,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ew, f); err != nil {
+			return fmt.Errorf("export %s: %w", key, err)
+		}
+		entries[key] = name
+		*url = name
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	mw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     ArchiveManifest,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return stats, err
+	}
+	if err := json.NewEncoder(mw).Encode(NewExport(plans)); err != nil {
+		return stats, err
+	}
+	if err := zw.Close(); err != nil {
+		return stats, err
+	}
+
+	stats.Plans = len(plans)
+	for _, fp := range plans {
+		stats.Destinations += len(fp.Destinations)
+	}
+	stats.Images = len(entries)
+	return stats, nil
+}
+
+// ImportArchive validates a ZIP archive and imports every plan of it as
+// new plans, with the same dry-run and rollback behavior as Import.
+// Base64 images in the manifest are accepted too.
+func (s *GlobalStore) ImportArchive(r io.ReaderAt, size int64, opts ImportOptions) (ImportReport, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return ImportReport{}, fmt.Errorf("%w: read archive: %v", ErrInvalidImport, err)
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	mf, ok := files[ArchiveManifest]
+	if !ok {
+		return ImportReport{}, fmt.Errorf("%w: missing %s", ErrInvalidImport, ArchiveManifest)
+	}
+	var manifest bytes.Buffer
+	if err := copyEntry(&manifest, mf, maxManifestBytes); err != nil {
+		return ImportReport{}, err
+	}
+	exp, version, err := DecodeExport(manifest.Bytes())
+	if err != nil {
+		if errors.Is(err, ErrExportTooNew) {
+			return ImportReport{}, err
+		}
+		return ImportReport{}, fmt.Errorf("%w: %s: %v", ErrInvalidImport, ArchiveManifest, err)
+	}
+	plans := exp.Plans
+
+	checkImage := func(url string, b64 string) (bool, string) {
+		if b64 != "" {
+			return checkBase64Image(url, b64)
+		}
+		if !strings.HasPrefix(url, archiveImageDir) {
+			return false, ""
+		}
+		f, ok := files[url]
+		if !ok {
+			return true, fmt.Sprintf("missing archive entry %s", url)
+		}
+		if f.UncompressedSize64 > maxArchiveImageBytes {
+			return true, fmt.Sprintf("%s is %d bytes, over the limit of %d", url, f.UncompressedSize64, maxArchiveImageBytes)
+		}
+		// The first 512 bytes are all content sniffing looks at
+		rc, err := f.Open()
+		if err != nil {
+			return true, err.Error()
+		}
+		defer rc.Close()
+		head, err := io.ReadAll(io.LimitReader(rc, 512))
+		if err != nil {
+			return true, fmt.Sprintf("read %s: %v", url, err)
+		}
+		if _, ok := detectImageExt(head); !ok {
+			return true, fmt.Sprintf("unknown image type %s", http.DetectContentType(head))
+		}
+		return true, ""
+	}
+
+	// An entry is stored once however often it is referenced
+	saved := make(map[string]string)
+	importImage := func(planID, destID string, url *string, b64 *string) error {
+		if *b64 != "" {
+			newUrl, err := s.saveBase64Image(*b64)
+			if err != nil {
+				return err
+			}
+			*url = newUrl
+			*b64 = ""
+			return nil
+		}
+		if !strings.HasPrefix(*url, archiveImageDir) {
+			return nil
+		}
+		if newUrl, ok := saved[*url]; ok {
+			*url = newUrl
+			return nil
+		}
+		f := files[*url]
+		if key, ok := s.existingBlob(path.Base(*url)); ok {
+			// Reuse the blob only if the entry really has its content,
+			// and touch it so that gc keeps it until the import is saved
+			h := sha256.New()
+			if err := copyEntry(h, f, maxArchiveImageBytes); err != nil {
+				return err
+			}
+			if hash, _, _ := parseBlobName(path.Base(*url)); hex.EncodeToString(h.Sum(nil)) == hash {
+				touched, err := s.touchBlob(key)
+				if err != nil {
+					return err
+				}
+				if touched {
+					newUrl := s.dataPrefix() + key
+					saved[*url] = newUrl
+					*url = newUrl
+					return nil
+				}
+			}
+		}
+
+		var data bytes.Buffer
+		if err := copyEntry(&data, f, maxArchiveImageBytes); err != nil {
+			return err
+		}
+		newUrl, err := s.saveImage(data.Bytes())
+		if err != nil {
+			return err
+		}
+		saved[*url] = newUrl
+		*url = newUrl
+		return nil
+	}
+	resolve := func(url string) ([]byte, bool) {
+		f, ok := files[url]
+		if !ok || !strings.HasPrefix(url, archiveImageDir) {
+			return nil, false
+		}
+		var data bytes.Buffer
+		if err := copyEntry(&data, f, maxArchiveImageBytes); err != nil {
+			return nil, false
+		}
+		return data.Bytes(), true
+	}
+	report, err := s.runImport(plans, opts, checkImage, resolve, importImage)
+	report.SourceVersion = version
+	return report, err
+}
+
+// copyEntry copies the content of an archive entry to w, failing with
+// ErrTooLarge if it is over max bytes: by its header up front, or by what
+// actually comes out should the header lie
+func copyEntry(w io.Writer, f *zip.File, max int64) error {
+	tooLarge := fmt.Errorf("%w: %s is over the limit of %d bytes", ErrTooLarge, f.Name, max)
+	if f.UncompressedSize64 > uint64(max) {
+		return tooLarge
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	n, err := io.Copy(w, io.LimitReader(rc, max+1))
+	if err != nil {
+		return fmt.Errorf("read %s: %w", f.Name, err)
+	}
+	if n > max {
+		return tooLarge
+	}
+	return nil
+}
+
+// ImportArchiveFrom imports an archive from a stream. ZIP needs random
+// access, so the stream is spooled to a temp file first rather than
+// buffered in memory.
+func (s *GlobalStore) ImportArchiveFrom(r io.Reader, opts ImportOptions) (ImportReport, error) {
+	f, err := os.CreateTemp("", "travel-map-import-*.zip")
+	if err != nil {
+		return ImportReport{}, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	return s.ImportArchive(f, size, opts)
+}
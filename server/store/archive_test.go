@@ -0,0 +1,156 @@
+package store
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"testing"
+	"time"
+)
+
+// testArchive returns a ZIP with the given entries, in order
+func testArchive(t *testing.T, entries ...[2]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, e[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// archiveWithImage returns an archive of one plan with one guide image,
+// the entry name holding data
+func archiveWithImage(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+	fd := FullDestination{Destination: Destination{Name: "Kyoto"}}
+	*GuideImageSection.List(&fd) = []GuideImage{{ID: "g", URL: name}}
+	manifest, err := json.Marshal(NewExport([]FullPlan{{Plan: Plan{Name: "Trip"}, Destinations: []FullDestination{fd}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testArchive(t, [2]string{ArchiveManifest, string(manifest)}, [2]string{name, string(data)})
+}
+
+// importedGuideImages returns the guide images of the only destination
+// of the only plan
+func importedGuideImages(t *testing.T, s *GlobalStore) []GuideImage {
+	t.Helper()
+	plans, err := s.ListPlans()
+	if err != nil || len(plans) != 1 {
+		t.Fatalf("plans %+v: %v", plans, err)
+	}
+	ps, err := s.GetPlanStore(plans[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dests, err := ps.ListDestinations()
+	if err != nil || len(dests) != 1 {
+		t.Fatalf("destinations %+v: %v", dests, err)
+	}
+	ds, err := ps.GetDestinationStore(dests[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := GuideImageSection.Load(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return images
+}
+
+func TestImportArchiveChecksBlobNames(t *testing.T) {
+	s := newTestStore(t)
+	stored := testPNG(t, 4, 4, 1)
+	storedURL, err := s.storeBlob(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry named after the stored blob but holding something else
+	other := testPNG(t, 4, 4, 2)
+	archive := archiveWithImage(t, archiveImageDir+path.Base(storedURL), other)
+	if _, err := s.ImportArchive(bytes.NewReader(archive), int64(len(archive)), ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	images := importedGuideImages(t, s)
+	if len(images) != 1 || images[0].URL == storedURL {
+		t.Fatalf("entry with foreign content reused the blob %s: %+v", storedURL, images)
+	}
+	key, ok := s.keyFromURL(images[0].URL)
+	if !ok {
+		t.Fatalf("imported URL %s does not resolve", images[0].URL)
+	}
+	data, err := s.Backend.ReadFile(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(other)
+	if !bytes.Equal(data, other) || path.Base(key) != hex.EncodeToString(sum[:])+".png" {
+		t.Errorf("imported image stored as %s", key)
+	}
+	storedKey, _ := s.keyFromURL(storedURL)
+	if data, _ := s.Backend.ReadFile(storedKey); !bytes.Equal(data, stored) {
+		t.Errorf("stored blob changed")
+	}
+}
+
+func TestImportArchiveReusesMatchingBlob(t *testing.T) {
+	s := newTestStore(t)
+	data := testPNG(t, 4, 4, 1)
+	storedURL, err := s.storeBlob(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := s.keyFromURL(storedURL)
+	ageKey(t, s, key, 48*time.Hour)
+
+	archive := archiveWithImage(t, archiveImageDir+path.Base(storedURL), data)
+	if _, err := s.ImportArchive(bytes.NewReader(archive), int64(len(archive)), ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if images := importedGuideImages(t, s); len(images) != 1 || images[0].URL != storedURL {
+		t.Errorf("images %+v, want the stored blob %s", images, storedURL)
+	}
+	// Reused like a re-upload, the blob is young again for gc
+	if info, err := fs.Stat(s.Backend, key); err != nil || time.Since(info.ModTime()) > time.Hour {
+		t.Errorf("reused blob not touched: %v", err)
+	}
+}
+
+func TestCopyEntryLimit(t *testing.T) {
+	archive := testArchive(t, [2]string{"big", string(make([]byte, 100))})
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := zr.File[0]
+	if err := copyEntry(io.Discard, f, 99); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("over the limit: %v", err)
+	}
+	if err := copyEntry(io.Discard, f, 100); err != nil {
+		t.Errorf("at the limit: %v", err)
+	}
+
+	// A header claiming less than the entry holds
+	f.UncompressedSize64 = 10
+	if err := copyEntry(io.Discard, f, 50); err == nil {
+		t.Errorf("understated entry read without error")
+	}
+}
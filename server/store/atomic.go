@@ -0,0 +1,191 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tmpPrefix marks in-flight writes; such files are never read as data
+const tmpPrefix = ".tmp-"
+
+// staleTempAge is how old a temp file must be before Recover treats it as
+// left by an interrupted write. Younger ones may belong to a write in
+// progress in another process sharing the data directory.
+const staleTempAge = 15 * time.Minute
+
+// corruptSuffix is inserted into the name of a quarantined file
+const corruptSuffix = ".corrupt-"
+
+// writeFileAtomic writes data to a temp file in the same directory,
+// fsyncs it and renames it over path, so readers only ever see the
+// old or the new content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath, err := stageFile(path, data, perm)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// stageFile writes data to a fsynced temp file next to path, ready to be
+// renamed over it, and returns the temp file's path
+func stageFile(path string, data []byte, perm os.FileMode) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), tmpPrefix+filepath.Base(path)+"-*")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := f.Name()
+	// Clean up the temp file on any failure
+	success := false
+	defer func() {
+		if !success {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return "", err
+	}
+	success = true
+	return tmpPath, nil
+}
+
+// syncDir fsyncs a directory so a preceding rename survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Some platforms do not support syncing directories
+	d.Sync()
+	return nil
+}
+
+// RecoveryAction describes what Recover did to a single file
+type RecoveryAction struct {
+	Path   string `json:"path"`
+	Action string `json:"action"` // removed-temp, restored, quarantined
+	Detail string `json:"detail,omitempty"`
+}
+
+// Recover scans the data directory for leftovers of interrupted writes.
+// Stale temp files, older than staleTempAge, are removed, and JSON files
+// that no longer parse are either restored from a complete stale temp
+// file or moved aside so the store can start with an empty section
+// instead of failing to load. Younger temp files are left alone.
+func (b *FileBackend) Recover() ([]RecoveryAction, error) {
+	if _, err := os.Stat(b.Dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	// Collect temp files per target so a valid one can repair its target
+	temps := make(map[string][]string)
+	var jsonFiles []string
+	now := time.Now()
+	err := filepath.WalkDir(b.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := d.Name()
+		if strings.HasPrefix(name, tmpPrefix) {
+			info, err := d.Info()
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					// Renamed into place or removed meanwhile
+					return nil
+				}
+				return err
+			}
+			if now.Sub(info.ModTime()) < staleTempAge {
+				return nil
+			}
+			target := strings.TrimPrefix(name, tmpPrefix)
+			if idx := strings.LastIndex(target, "-"); idx > 0 {
+				target = target[:idx]
+			}
+			targetPath := filepath.Join(filepath.Dir(path), target)
+			temps[targetPath] = append(temps[targetPath], path)
+			return nil
+		}
+		if strings.HasSuffix(name, ".json") {
+			jsonFiles = append(jsonFiles, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []RecoveryAction
+	for _, path := range jsonFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return actions, err
+		}
+		if len(data) == 0 || json.Valid(data) {
+			continue
+		}
+
+		restored := false
+		for _, tmp := range temps[path] {
+			tmpData, err := os.ReadFile(tmp)
+			if err != nil || len(tmpData) == 0 || !json.Valid(tmpData) {
+				continue
+			}
+			if err := os.Rename(tmp, path); err != nil {
+				return actions, err
+			}
+			actions = append(actions, RecoveryAction{Path: path, Action: "restored", Detail: "from " + filepath.Base(tmp)})
+			restored = true
+			break
+		}
+		if restored {
+			continue
+		}
+
+		quarantine := fmt.Sprintf("%s%s%d", path, corruptSuffix, time.Now().UnixMilli())
+		if err := os.Rename(path, quarantine); err != nil {
+			return actions, err
+		}
+		actions = append(actions, RecoveryAction{Path: path, Action: "quarantined", Detail: "moved to " + filepath.Base(quarantine)})
+	}
+
+	// Whatever temp files remain are incomplete writes
+	for _, list := range temps {
+		for _, tmp := range list {
+			if _, err := os.Stat(tmp); err != nil {
+				continue
+			}
+			if err := os.Remove(tmp); err != nil {
+				return actions, err
+			}
+			actions = append(actions, RecoveryAction{Path: tmp, Action: "removed-temp"})
+		}
+	}
+	return actions, nil
+}
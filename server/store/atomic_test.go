@@ -0,0 +1,109 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "spots.json")
+	for _, content := range []string{"[1]", "[1,2]"} {
+		if err := writeFileAtomic(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Fatalf("content %q, want %q", data, content)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("files left: %v", entries)
+	}
+}
+
+// writeTemp leaves a temp file for target as an interrupted write would,
+// modified age ago
+func writeTemp(t *testing.T, target string, content string, age time.Duration) string {
+	t.Helper()
+	p := filepath.Join(filepath.Dir(target), tmpPrefix+filepath.Base(target)+"-123")
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	b := NewFileBackend(dir)
+	write := func(name string, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	good := write("plans.json", `[]`)
+	staleTemp := writeTemp(t, good, `[{"id":"half`, time.Hour)
+	freshTemp := writeTemp(t, write("foods.json", `[]`), `[{"id":"being written"}]`, 0)
+	restorable := write("spots.json", `[{"id":`)
+	writeTemp(t, restorable, `[{"id":"a"}]`, time.Hour)
+	corrupt := write("routes.json", `[{`)
+	// Only a fresh temp file, which may be a write in progress elsewhere
+	freshForCorrupt := writeTemp(t, corrupt, `[]`, 0)
+
+	actions, err := b.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, a := range actions {
+		got[filepath.Base(a.Path)] = a.Action
+	}
+
+	if exists(staleTemp) || got[filepath.Base(staleTemp)] != "removed-temp" {
+		t.Errorf("stale temp file not removed, actions %v", got)
+	}
+	if !exists(freshTemp) || !exists(freshForCorrupt) {
+		t.Errorf("fresh temp files removed, actions %v", got)
+	}
+	if data, _ := os.ReadFile(restorable); string(data) != `[{"id":"a"}]` || got["spots.json"] != "restored" {
+		t.Errorf("spots.json = %q, actions %v; want restored from its temp file", data, got)
+	}
+	if exists(corrupt) || got["routes.json"] != "quarantined" {
+		t.Errorf("routes.json not quarantined, actions %v", got)
+	}
+	entries, _ := os.ReadDir(dir)
+	quarantined := false
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "routes.json"+corruptSuffix) {
+			quarantined = true
+		}
+	}
+	if !quarantined {
+		t.Errorf("no quarantined copy of routes.json in %v", entries)
+	}
+	if data, _ := os.ReadFile(good); string(data) != `[]` {
+		t.Errorf("plans.json changed to %q", data)
+	}
+}
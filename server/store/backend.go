@@ -0,0 +1,139 @@
+package store
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Backend is the raw storage the typed stores are built on. Everything is
+// addressed by slash-separated keys that mirror the classic travel-data
+// layout, e.g. "plans.json", "plans/<id>/destinations.json",
+// "plans/<id>/destinations/<id>/spots.json" and
+// "plans/<id>/destinations/<id>/images/<name>".
+//
+// The embedded fs.FS lets the data be served over HTTP and walked with
+// fs.WalkDir regardless of where it lives.
+type Backend interface {
+	fs.FS
+
+	// ReadFile returns the content stored under key. A missing key
+	// yields an error matching fs.ErrNotExist.
+	ReadFile(key string) ([]byte, error)
+	// WriteFile replaces the content under key atomically, creating
+	// parent directories as needed.
+	WriteFile(key string, data []byte) error
+	// MkdirAll creates the directory key and its parents.
+	MkdirAll(key string) error
+	// RemoveAll deletes key and everything below it. A missing key is
+	// not an error.
+	RemoveAll(key string) error
+	// WriteFiles applies several changes as one: if it fails, none of
+	// them is in effect. Stores use it for edits that span keys, e.g. a
+	// removed spot and the routes that referred to it.
+	WriteFiles(changes []FileChange) error
+	// Lock takes an exclusive lock on the subtree rooted at key; "" is
+	// the whole store. The returned func releases it.
+	Lock(key string) (func(), error)
+	Close() error
+}
+
+// FileChange is one change of a WriteFiles batch: Data is written to Key
+// as by WriteFile, or Key is deleted as by RemoveAll if Remove is set
+type FileChange struct {
+	Key    string
+	Data   []byte
+	Remove bool
+}
+
+// Backend kinds accepted by OpenBackend
+const (
+	BackendFile   = "file"
+	BackendSQLite = "sqlite"
+	BackendMemory = "memory"
+)
+
+// SQLiteFileName is the database file the sqlite backend keeps in the
+// data directory
+const SQLiteFileName = "travel-map.db"
+
+// OpenBackend opens the backend of the given kind rooted at the data
+// directory dir. An empty kind means the file backend; the memory
+// backend ignores dir.
+func OpenBackend(kind string, dir string) (Backend, error) {
+	switch kind {
+	case "", BackendFile:
+		return NewFileBackend(dir), nil
+	case BackendSQLite:
+		b, err := OpenSQLiteBackend(filepath.Join(dir, SQLiteFileName))
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case BackendMemory:
+		return NewMemoryBackend(), nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q, expecting %s, %s or %s", kind, BackendFile, BackendSQLite, BackendMemory)
+	}
+}
+
+// ParseBackendSpec parses "kind:location" as used by the convert command.
+// For the file backend the location is the data directory; for sqlite it
+// is either a directory or a path ending in ".db".
+func ParseBackendSpec(spec string) (Backend, error) {
+	kind, loc, ok := strings.Cut(spec, ":")
+	if !ok || loc == "" {
+		return nil, fmt.Errorf("invalid backend %q, expecting kind:location", spec)
+	}
+	if kind == BackendSQLite && strings.HasSuffix(loc, ".db") {
+		b, err := OpenSQLiteBackend(loc)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	return OpenBackend(kind, loc)
+}
+
+// isInternalName reports whether a file name is backend bookkeeping
+// (lock files, in-flight temp files) rather than data.
+func isInternalName(name string) bool {
+	return name == lockFileName || strings.HasPrefix(name, tmpPrefix)
+}
+
+// CopyBackend copies every data key of src into dst and returns the
+// number of keys copied. Keys already present in dst are overwritten.
+func CopyBackend(dst Backend, src Backend) (int, error) {
+	n := 0
+	err := fs.WalkDir(src, ".", func(key string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if isInternalName(d.Name()) || strings.HasPrefix(key, SQLiteFileName) {
+			return nil
+		}
+		if d.IsDir() {
+			if key == "." {
+				return nil
+			}
+			return dst.MkdirAll(key)
+		}
+		data, err := src.ReadFile(key)
+		if err != nil {
+			return err
+		}
+		if err := dst.WriteFile(key, data); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// joinKey joins key segments with slashes
+func joinKey(elem ...string) string {
+	return path.Join(elem...)
+}
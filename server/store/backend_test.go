@@ -0,0 +1,111 @@
+package store
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testBackends returns one backend of each kind, empty
+func testBackends(t *testing.T) map[string]Backend {
+	t.Helper()
+	db, err := OpenSQLiteBackend(filepath.Join(t.TempDir(), SQLiteFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]Backend{
+		BackendFile:   NewFileBackend(t.TempDir()),
+		BackendSQLite: db,
+		BackendMemory: NewMemoryBackend(),
+	}
+}
+
+func TestWriteFiles(t *testing.T) {
+	for kind, b := range testBackends(t) {
+		for key, content := range map[string]string{"a.json": "a", "d/b.json": "b"} {
+			if err := b.WriteFile(key, []byte(content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := b.WriteFiles([]FileChange{
+			{Key: "a.json", Data: []byte("a2")},
+			{Key: "d/b.json", Remove: true},
+			{Key: "e/c.json", Data: []byte("c")},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		want := map[string]string{"a.json": "a2", "d/b.json": "", "e/c.json": "c"}
+		for key, content := range want {
+			data, err := b.ReadFile(key)
+			if content == "" {
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("%s: %s not removed: %v", kind, key, err)
+				}
+			} else if err != nil || string(data) != content {
+				t.Errorf("%s: %s is %q, %v, want %q", kind, key, data, err, content)
+			}
+		}
+
+		// A batch that cannot be written leaves everything as it was
+		err = b.WriteFiles([]FileChange{
+			{Key: "a.json", Data: []byte("a3")},
+			{Key: "e/c.json", Remove: true},
+			{Key: "../outside", Data: []byte("x")},
+		})
+		if err == nil {
+			t.Fatalf("%s: batch with an invalid key written", kind)
+		}
+		for key, content := range map[string]string{"a.json": "a2", "e/c.json": "c"} {
+			if data, err := b.ReadFile(key); err != nil || string(data) != content {
+				t.Errorf("%s: failed batch changed %s to %q, %v", kind, key, data, err)
+			}
+		}
+	}
+}
+
+// failingBackend fails every write that touches a key ending in suffix
+type failingBackend struct {
+	Backend
+	suffix string
+}
+
+func (b failingBackend) WriteFile(key string, data []byte) error {
+	return b.WriteFiles([]FileChange{{Key: key, Data: data}})
+}
+
+func (b failingBackend) WriteFiles(changes []FileChange) error {
+	for _, c := range changes {
+		if strings.HasSuffix(c.Key, b.suffix) {
+			return errors.New("disk full")
+		}
+	}
+	return b.Backend.WriteFiles(changes)
+}
+
+func TestCascadeIsOneWrite(t *testing.T) {
+	s := newTestStore(t)
+	_, ds := newTestDestination(t, s)
+	spot, _, err := SpotSection.Add(ds, Spot{Name: "Tower"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := RouteSection.Add(ds, Route{Name: "Day 1", Spots: []string{spot.ID}}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing the spot must not be saved without dropping it from routes
+	ds.Backend = failingBackend{Backend: ds.Backend, suffix: RouteSection.File()}
+	if _, err := SpotSection.Delete(ds, spot.ID, "", DeleteCascade); err == nil {
+		t.Fatal("delete succeeded although routes could not be written")
+	}
+	if spots, err := SpotSection.Load(ds); err != nil || len(spots) != 1 {
+		t.Errorf("spots %+v, want the spot kept: %v", spots, err)
+	}
+	if routes, err := RouteSection.Load(ds); err != nil || len(routes) != 1 || len(routes[0].Spots) != 1 {
+		t.Errorf("routes %+v, want the reference kept: %v", routes, err)
+	}
+}
@@ -0,0 +1,200 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// BlobDir holds every stored image once, under the hash of its content:
+// blobs/<first 2 hex digits>/<sha256 hex><ext>. Destinations refer to
+// blobs by their data URL, so the same picture used in several
+// destinations, or imported twice, takes its space once. Blobs are not
+// removed with the destinations using them; gc collects the unused ones.
+const BlobDir = "blobs"
+
+// blobKey returns the key content with the given hash is stored under
+func blobKey(hash string, ext string) string {
+	return joinKey(BlobDir, hash[:2], hash+ext)
+}
+
+// parseBlobName splits "<sha256 hex><ext>" into hash and extension; ok is
+// false for names that are not blob names
+func parseBlobName(name string) (hash string, ext string, ok bool) {
+	ext = path.Ext(name)
+	hash = strings.TrimSuffix(name, ext)
+	if len(hash) != sha256.Size*2 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", "", false
+	}
+	return hash, ext, true
+}
+
+// validBlobKey reports whether key is blobs/<xx>/<hash><ext> with xx the
+// first 2 digits of the hash
+func validBlobKey(key string) bool {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || parts[0] != BlobDir {
+		return false
+	}
+	hash, ext, ok := parseBlobName(parts[2])
+	return ok && parts[1] == hash[:2] && cleanExt(ext) == ext
+}
+
+// isBlobKey reports whether key lies in the blob area
+func isBlobKey(key string) bool {
+	return strings.HasPrefix(key, BlobDir+"/")
+}
+
+// cleanExt keeps a file extension only if it is short and plain
+func cleanExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if len(ext) < 2 || len(ext) > 6 || ext[0] != '.' {
+		return ""
+	}
+	for _, c := range ext[1:] {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+// lockBlobs takes the lock of the blob area, which orders storing a blob
+// against gc removing it
+func (s *GlobalStore) lockBlobs() (func(), error) {
+	if err := s.Backend.MkdirAll(BlobDir); err != nil {
+		return nil, err
+	}
+	return s.Backend.Lock(BlobDir)
+}
+
+// putBlob stores data under its content hash unless it is there already
+// and returns the key. The extension comes from the content, or else from
+// fallbackExt. A blob stored already is touched, so that gc, which keeps
+// young blobs, does not remove it before the item using it is saved.
+func (s *GlobalStore) putBlob(data []byte, fallbackExt string) (string, error) {
+	ext, ok := detectImageExt(data)
+	if !ok {
+		ext = cleanExt(fallbackExt)
+	}
+	sum := sha256.Sum256(data)
+	key := blobKey(hex.EncodeToString(sum[:]), ext)
+
+	unlock, err := s.lockBlobs()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if _, err := fs.Stat(s.Backend, key); err == nil {
+		if err := s.touchKey(key, data); err != nil {
+			return "", err
+		}
+		return key, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if err := s.Backend.WriteFile(key, data); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// touchKey sets the modification time of key, holding data, to now.
+// Backends that cannot do that in place have the data rewritten, read
+// back first if data is nil.
+func (s *GlobalStore) touchKey(key string, data []byte) error {
+	if t, ok := s.Backend.(interface{ Touch(key string) error }); ok {
+		return t.Touch(key)
+	}
+	if data == nil {
+		var err error
+		if data, err = s.Backend.ReadFile(key); err != nil {
+			return err
+		}
+	}
+	return s.Backend.WriteFile(key, data)
+}
+
+// touchBlob touches the stored blob key under the blob lock, as putBlob
+// does for content it has already, and reports whether it is still
+// there: gc may have removed it since it was looked up.
+func (s *GlobalStore) touchBlob(key string) (bool, error) {
+	unlock, err := s.lockBlobs()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	if _, err := fs.Stat(s.Backend, key); errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := s.touchKey(key, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ErrUnsupportedImage is returned by SaveUpload for content that is not
+// one of UploadImageTypes
+var ErrUnsupportedImage = errors.New("unsupported image type")
+
+// UploadImageTypes are the image types SaveUpload accepts, by content.
+// SVG is left out: it can carry scripts, and uploads are served from the
+// app's own origin.
+var UploadImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// SaveUpload stores an uploaded image in the blob area and returns its
+// data URL. The type is sniffed from the content, whatever the file was
+// named; anything but UploadImageTypes yields ErrUnsupportedImage.
+func (s *GlobalStore) SaveUpload(data []byte) (string, error) {
+	if typ := http.DetectContentType(data); !UploadImageTypes[typ] {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedImage, typ)
+	}
+	return s.storeBlob(data)
+}
+
+// saveImage stores an imported image in the blob area and returns its
+// data URL
+func (s *GlobalStore) saveImage(data []byte) (string, error) {
+	if _, ok := detectImageExt(data); !ok {
+		return "", fmt.Errorf("unknown image type %s", http.DetectContentType(data))
+	}
+	return s.storeBlob(data)
+}
+
+// storeBlob stores an image of a known type and returns its data URL
+func (s *GlobalStore) storeBlob(data []byte) (string, error) {
+	key, err := s.putBlob(data, "")
+	if err != nil {
+		return "", err
+	}
+	return s.dataPrefix() + key, nil
+}
+
+// existingBlob returns the key of the blob named name, e.g. an archive
+// entry written by ExportArchive, if the store has it already
+func (s *GlobalStore) existingBlob(name string) (string, bool) {
+	hash, ext, ok := parseBlobName(name)
+	if !ok {
+		return "", false
+	}
+	key := blobKey(hash, ext)
+	if _, err := fs.Stat(s.Backend, key); err != nil {
+		return "", false
+	}
+	return key, true
+}
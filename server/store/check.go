@@ -0,0 +1,346 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Codes of the problems Check finds
+const (
+	CheckUnreadable        = "unreadable"         // a JSON file that does not parse
+	CheckDuplicateID       = "duplicate-id"       // two list entries with the same ID
+	CheckInvalidID         = "invalid-id"         // an ID not safe as a directory name
+	CheckMissingDir        = "missing-dir"        // listed, but its directory is missing
+	CheckUnlistedDir       = "unlisted-dir"       // a directory no list entry refers to
+	CheckMissingImage      = "missing-image"      // a data URL whose image does not exist
+	CheckUnreferencedImage = "unreferenced-image" // an image nothing refers to
+	CheckUnresolvedImage   = "unresolved-image"   // a URL shaped like a data URL that names no stored image
+	CheckDanglingRouteSpot = "dangling-route-spot"
+	CheckItemID            = "item-id" // section items without an ID or with a duplicate one
+)
+
+// CheckProblem is one inconsistency found by Check
+type CheckProblem struct {
+	Path     string `json:"path"`            // backend key, e.g. plans/<id>/destinations.json
+	Field    string `json:"field,omitempty"` // e.g. routes[0].spots[2]
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+	// Fixable problems are repaired by Check(true) without losing data
+	Fixable bool `json:"fixable"`
+	Fixed   bool `json:"fixed,omitempty"`
+}
+
+// CheckReport is the outcome of Check
+type CheckReport struct {
+	Plans        int            `json:"plans"`
+	Destinations int            `json:"destinations"`
+	Images       int            `json:"images"`
+	Problems     []CheckProblem `json:"problems"`
+}
+
+func (r *CheckReport) add(p CheckProblem) *CheckProblem {
+	r.Problems = append(r.Problems, p)
+	return &r.Problems[len(r.Problems)-1]
+}
+
+// Fixed counts the problems repaired
+func (r *CheckReport) Fixed() int {
+	n := 0
+	for _, p := range r.Problems {
+		if p.Fixed {
+			n++
+		}
+	}
+	return n
+}
+
+// readList decodes a plans.json or destinations.json. A missing file is an
+// empty list.
+func (s *GlobalStore) readList(key string, v interface{}) error {
+	data, err := s.Backend.ReadFile(key)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && len(data) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// subdirs lists the directory names directly below key
+func (s *GlobalStore) subdirs(key string) (map[string]bool, error) {
+	entries, err := fs.ReadDir(s.Backend, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]bool)
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs[e.Name()] = true
+		}
+	}
+	return dirs, nil
+}
+
+// Check walks the whole store and reports inconsistencies: list entries
+// without a directory and the reverse, duplicate IDs, files that do not
+// parse, image URLs pointing nowhere, images nothing refers to, and route
+// spots that name no spot. With fix set, the fixable problems are
+// repaired: missing directories are created and dangling route spots
+// dropped. Everything else is only reported.
+func (s *GlobalStore) Check(fix bool) (CheckReport, error) {
+	report := CheckReport{Problems: []CheckProblem{}}
+
+	var plans []Plan
+	if err := s.readList("plans.json", &plans); err != nil {
+		report.add(CheckProblem{Path: "plans.json", Code: CheckUnreadable, Message: err.Error(), Severity: SeverityError})
+		return report, nil
+	}
+	report.Plans = len(plans)
+	planDirs, err := s.subdirs("plans")
+	if err != nil {
+		return report, err
+	}
+
+	referenced := make(map[string]bool)
+	var images []string
+	seenPlans := make(map[string]bool)
+	for i, p := range plans {
+		if seenPlans[p.ID] {
+			report.add(CheckProblem{Path: "plans.json", Field: fmt.Sprintf("[%d]", i), Code: CheckDuplicateID, Message: fmt.Sprintf("plan ID %s is used twice", p.ID), Severity: SeverityError})
+			continue
+		}
+		seenPlans[p.ID] = true
+		planStore, err := s.GetPlanStore(p.ID)
+		if err != nil {
+			report.add(CheckProblem{Path: "plans.json", Field: fmt.Sprintf("[%d].id", i), Code: CheckInvalidID, Message: err.Error(), Severity: SeverityError})
+			continue
+		}
+		if !planDirs[p.ID] {
+			prob := report.add(CheckProblem{Path: planStore.Prefix, Code: CheckMissingDir, Message: fmt.Sprintf("plan %q has no directory", p.Name), Severity: SeverityWarning, Fixable: true})
+			if fix {
+				if err := planStore.EnsureDir(); err != nil {
+					return report, err
+				}
+				prob.Fixed = true
+			}
+		}
+		if err := s.checkPlan(&report, planStore, fix, referenced, &images); err != nil {
+			return report, err
+		}
+	}
+	for _, id := range sortedKeys(planDirs) {
+		if !seenPlans[id] {
+			report.add(CheckProblem{Path: joinKey("plans", id), Code: CheckUnlistedDir, Message: "directory of no plan in plans.json, e.g. left by an interrupted delete", Severity: SeverityWarning})
+		}
+	}
+
+	err = fs.WalkDir(s.Backend, BlobDir, func(key string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if !e.IsDir() && !isInternalName(e.Name()) {
+			images = append(images, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	report.Images = len(images)
+	for _, key := range images {
+		if !referenced[key] {
+			report.add(CheckProblem{Path: key, Code: CheckUnreferencedImage, Message: "no spot, reference, guide image or map refers to this image", Severity: SeverityWarning})
+		}
+	}
+	return report, nil
+}
+
+func (s *GlobalStore) checkPlan(report *CheckReport, planStore *PlanStore, fix bool, referenced map[string]bool, images *[]string) error {
+	planKey := planStore.Prefix
+	listKey := joinKey(planKey, "destinations.json")
+	var dests []Destination
+	if err := s.readList(listKey, &dests); err != nil {
+		report.add(CheckProblem{Path: listKey, Code: CheckUnreadable, Message: err.Error(), Severity: SeverityError})
+		return nil
+	}
+	report.Destinations += len(dests)
+	destDirs, err := s.subdirs(joinKey(planKey, "destinations"))
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for i, d := range dests {
+		if seen[d.ID] {
+			report.add(CheckProblem{Path: listKey, Field: fmt.Sprintf("[%d]", i), Code: CheckDuplicateID, Message: fmt.Sprintf("destination ID %s is used twice", d.ID), Severity: SeverityError})
+			continue
+		}
+		seen[d.ID] = true
+		destStore, err := planStore.GetDestinationStore(d.ID)
+		if err != nil {
+			report.add(CheckProblem{Path: listKey, Field: fmt.Sprintf("[%d].id", i), Code: CheckInvalidID, Message: err.Error(), Severity: SeverityError})
+			continue
+		}
+		if !destDirs[d.ID] {
+			prob := report.add(CheckProblem{Path: destStore.Prefix, Code: CheckMissingDir, Message: fmt.Sprintf("destination %q has no directory", d.Name), Severity: SeverityWarning, Fixable: true})
+			if fix {
+				if err := destStore.EnsureDir(); err != nil {
+					return err
+				}
+				prob.Fixed = true
+			}
+			continue
+		}
+		if err := s.checkDestination(report, destStore, d, fix, referenced); err != nil {
+			return err
+		}
+	}
+	for _, id := range sortedKeys(destDirs) {
+		key := joinKey(planKey, "destinations", id)
+		if !seen[id] {
+			// Its images are covered by this problem
+			report.add(CheckProblem{Path: key, Code: CheckUnlistedDir, Message: "directory of no destination in destinations.json, e.g. left by an interrupted delete", Severity: SeverityWarning})
+			continue
+		}
+		entries, err := fs.ReadDir(s.Backend, joinKey(key, "images"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && !isInternalName(e.Name()) {
+				*images = append(*images, joinKey(key, "images", e.Name()))
+			}
+		}
+	}
+	return nil
+}
+
+func (s *GlobalStore) checkDestination(report *CheckReport, destStore *DestinationStore, d Destination, fix bool, referenced map[string]bool) error {
+	fd := FullDestination{Destination: d}
+	revs := make(map[string]string)
+	for _, sec := range fd.sections() {
+		rev, err := destStore.LoadSection(sec.file, sec.value)
+		if err != nil {
+			report.add(CheckProblem{Path: joinKey(destStore.Prefix, sec.file), Code: CheckUnreadable, Message: err.Error(), Severity: SeverityError})
+			continue
+		}
+		revs[sec.file] = rev
+	}
+
+	// Items saved before IDs were assigned on save may have none
+	for _, sec := range Sections {
+		rev, ok := revs[sec.File()]
+		if !ok {
+			continue
+		}
+		n := sec.AssignIDs(sec.field(&fd))
+		if n == 0 {
+			continue
+		}
+		p := report.add(CheckProblem{Path: joinKey(destStore.Prefix, sec.File()), Code: CheckItemID, Message: fmt.Sprintf("%d %s without an ID or with a duplicate one", n, sec.Name()), Severity: SeverityWarning, Fixable: true})
+		if !fix {
+			continue
+		}
+		newRev, err := destStore.SaveSection(sec.File(), sec.field(&fd), rev)
+		if errors.Is(err, ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		revs[sec.File()] = newRev
+		p.Fixed = true
+	}
+
+	fd.eachImage(func(field string, url *string, b64 *string) error {
+		file, _, _ := strings.Cut(field, "[")
+		if field == "config.map_image" {
+			file = "config"
+		}
+		key, ok := s.keyFromURL(*url)
+		if !ok {
+			if looksLikeDataURL(*url) {
+				report.add(CheckProblem{Path: joinKey(destStore.Prefix, file+".json"), Field: field, Code: CheckUnresolvedImage, Message: fmt.Sprintf("image %s looks stored but names no image key", *url), Severity: SeverityWarning})
+			}
+			return nil
+		}
+		key = path.Clean(key)
+		referenced[key] = true
+		if _, err := fs.Stat(s.Backend, key); err != nil {
+			report.add(CheckProblem{Path: joinKey(destStore.Prefix, file+".json"), Field: field, Code: CheckMissingImage, Message: fmt.Sprintf("image %s does not exist", *url), Severity: SeverityWarning})
+		}
+		return nil
+	})
+
+	// Route spots may name a spot by ID or by name
+	routesFile := RouteSection.File()
+	if _, ok := revs[routesFile]; !ok {
+		return nil
+	}
+	spots := *SpotSection.List(&fd)
+	known := make(map[string]bool, 2*len(spots))
+	for _, sp := range spots {
+		known[sp.ID] = true
+		known[sp.Name] = true
+	}
+	dangling := 0
+	var prune func(routes []Route, field string) []Route
+	prune = func(routes []Route, field string) []Route {
+		for i := range routes {
+			r := &routes[i]
+			routeField := fmt.Sprintf("%s[%d]", field, i)
+			kept := r.Spots[:0]
+			for j, spot := range r.Spots {
+				if known[spot] {
+					kept = append(kept, spot)
+					continue
+				}
+				dangling++
+				report.add(CheckProblem{Path: joinKey(destStore.Prefix, routesFile), Field: fmt.Sprintf("%s.spots[%d]", routeField, j), Code: CheckDanglingRouteSpot, Message: fmt.Sprintf("route %q refers to unknown spot %q", r.Name, spot), Severity: SeverityWarning, Fixable: true})
+			}
+			r.Spots = kept
+			r.Children = prune(r.Children, routeField+".children")
+		}
+		return routes
+	}
+	start := len(report.Problems)
+	routes := RouteSection.List(&fd)
+	*routes = prune(*routes, "routes")
+	if dangling == 0 || !fix {
+		return nil
+	}
+	if _, err := destStore.SaveSection(routesFile, *routes, revs[routesFile]); err != nil {
+		if errors.Is(err, ErrConflict) {
+			// Edited meanwhile, leave it for the next run
+			return nil
+		}
+		return err
+	}
+	for i := start; i < len(report.Problems); i++ {
+		report.Problems[i].Fixed = true
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
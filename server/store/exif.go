@@ -0,0 +1,240 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PhotoInfo is what the EXIF data of a photo tells about where and when
+// it was taken
+type PhotoInfo struct {
+	HasGPS bool
+	// Lat and Lng are WGS-84, as the camera's GPS reports them
+	Lat float64
+	Lng float64
+	// TakenAt is RFC 3339 if the photo records its time zone, otherwise
+	// local time without an offset, e.g. "2024-04-03T10:15:00"
+	TakenAt string
+	// Orientation is how the stored pixels are to be turned for display,
+	// 1 to 8 as in EXIF; 0 if the photo does not say
+	Orientation int
+}
+
+// errNoExif is returned for JPEGs without EXIF data and for other formats
+var errNoExif = errors.New("no EXIF data")
+
+// EXIF tags read by ReadPhotoInfo
+const (
+	tagOrientation       = 0x0112
+	tagExifIFD           = 0x8769
+	tagGPSIFD            = 0x8825
+	tagDateTime          = 0x0132
+	tagDateTimeOriginal  = 0x9003
+	tagOffsetTimeOrig    = 0x9011
+	tagGPSLatitudeRef    = 0x0001
+	tagGPSLatitude       = 0x0002
+	tagGPSLongitudeRef   = 0x0003
+	tagGPSLongitude      = 0x0004
+	exifTimeLayout       = "2006:01:02 15:04:05"
+	maxExifEntriesPerIFD = 1000
+)
+
+// ReadPhotoInfo reads the GPS position, capture time and orientation from
+// the EXIF data of a JPEG. Missing fields are left empty; an error means there is
+// no usable EXIF data at all.
+func ReadPhotoInfo(data []byte) (PhotoInfo, error) {
+	tiff, err := findExif(data)
+	if err != nil {
+		return PhotoInfo{}, err
+	}
+	x, err := newExifReader(tiff)
+	if err != nil {
+		return PhotoInfo{}, err
+	}
+	ifd0, err := x.readIFD(x.order.Uint32(tiff[4:8]))
+	if err != nil {
+		return PhotoInfo{}, err
+	}
+
+	var info PhotoInfo
+	if o := x.uint32(ifd0[tagOrientation]); o >= 1 && o <= 8 {
+		info.Orientation = int(o)
+	}
+	taken := x.ascii(ifd0[tagDateTime])
+	var offset string
+	if e, ok := ifd0[tagExifIFD]; ok {
+		if exif, err := x.readIFD(x.uint32(e)); err == nil {
+			if t := x.ascii(exif[tagDateTimeOriginal]); t != "" {
+				taken = t
+			}
+			offset = x.ascii(exif[tagOffsetTimeOrig])
+		}
+	}
+	if t, err := time.Parse(exifTimeLayout, taken); err == nil {
+		info.TakenAt = t.Format("2006-01-02T15:04:05")
+		if _, err := time.Parse("-07:00", offset); err == nil {
+			info.TakenAt += offset
+		}
+	}
+
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		if gps, err := x.readIFD(x.uint32(e)); err == nil {
+			lat, latOK := x.degrees(gps[tagGPSLatitude])
+			lng, lngOK := x.degrees(gps[tagGPSLongitude])
+			if strings.HasPrefix(x.ascii(gps[tagGPSLatitudeRef]), "S") {
+				lat = -lat
+			}
+			if strings.HasPrefix(x.ascii(gps[tagGPSLongitudeRef]), "W") {
+				lng = -lng
+			}
+			// 0,0 is what cameras without a fix write
+			if latOK && lngOK && lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180 && (lat != 0 || lng != 0) {
+				info.HasGPS = true
+				info.Lat = lat
+				info.Lng = lng
+			}
+		}
+	}
+	return info, nil
+}
+
+// findExif returns the TIFF structure of the APP1 Exif segment of a JPEG
+func findExif(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errNoExif
+	}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return nil, errNoExif
+		}
+		marker := data[i+1]
+		// Image data follows, no more metadata
+		if marker == 0xDA || marker == 0xD9 {
+			return nil, errNoExif
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if size < 2 || i+2+size > len(data) {
+			return nil, errNoExif
+		}
+		seg := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return seg[6:], nil
+		}
+		i += 2 + size
+	}
+	return nil, errNoExif
+}
+
+type exifEntry struct {
+	typ   uint16
+	count uint32
+	value []byte // the raw value, from the entry itself or its offset
+}
+
+type exifReader struct {
+	tiff  []byte
+	order binary.ByteOrder
+}
+
+func newExifReader(tiff []byte) (*exifReader, error) {
+	if len(tiff) < 8 {
+		return nil, errNoExif
+	}
+	x := &exifReader{tiff: tiff}
+	switch string(tiff[:2]) {
+	case "II":
+		x.order = binary.LittleEndian
+	case "MM":
+		x.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid EXIF byte order")
+	}
+	if x.order.Uint16(tiff[2:4]) != 42 {
+		return nil, fmt.Errorf("invalid EXIF header")
+	}
+	return x, nil
+}
+
+// exifTypeSize is the size of one value of each EXIF type
+var exifTypeSize = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// readIFD reads the entries of the IFD at offset, skipping entries of
+// unknown types or pointing outside the data
+func (x *exifReader) readIFD(offset uint32) (map[uint16]exifEntry, error) {
+	if uint64(offset)+2 > uint64(len(x.tiff)) {
+		return nil, fmt.Errorf("EXIF IFD out of range")
+	}
+	n := int(x.order.Uint16(x.tiff[offset:]))
+	if n > maxExifEntriesPerIFD || int(offset)+2+12*n > len(x.tiff) {
+		return nil, fmt.Errorf("EXIF IFD out of range")
+	}
+	entries := make(map[uint16]exifEntry, n)
+	for k := 0; k < n; k++ {
+		e := x.tiff[int(offset)+2+12*k:]
+		tag := x.order.Uint16(e[0:2])
+		typ := x.order.Uint16(e[2:4])
+		count := x.order.Uint32(e[4:8])
+		size, ok := exifTypeSize[typ]
+		if !ok || uint64(count)*uint64(size) > uint64(len(x.tiff)) {
+			continue
+		}
+		total := count * size
+		var value []byte
+		if total <= 4 {
+			value = e[8 : 8+total]
+		} else {
+			off := x.order.Uint32(e[8:12])
+			if uint64(off)+uint64(total) > uint64(len(x.tiff)) {
+				continue
+			}
+			value = x.tiff[off : off+total]
+		}
+		entries[tag] = exifEntry{typ: typ, count: count, value: value}
+	}
+	return entries, nil
+}
+
+// uint32 reads a SHORT or LONG entry
+func (x *exifReader) uint32(e exifEntry) uint32 {
+	switch {
+	case e.typ == 3 && len(e.value) >= 2:
+		return uint32(x.order.Uint16(e.value))
+	case e.typ == 4 && len(e.value) >= 4:
+		return x.order.Uint32(e.value)
+	}
+	// Out of range for readIFD
+	return ^uint32(0)
+}
+
+func (x *exifReader) ascii(e exifEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+// degrees reads a GPS coordinate: degrees, minutes and seconds as three
+// RATIONALs
+func (x *exifReader) degrees(e exifEntry) (float64, bool) {
+	if e.typ != 5 || e.count < 3 {
+		return 0, false
+	}
+	var parts [3]float64
+	for i := range parts {
+		num := x.order.Uint32(e.value[8*i:])
+		den := x.order.Uint32(e.value[8*i+4:])
+		if den == 0 {
+			if num != 0 {
+				return 0, false
+			}
+			continue
+		}
+		parts[i] = float64(num) / float64(den)
+	}
+	return parts[0] + parts[1]/60 + parts[2]/3600, true
+}
@@ -0,0 +1,218 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+// testExifEntry is an IFD entry; data holds its raw values
+type testExifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func exifShort(tag uint16, v uint16) testExifEntry {
+	return testExifEntry{tag, 3, 1, binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+func exifLong(tag uint16, v uint32) testExifEntry {
+	return testExifEntry{tag, 4, 1, binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+func exifASCII(tag uint16, s string) testExifEntry {
+	return testExifEntry{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+// exifDegrees is a GPS coordinate as degrees, minutes and hundredths of
+// seconds
+func exifDegrees(tag uint16, d, m, cs uint32) testExifEntry {
+	var data []byte
+	for _, r := range [][2]uint32{{d, 1}, {m, 1}, {cs, 100}} {
+		data = binary.LittleEndian.AppendUint32(data, r[0])
+		data = binary.LittleEndian.AppendUint32(data, r[1])
+	}
+	return testExifEntry{tag, 5, 3, data}
+}
+
+// testTIFF builds the little-endian TIFF structure of an EXIF segment.
+// ifd0 gets pointers to the Exif and GPS IFDs if they are given.
+func testTIFF(ifd0, exif, gps []testExifEntry) []byte {
+	buf := []byte("II*\x00\x00\x00\x00\x00")
+	writeIFD := func(entries []testExifEntry) uint32 {
+		off := uint32(len(buf))
+		dataOff := off + 2 + 12*uint32(len(entries)) + 4
+		var extra []byte
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(entries)))
+		for _, e := range entries {
+			buf = binary.LittleEndian.AppendUint16(buf, e.tag)
+			buf = binary.LittleEndian.AppendUint16(buf, e.typ)
+			buf = binary.LittleEndian.AppendUint32(buf, e.count)
+			if len(e.data) <= 4 {
+				buf = append(buf, append(e.data, make([]byte, 4-len(e.data))...)...)
+				continue
+			}
+			buf = binary.LittleEndian.AppendUint32(buf, dataOff+uint32(len(extra)))
+			extra = append(extra, e.data...)
+		}
+		buf = append(buf, 0, 0, 0, 0)
+		buf = append(buf, extra...)
+		return off
+	}
+	if exif != nil {
+		ifd0 = append(ifd0, exifLong(tagExifIFD, writeIFD(exif)))
+	}
+	if gps != nil {
+		ifd0 = append(ifd0, exifLong(tagGPSIFD, writeIFD(gps)))
+	}
+	off := writeIFD(ifd0)
+	binary.LittleEndian.PutUint32(buf[4:], off)
+	return buf
+}
+
+// testJPEG encodes img with tiff as its EXIF segment, if not nil
+func testJPEG(t *testing.T, img image.Image, tiff []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if tiff == nil {
+		return data
+	}
+	seg := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{0xFF, 0xE1}, binary.BigEndian.AppendUint16(nil, uint16(len(seg)+2))...)
+	return append(append(append([]byte{}, data[:2]...), append(app1, seg...)...), data[2:]...)
+}
+
+func TestReadPhotoInfo(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	tiff := testTIFF(
+		[]testExifEntry{exifShort(tagOrientation, 6), exifASCII(tagDateTime, "2024:01:01 00:00:00")},
+		[]testExifEntry{exifASCII(tagDateTimeOriginal, "2024:04:03 10:15:00"), exifASCII(tagOffsetTimeOrig, "+09:00")},
+		[]testExifEntry{
+			exifASCII(tagGPSLatitudeRef, "S"), exifDegrees(tagGPSLatitude, 33, 52, 1200),
+			exifASCII(tagGPSLongitudeRef, "E"), exifDegrees(tagGPSLongitude, 151, 12, 3600),
+		},
+	)
+	info, err := ReadPhotoInfo(testJPEG(t, img, tiff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.HasGPS || math.Abs(info.Lat-(-(33+52.0/60+12.0/3600))) > 1e-9 || math.Abs(info.Lng-(151+12.0/60+36.0/3600)) > 1e-9 {
+		t.Errorf("position %v %v,%v", info.HasGPS, info.Lat, info.Lng)
+	}
+	if info.TakenAt != "2024-04-03T10:15:00+09:00" {
+		t.Errorf("taken at %q", info.TakenAt)
+	}
+	if info.Orientation != 6 {
+		t.Errorf("orientation %d", info.Orientation)
+	}
+}
+
+func TestReadPhotoInfoWithout(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+
+	// No fix and no time: 0,0 and missing tags leave the fields empty
+	tiff := testTIFF(nil, nil, []testExifEntry{exifDegrees(tagGPSLatitude, 0, 0, 0), exifDegrees(tagGPSLongitude, 0, 0, 0)})
+	info, err := ReadPhotoInfo(testJPEG(t, img, tiff))
+	if err != nil || info != (PhotoInfo{}) {
+		t.Errorf("got %+v, %v", info, err)
+	}
+
+	if _, err := ReadPhotoInfo(testJPEG(t, img, nil)); err != errNoExif {
+		t.Errorf("JPEG without EXIF: %v", err)
+	}
+	if _, err := ReadPhotoInfo(testPNG(t, 8, 8, 0)); err != errNoExif {
+		t.Errorf("PNG: %v", err)
+	}
+
+	// Damaged data is no EXIF, not a panic
+	full := testJPEG(t, img, testTIFF([]testExifEntry{exifShort(tagOrientation, 3)}, nil, nil))
+	for n := 0; n < 200 && n < len(full); n++ {
+		ReadPhotoInfo(full[:n])
+	}
+	bad := testTIFF([]testExifEntry{exifLong(tagGPSIFD, 1<<30), exifLong(tagExifIFD, 3)}, nil, nil)
+	if _, err := ReadPhotoInfo(testJPEG(t, img, bad)); err != nil {
+		t.Errorf("IFD pointers out of range: %v", err)
+	}
+}
+
+func TestThumbnailOrientation(t *testing.T) {
+	s := newTestStore(t)
+	// Stored sideways, red on the left and blue on the right
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 200 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	url, err := s.storeBlob(testJPEG(t, img, testTIFF([]testExifEntry{exifShort(tagOrientation, 8)}, nil, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := s.keyFromURL(url)
+	thumb, err := s.Thumbnail(key, 160)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.Backend.ReadFile(thumb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := got.Bounds(); b.Dx() != 160 || b.Dy() != 320 {
+		t.Fatalf("thumbnail is %dx%d, want 160x320", b.Dx(), b.Dy())
+	}
+	// Orientation 8 is turned a quarter counter-clockwise for display:
+	// the right half comes out on top
+	top, bottom := got.At(80, 40), got.At(80, 280)
+	if r, _, b, _ := top.RGBA(); b < r {
+		t.Errorf("top is %v, want blue", top)
+	}
+	if r, _, b, _ := bottom.RGBA(); r < b {
+		t.Errorf("bottom is %v, want red", bottom)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 3x2, pixel values are 1 + their index
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		img.Pix[4*i] = uint8(1 + i)
+	}
+	want := map[int][]uint8{
+		1: {1, 2, 3, 4, 5, 6},
+		2: {3, 2, 1, 6, 5, 4},
+		3: {6, 5, 4, 3, 2, 1},
+		4: {4, 5, 6, 1, 2, 3},
+		5: {1, 4, 2, 5, 3, 6},
+		6: {4, 1, 5, 2, 6, 3},
+		7: {6, 3, 5, 2, 4, 1},
+		8: {3, 6, 2, 5, 1, 4},
+	}
+	for o, px := range want {
+		got := orient(img, o)
+		var vals []uint8
+		for i := 0; i < len(got.Pix); i += 4 {
+			vals = append(vals, got.Pix[i])
+		}
+		if !bytes.Equal(vals, px) {
+			t.Errorf("orientation %d: %v, want %v", o, vals, px)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileBackend keeps every key as a plain file under Dir. This is the
+// classic travel-data layout.
+type FileBackend struct {
+	Dir string
+}
+
+func NewFileBackend(dir string) *FileBackend {
+	return &FileBackend{Dir: dir}
+}
+
+// path maps a key to its location on disk, rejecting keys that would
+// escape Dir
+func (b *FileBackend) path(op string, key string) (string, error) {
+	if key == "" {
+		key = "."
+	}
+	if !fs.ValidPath(key) {
+		return "", &fs.PathError{Op: op, Path: key, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(b.Dir, filepath.FromSlash(key)), nil
+}
+
+func (b *FileBackend) Open(name string) (fs.File, error) {
+	return os.DirFS(b.Dir).Open(name)
+}
+
+func (b *FileBackend) ReadFile(key string) ([]byte, error) {
+	p, err := b.path("read", key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+func (b *FileBackend) WriteFile(key string, data []byte) error {
+	p, err := b.path("write", key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data, 0644)
+}
+
+// Touch sets the modification time of key to now
+func (b *FileBackend) Touch(key string) error {
+	p, err := b.path("touch", key)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(p, now, now)
+}
+
+func (b *FileBackend) MkdirAll(key string) error {
+	p, err := b.path("mkdir", key)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, 0755)
+}
+
+func (b *FileBackend) RemoveAll(key string) error {
+	p, err := b.path("remove", key)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+// WriteFiles stages every write in a temp file first, so that running
+// out of space changes nothing, then renames the staged files into place
+// and removed keys aside. If a rename fails, the keys changed before it
+// are put back. Only a crash midway leaves part of the batch in effect,
+// as it would with separate writes.
+func (b *FileBackend) WriteFiles(changes []FileChange) error {
+	type step struct {
+		path   string
+		tmp    string // the staged content, or where a removed key goes
+		remove bool
+		old    []byte // content a write replaces, nil if there was none
+	}
+	steps := make([]step, 0, len(changes))
+	// Whatever is left at the temp names is no longer needed
+	defer func() {
+		for _, st := range steps {
+			os.RemoveAll(st.tmp)
+		}
+	}()
+	for _, c := range changes {
+		op := "write"
+		if c.Remove {
+			op = "remove"
+		}
+		p, err := b.path(op, c.Key)
+		if err != nil {
+			return err
+		}
+		if c.Remove {
+			tmp := filepath.Join(filepath.Dir(p), fmt.Sprintf("%s%s-%d", tmpPrefix, filepath.Base(p), time.Now().UnixNano()))
+			steps = append(steps, step{path: p, tmp: tmp, remove: true})
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		old, err := os.ReadFile(p)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		tmp, err := stageFile(p, c.Data, 0644)
+		if err != nil {
+			return err
+		}
+		steps = append(steps, step{path: p, tmp: tmp, old: old})
+	}
+
+	for i, st := range steps {
+		var err error
+		if st.remove {
+			err = os.Rename(st.path, st.tmp)
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		} else {
+			err = os.Rename(st.tmp, st.path)
+		}
+		if err == nil {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			done := steps[j]
+			switch {
+			case done.remove:
+				os.Rename(done.tmp, done.path)
+			case done.old != nil:
+				writeFileAtomic(done.path, done.old, 0644)
+			default:
+				os.Remove(done.path)
+			}
+		}
+		return err
+	}
+	synced := make(map[string]bool)
+	for _, st := range steps {
+		if dir := filepath.Dir(st.path); !synced[dir] {
+			synced[dir] = true
+			if err := syncDir(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Lock requires the directory key to exist, except for the data
+// directory itself, which is created
+func (b *FileBackend) Lock(key string) (func(), error) {
+	p, err := b.path("lock", key)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" || key == "." {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return lockDir(p)
+}
+
+func (b *FileBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultGCGracePeriod keeps images this young, as an image is uploaded
+// before the section referring to it is saved
+const DefaultGCGracePeriod = 24 * time.Hour
+
+// ErrUnresolvedImage is returned by CollectGarbage when some image URL
+// looks like a data URL but names no stored image. The image it means may
+// be among the orphans, so nothing is removed.
+var ErrUnresolvedImage = errors.New("unresolved image URLs, not collecting garbage")
+
+// QuarantineDir is where CollectGarbage moves images with Quarantine set
+const QuarantineDir = "quarantine"
+
+// Actions of a GCImage
+const (
+	GCDeleted     = "deleted"
+	GCQuarantined = "quarantined"
+	GCWouldRemove = "would-remove" // dry run
+	GCKept        = "kept"         // within the grace period
+)
+
+// GCOptions controls CollectGarbage
+type GCOptions struct {
+	// DryRun reports what would be removed without removing anything
+	DryRun bool
+	// GracePeriod keeps orphans modified more recently than this;
+	// zero means DefaultGCGracePeriod, a negative value keeps none
+	GracePeriod time.Duration
+	// Quarantine moves orphans below QuarantineDir instead of deleting
+	// them
+	Quarantine bool
+}
+
+// GCImage is one orphaned image
+type GCImage struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Action  string    `json:"action"`
+	MovedTo string    `json:"moved_to,omitempty"`
+}
+
+// GCReport is the outcome of CollectGarbage
+type GCReport struct {
+	DryRun  bool      `json:"dry_run"`
+	Scanned int       `json:"scanned"` // image files looked at
+	Orphans []GCImage `json:"orphans"`
+	// Reclaimed is the size of the images removed, or that would be
+	Reclaimed int64 `json:"reclaimed"`
+	// Skipped lists destinations whose images were left alone because a
+	// section file does not parse, so their references are unknown
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// CollectGarbage removes the images no spot, reference, guide image or
+// map image of any destination refers to, i.e. the unreferenced-image
+// problems of Check. Images of destinations with unreadable sections and
+// of directories no destination lists are never touched, nor are blobs
+// while any destination is unreadable. Any unresolved-image problem
+// fails it with ErrUnresolvedImage before anything is removed.
+func (s *GlobalStore) CollectGarbage(opts GCOptions) (GCReport, error) {
+	grace := opts.GracePeriod
+	if grace == 0 {
+		grace = DefaultGCGracePeriod
+	}
+	report := GCReport{DryRun: opts.DryRun, Orphans: []GCImage{}}
+
+	check, err := s.Check(false)
+	if err != nil {
+		return report, err
+	}
+	report.Scanned = check.Images
+	var unresolved []string
+	for _, p := range check.Problems {
+		if p.Code == CheckUnresolvedImage {
+			unresolved = append(unresolved, p.Path+" "+p.Field)
+		}
+	}
+	if len(unresolved) > 0 {
+		return report, fmt.Errorf("%w: %s; see travel-map doctor", ErrUnresolvedImage, strings.Join(unresolved, ", "))
+	}
+	skip := make(map[string]bool)
+	for _, p := range check.Problems {
+		if p.Code == CheckUnreadable {
+			dir := path.Dir(p.Path)
+			if !skip[dir] {
+				skip[dir] = true
+				report.Skipped = append(report.Skipped, dir)
+			}
+		}
+	}
+
+	// An upload of the same content touches the blob under this lock, so
+	// the grace check below sees it
+	unlock, err := s.lockBlobs()
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+	now := time.Now()
+	stamp := now.Format("20060102-150405")
+	for _, p := range check.Problems {
+		if p.Code != CheckUnreferencedImage {
+			continue
+		}
+		// Any destination may use a blob, other images are in
+		// plans/<id>/destinations/<id>/images/<name>
+		if isBlobKey(p.Path) && len(skip) > 0 {
+			continue
+		}
+		if skip[path.Dir(path.Dir(p.Path))] {
+			continue
+		}
+		info, err := fs.Stat(s.Backend, p.Path)
+		if err != nil {
+			// Removed meanwhile
+			continue
+		}
+		img := GCImage{Path: p.Path, Size: info.Size(), ModTime: info.ModTime()}
+		switch {
+		case grace > 0 && now.Sub(info.ModTime()) < grace:
+			img.Action = GCKept
+		case opts.DryRun:
+			img.Action = GCWouldRemove
+		default:
+			if opts.Quarantine {
+				img.MovedTo = joinKey(QuarantineDir, stamp, p.Path)
+				if err := s.moveKey(p.Path, img.MovedTo); err != nil {
+					return report, fmt.Errorf("quarantine %s: %w", p.Path, err)
+				}
+				if err := s.removeThumbnails(p.Path); err != nil {
+					return report, err
+				}
+				img.Action = GCQuarantined
+			} else {
+				if err := s.Backend.RemoveAll(p.Path); err != nil {
+					return report, fmt.Errorf("delete %s: %w", p.Path, err)
+				}
+				if err := s.removeThumbnails(p.Path); err != nil {
+					return report, err
+				}
+				img.Action = GCDeleted
+			}
+		}
+		if img.Action != GCKept {
+			report.Reclaimed += img.Size
+		}
+		report.Orphans = append(report.Orphans, img)
+	}
+
+	// Variants of originals removed some other way, e.g. with their
+	// destination, are removed too
+	err = fs.WalkDir(s.Backend, ThumbDir, func(key string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if e.IsDir() || isInternalName(e.Name()) {
+			return nil
+		}
+		if _, err := fs.Stat(s.Backend, thumbOriginal(key)); !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		img := GCImage{Path: key, Size: info.Size(), ModTime: info.ModTime(), Action: GCWouldRemove}
+		if !opts.DryRun {
+			if err := s.Backend.RemoveAll(key); err != nil {
+				return err
+			}
+			img.Action = GCDeleted
+		}
+		report.Reclaimed += img.Size
+		report.Orphans = append(report.Orphans, img)
+		return nil
+	})
+	return report, err
+}
+
+// moveKey copies from to to and then removes from
+func (s *GlobalStore) moveKey(from string, to string) error {
+	data, err := s.Backend.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	if err := s.Backend.WriteFile(to, data); err != nil {
+		return err
+	}
+	return s.Backend.RemoveAll(from)
+}
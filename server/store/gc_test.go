@@ -0,0 +1,207 @@
+package store
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// addGuideImage saves a guide image pointing at url
+func addGuideImage(t *testing.T, destStore *DestinationStore, url string) {
+	t.Helper()
+	if _, _, err := GuideImageSection.Add(destStore, GuideImage{URL: url}, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func gcAction(report GCReport, key string) string {
+	for _, img := range report.Orphans {
+		if img.Path == key {
+			return img.Action
+		}
+	}
+	return ""
+}
+
+func TestCollectGarbageRemovesOrphansAfterGrace(t *testing.T) {
+	s := newTestStore(t)
+	_, destStore := newTestDestination(t, s)
+	usedURL, err := s.SaveUpload(testPNG(t, 4, 4, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addGuideImage(t, destStore, usedURL)
+	orphanURL, err := s.SaveUpload(testPNG(t, 4, 4, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	usedKey, _ := s.keyFromURL(usedURL)
+	orphanKey, _ := s.keyFromURL(orphanURL)
+
+	// Just uploaded, so within the default grace period
+	report, err := s.CollectGarbage(GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gcAction(report, orphanKey); got != GCKept {
+		t.Fatalf("young orphan: action %q, want %q", got, GCKept)
+	}
+
+	report, err = s.CollectGarbage(GCOptions{GracePeriod: -1, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gcAction(report, orphanKey); got != GCWouldRemove {
+		t.Fatalf("dry run: action %q, want %q", got, GCWouldRemove)
+	}
+	if _, err := fs.Stat(s.Backend, orphanKey); err != nil {
+		t.Fatalf("dry run removed the orphan: %v", err)
+	}
+
+	report, err = s.CollectGarbage(GCOptions{GracePeriod: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gcAction(report, orphanKey); got != GCDeleted {
+		t.Fatalf("action %q, want %q", got, GCDeleted)
+	}
+	if got := gcAction(report, usedKey); got != "" {
+		t.Fatalf("referenced image reported as %q", got)
+	}
+	if _, err := fs.Stat(s.Backend, orphanKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("orphan not removed: %v", err)
+	}
+	if _, err := fs.Stat(s.Backend, usedKey); err != nil {
+		t.Fatalf("referenced image removed: %v", err)
+	}
+}
+
+func TestCollectGarbageKeepsImagesOfAnotherAPIPrefix(t *testing.T) {
+	s := newTestStore(t)
+	s.SetAPIPrefix("/x/api")
+	_, destStore := newTestDestination(t, s)
+	url, err := s.SaveUpload(testPNG(t, 4, 4, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addGuideImage(t, destStore, url)
+
+	// gc and doctor run with the default prefix
+	s.SetAPIPrefix("/api")
+	report, err := s.CollectGarbage(GCOptions{GracePeriod: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 0 {
+		t.Fatalf("orphans %+v, want none", report.Orphans)
+	}
+	key, _ := s.keyFromURL(url)
+	if _, err := fs.Stat(s.Backend, key); err != nil {
+		t.Fatalf("referenced image removed: %v", err)
+	}
+}
+
+func TestCollectGarbageRefusesUnresolvedURLs(t *testing.T) {
+	s := newTestStore(t)
+	_, destStore := newTestDestination(t, s)
+	orphanURL, err := s.SaveUpload(testPNG(t, 4, 4, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addGuideImage(t, destStore, "/api/data/blobs/zz/not-a-blob.png")
+
+	_, err = s.CollectGarbage(GCOptions{GracePeriod: -1})
+	if !errors.Is(err, ErrUnresolvedImage) {
+		t.Fatalf("err = %v, want ErrUnresolvedImage", err)
+	}
+	key, _ := s.keyFromURL(orphanURL)
+	if _, err := fs.Stat(s.Backend, key); err != nil {
+		t.Fatalf("image removed despite the error: %v", err)
+	}
+
+	// Links elsewhere are not data URLs
+	s2 := newTestStore(t)
+	_, destStore2 := newTestDestination(t, s2)
+	addGuideImage(t, destStore2, "https://example.com/data/map.png")
+	if _, err := s2.CollectGarbage(GCOptions{GracePeriod: -1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ageKey sets the modification time of a file-backed key to d ago
+func ageKey(t *testing.T, s *GlobalStore, key string, d time.Duration) {
+	t.Helper()
+	p, err := s.Backend.(*FileBackend).path("age", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-d)
+	if err := os.Chtimes(p, old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectGarbageKeepsReuploadedBlob(t *testing.T) {
+	s := newTestStore(t)
+	newTestDestination(t, s)
+	data := testPNG(t, 4, 4, 1)
+	url, err := s.SaveUpload(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := s.keyFromURL(url)
+	ageKey(t, s, key, 48*time.Hour)
+
+	// Uploaded again before the item using it is saved
+	again, err := s.SaveUpload(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != url {
+		t.Fatalf("re-upload stored at %s, want %s", again, url)
+	}
+	report, err := s.CollectGarbage(GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gcAction(report, key); got != GCKept {
+		t.Fatalf("action %q, want %q", got, GCKept)
+	}
+}
+
+func TestCollectGarbageRacingReupload(t *testing.T) {
+	s := newTestStore(t)
+	newTestDestination(t, s)
+	data := testPNG(t, 4, 4, 1)
+	for i := 0; i < 20; i++ {
+		url, err := s.SaveUpload(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, _ := s.keyFromURL(url)
+		ageKey(t, s, key, 48*time.Hour)
+
+		var wg sync.WaitGroup
+		var gcErr error
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, gcErr = s.CollectGarbage(GCOptions{GracePeriod: time.Hour})
+		}()
+		url, err = s.SaveUpload(data)
+		wg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gcErr != nil {
+			t.Fatal(gcErr)
+		}
+		// Whichever ran first, the URL handed out must stay valid
+		if _, err := fs.Stat(s.Backend, key); err != nil {
+			t.Fatalf("round %d: blob of a fresh upload removed: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// crockford is the base32 alphabet of ULIDs, without I, L, O and U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var ulidState struct {
+	sync.Mutex
+	ms      uint64
+	entropy [10]byte
+}
+
+// newID returns a new ULID: 26 characters, the first 10 the creation
+// time in milliseconds, the rest random. IDs made in the same millisecond
+// by this process count up from the first, so they stay unique and keep
+// the order they were made in. Plan, destination and item IDs all come
+// from here.
+func newID() string {
+	ulidState.Lock()
+	defer ulidState.Unlock()
+	ms := uint64(time.Now().UnixMilli())
+	if ms <= ulidState.ms {
+		// Same (or an earlier, after a clock step) millisecond: increment
+		ms = ulidState.ms
+		for i := len(ulidState.entropy) - 1; i >= 0; i-- {
+			ulidState.entropy[i]++
+			if ulidState.entropy[i] != 0 {
+				break
+			}
+			if i == 0 {
+				// 80 bits overflowed, move on to the next millisecond
+				ms++
+				rand.Read(ulidState.entropy[:])
+			}
+		}
+	} else {
+		rand.Read(ulidState.entropy[:])
+	}
+	ulidState.ms = ms
+
+	var b [16]byte
+	binary.BigEndian.PutUint16(b[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+	copy(b[6:], ulidState.entropy[:])
+	return encodeULID(b)
+}
+
+// encodeULID renders 128 bits as 26 base32 characters, 5 bits each with
+// the 2 spare bits at the top
+func encodeULID(b [16]byte) string {
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,346 @@
+package store
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidImport is returned when validation finds errors in an import
+// payload; nothing has been written then
+var ErrInvalidImport = errors.New("invalid import")
+
+// Problem severities. Errors block the import, warnings do not.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// ImportOptions controls Import and ImportArchive
+type ImportOptions struct {
+	// DryRun validates the payload and reports what would be created
+	// without writing anything
+	DryRun bool
+	// PlanID merges the single plan of the payload into this existing
+	// plan instead of creating a new one
+	PlanID string
+	// OnConflict is the merge policy for items that exist in both and
+	// differ: MergeTheirs (default) or MergeOurs
+	OnConflict string
+}
+
+// ImportProblem is something validation found in the payload
+type ImportProblem struct {
+	Path     string `json:"path"` // e.g. plans[0].destinations[1].spots[2].icon
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+}
+
+// ImportPlanSummary describes one plan of the payload
+type ImportPlanSummary struct {
+	ID           string `json:"id,omitempty"` // set once the plan is created
+	Name         string `json:"name"`
+	Destinations int    `json:"destinations"`
+	Images       int    `json:"images"`
+}
+
+// ImportReport is the outcome of a validated import
+type ImportReport struct {
+	DryRun   bool                `json:"dry_run"`
+	Plans    []ImportPlanSummary `json:"plans"`
+	Problems []ImportProblem     `json:"problems"`
+	Changes  []ImportChange      `json:"changes,omitempty"` // merge imports only
+	// SourceVersion is the export schema version the payload was
+	// written with, when it came from an export file
+	SourceVersion int `json:"source_version,omitempty"`
+}
+
+func (r *ImportReport) HasErrors() bool {
+	for _, p := range r.Problems {
+		if p.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ImportReport) addProblem(path string, severity string, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, ImportProblem{Path: path, Message: fmt.Sprintf(format, args...), Severity: severity})
+}
+
+// checkImageFunc validates one image reference of the payload and
+// returns whether it carries an image and what is wrong with it, if
+// anything
+type checkImageFunc func(url string, b64 string) (hasImage bool, problem string)
+
+// importImageFunc stores one image of the payload for the new plan and
+// destination and points url at it
+type importImageFunc func(planID, destID string, url *string, b64 *string) error
+
+// checkBase64Image is the checkImageFunc of the JSON format
+func checkBase64Image(url string, b64 string) (bool, string) {
+	if b64 == "" {
+		return false, ""
+	}
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return true, fmt.Sprintf("invalid base64: %v", err)
+	}
+	if _, ok := detectImageExt(data); !ok {
+		return true, fmt.Sprintf("unknown image type %s", http.DetectContentType(data))
+	}
+	return true, ""
+}
+
+// ImportPlans imports a list of full plans with base64 embedded images.
+// See Import.
+func (s *GlobalStore) ImportPlans(plans []FullPlan) error {
+	_, err := s.Import(plans, ImportOptions{})
+	return err
+}
+
+// Import validates the plans and, unless opts.DryRun is set, creates
+// every plan anew with base64 embedded images, or merges the plan into
+// opts.PlanID. If validation finds an error nothing is written and the
+// error is ErrInvalidImport. If a write fails midway, everything written
+// so far is undone. The image fields of plans are rewritten in place.
+func (s *GlobalStore) Import(plans []FullPlan, opts ImportOptions) (ImportReport, error) {
+	return s.runImport(plans, opts, checkBase64Image, nil, func(planID, destID string, url *string, b64 *string) error {
+		if *b64 == "" {
+			return nil
+		}
+		newUrl, err := s.saveBase64Image(*b64)
+		if err != nil {
+			return err
+		}
+		*url = newUrl
+		*b64 = ""
+		return nil
+	})
+}
+
+// runImport validates and imports plans. resolve returns the content of
+// image references that are neither base64 nor stored, for merging.
+func (s *GlobalStore) runImport(plans []FullPlan, opts ImportOptions, checkImage checkImageFunc, resolve func(url string) ([]byte, bool), importImage importImageFunc) (ImportReport, error) {
+	if err := CheckConflictPolicy(opts.OnConflict); err != nil {
+		return ImportReport{}, err
+	}
+	if opts.OnConflict == "" {
+		opts.OnConflict = MergeTheirs
+	}
+	if opts.PlanID != "" {
+		if _, err := s.findPlan(opts.PlanID); err != nil {
+			return ImportReport{}, err
+		}
+	}
+
+	report, err := s.validateImport(plans, opts, checkImage)
+	if err != nil {
+		return report, err
+	}
+	report.DryRun = opts.DryRun
+	if report.HasErrors() {
+		return report, ErrInvalidImport
+	}
+
+	if opts.PlanID != "" {
+		report.Plans[0].ID = opts.PlanID
+		report.Changes, err = s.mergePlan(opts.PlanID, plans[0], opts, resolve, importImage)
+		return report, err
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+
+	created, err := s.importPlans(plans, importImage)
+	if err != nil {
+		var rollbackErrs []string
+		for _, p := range created {
+			if rbErr := s.DeletePlan(p.ID); rbErr != nil {
+				rollbackErrs = append(rollbackErrs, fmt.Sprintf("plan %s: %v", p.ID, rbErr))
+			}
+		}
+		if len(rollbackErrs) > 0 {
+			return report, fmt.Errorf("import failed: %w; rollback failed: %s", err, strings.Join(rollbackErrs, "; "))
+		}
+		return report, fmt.Errorf("import failed, rolled back: %w", err)
+	}
+	for i, p := range created {
+		report.Plans[i].ID = p.ID
+	}
+	return report, nil
+}
+
+// validateImport checks the whole payload before anything is written
+func (s *GlobalStore) validateImport(plans []FullPlan, opts ImportOptions, checkImage checkImageFunc) (ImportReport, error) {
+	report := ImportReport{
+		Plans:    []ImportPlanSummary{},
+		Problems: []ImportProblem{},
+	}
+	if opts.PlanID != "" && len(plans) != 1 {
+		report.addProblem("plans", SeverityError, "merging into plan %s takes exactly one plan, got %d", opts.PlanID, len(plans))
+	}
+	existing, err := s.ListPlans()
+	if err != nil {
+		return report, err
+	}
+	existingNames := make(map[string]bool, len(existing))
+	for _, p := range existing {
+		existingNames[p.Name] = true
+	}
+
+	planNames := make(map[string]int)
+	for i, fp := range plans {
+		planPath := fmt.Sprintf("plans[%d]", i)
+		summary := ImportPlanSummary{Name: fp.Plan.Name, Destinations: len(fp.Destinations)}
+
+		name := strings.TrimSpace(fp.Plan.Name)
+		if name == "" {
+			report.addProblem(planPath+".plan.name", SeverityError, "plan name is empty")
+		} else {
+			if j, ok := planNames[name]; ok {
+				report.addProblem(planPath+".plan.name", SeverityWarning, "duplicate plan name %q, same as plans[%d]", name, j)
+			} else {
+				planNames[name] = i
+			}
+			if existingNames[name] && opts.PlanID == "" {
+				report.addProblem(planPath+".plan.name", SeverityWarning, "a plan named %q already exists", name)
+			}
+		}
+
+		destNames := make(map[string]int)
+		for j := range fp.Destinations {
+			fd := &fp.Destinations[j]
+			destPath := fmt.Sprintf("%s.destinations[%d]", planPath, j)
+			destName := strings.TrimSpace(fd.Destination.Name)
+			if destName == "" {
+				report.addProblem(destPath+".destination.name", SeverityError, "destination name is empty")
+			} else if k, ok := destNames[destName]; ok {
+				report.addProblem(destPath+".destination.name", SeverityWarning, "duplicate destination name %q, same as destinations[%d]", destName, k)
+			} else {
+				destNames[destName] = j
+			}
+
+			// The same checks as a save of the section, and references
+			// must point into the payload
+			for _, sec := range Sections {
+				errs := sec.checkRefs(fd)
+				if err := sec.Validate(sec.field(fd)); err != nil {
+					errs = append([]error{err}, errs...)
+				}
+				for _, err := range errs {
+					field, msg := sec.Name(), err.Error()
+					var fe *FieldError
+					if errors.As(err, &fe) {
+						field, msg = fe.Field, fe.Err.Error()
+					}
+					report.addProblem(destPath+"."+field, SeverityError, "%s", msg)
+				}
+			}
+
+			fd.eachImage(func(field string, url *string, b64 *string) error {
+				hasImage, problem := checkImage(*url, *b64)
+				if hasImage {
+					summary.Images++
+				}
+				if problem != "" {
+					report.addProblem(destPath+"."+field, SeverityError, "%s", problem)
+				}
+				return nil
+			})
+		}
+		report.Plans = append(report.Plans, summary)
+	}
+	return report, nil
+}
+
+// importPlans creates every plan anew and hands each image reference to
+// importImage, which stores the image and points the URL at it. The
+// plans created so far are returned along with any error so the caller
+// can roll them back.
+func (s *GlobalStore) importPlans(plans []FullPlan, importImage importImageFunc) ([]Plan, error) {
+	var created []Plan
+	for _, fp := range plans {
+		// Create new plan
+		newPlan, err := s.CreatePlan(fp.Plan.Name)
+		if err != nil {
+			return created, err
+		}
+		created = append(created, newPlan)
+
+		for _, fd := range fp.Destinations {
+			if _, err := s.importDestination(newPlan.ID, fd, importImage, true); err != nil {
+				return created, err
+			}
+		}
+	}
+	return created, nil
+}
+
+// importDestination creates fd as a new destination of the plan, storing
+// its images through importImage. Its items get new IDs, so an export may
+// be imported any number of times. keepOrder applies the exported order,
+// otherwise the destination goes last.
+func (s *GlobalStore) importDestination(planID string, fd FullDestination, importImage importImageFunc, keepOrder bool) (Destination, error) {
+	planStore, err := s.GetPlanStore(planID)
+	if err != nil {
+		return Destination{}, err
+	}
+
+	// Create destination
+	newDest, err := planStore.CreateDestination(fd.Destination.Name)
+	if err != nil {
+		return Destination{}, err
+	}
+
+	// Update destination order if needed (CreateDestination sets order to last)
+	if keepOrder && newDest.Order != fd.Destination.Order {
+		newDest.Order = fd.Destination.Order
+		if err := planStore.UpdateDestination(newDest.ID, newDest); err != nil {
+			return newDest, err
+		}
+	}
+
+	destStore, err := planStore.GetDestinationStore(newDest.ID)
+	if err != nil {
+		return newDest, err
+	}
+
+	// Items get new IDs, references between them follow. Older exports
+	// refer to spots by name.
+	ids := make(idMap)
+	for _, sec := range Sections {
+		sec.renewIDs(&fd, ids)
+	}
+	for _, sec := range Sections {
+		sec.remapRefs(&fd, ids)
+		sec.link(&fd, &fd)
+	}
+
+	// Process images before saving metadata
+	err = fd.eachImage(func(field string, url *string, b64 *string) error {
+		if err := importImage(planID, newDest.ID, url, b64); err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return newDest, err
+	}
+
+	// Save all data in one write
+	var writes []sectionWrite
+	for _, sec := range fd.sections() {
+		w, err := newSectionWrite(sec.file, sec.value, "")
+		if err != nil {
+			return newDest, err
+		}
+		writes = append(writes, w)
+	}
+	if _, err := destStore.writeSections(writes); err != nil {
+		return newDest, err
+	}
+	return newDest, nil
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// importedDestination returns the only destination of the plan with
+// the given ID, as exported
+func importedDestination(t *testing.T, s *GlobalStore, planID string) FullDestination {
+	t.Helper()
+	plans, err := s.ExportPlans([]string{planID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 1 || len(plans[0].Destinations) != 1 {
+		t.Fatalf("exported %+v, want one plan with one destination", plans)
+	}
+	return plans[0].Destinations[0]
+}
+
+func TestImportValidation(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.CreatePlan("Trip"); err != nil {
+		t.Fatal(err)
+	}
+	fd := FullDestination{Destination: Destination{Name: " "}}
+	*GuideImageSection.List(&fd) = []GuideImage{
+		{ID: "a", Base64Data: "not base64!"},
+		{ID: "b", Base64Data: base64.StdEncoding.EncodeToString([]byte("plain text"))},
+	}
+	plans := []FullPlan{
+		{Plan: Plan{Name: "Trip"}, Destinations: []FullDestination{fd}},
+		{Plan: Plan{Name: ""}},
+	}
+
+	for _, dryRun := range []bool{false, true} {
+		report, err := s.Import(plans, ImportOptions{DryRun: dryRun})
+		if !errors.Is(err, ErrInvalidImport) {
+			t.Fatalf("dry run %v: %v, want ErrInvalidImport", dryRun, err)
+		}
+		problems := make(map[string]string)
+		for _, p := range report.Problems {
+			problems[p.Path] = p.Severity
+		}
+		want := map[string]string{
+			"plans[0].plan.name":                           SeverityWarning, // exists already
+			"plans[0].destinations[0].destination.name":    SeverityError,
+			"plans[0].destinations[0].guide_images[0].url": SeverityError,
+			"plans[0].destinations[0].guide_images[1].url": SeverityError,
+			"plans[1].plan.name":                           SeverityError,
+		}
+		for path, severity := range want {
+			if problems[path] != severity {
+				t.Errorf("dry run %v: %s is %q, want %q; problems %+v", dryRun, path, problems[path], severity, report.Problems)
+			}
+		}
+		if len(report.Plans) != 2 || report.Plans[0].Images != 2 {
+			t.Errorf("dry run %v: summary %+v", dryRun, report.Plans)
+		}
+	}
+	if got, err := s.ListPlans(); err != nil || len(got) != 1 {
+		t.Errorf("invalid import wrote plans: %+v, %v", got, err)
+	}
+
+	// Warnings alone do not block it, and a dry run writes nothing
+	valid := []FullPlan{{Plan: Plan{Name: "Trip"}, Destinations: []FullDestination{{Destination: Destination{Name: "Kyoto"}}}}}
+	report, err := s.Import(valid, ImportOptions{DryRun: true})
+	if err != nil || !report.DryRun || len(report.Problems) != 1 || report.Plans[0].ID != "" {
+		t.Errorf("dry run: %+v, %v", report, err)
+	}
+	if got, _ := s.ListPlans(); len(got) != 1 {
+		t.Errorf("dry run wrote plans: %+v", got)
+	}
+}
+
+func TestImportValidatesSections(t *testing.T) {
+	s := newTestStore(t)
+	fd := FullDestination{Destination: Destination{Name: "Kyoto"}}
+	*SpotSection.List(&fd) = []Spot{{ID: "s1", Name: "Tower"}, {ID: "s2", Name: "Temple", Lat: 200}}
+	*FoodSection.List(&fd) = []Food{{ID: "f1", Name: "Tofu", Rating: 9}}
+	*RouteSection.List(&fd) = []Route{
+		{ID: "r1", Name: "Day 1", Spots: []string{"s1", "Tower"}},
+		{ID: "r2", Name: "Day 2", Spots: []string{"s1"}, Children: []Route{{ID: "r3", Spots: []string{"s9", "Gone"}}}},
+	}
+	plans := []FullPlan{{Plan: Plan{Name: "Trip"}, Destinations: []FullDestination{fd}}}
+
+	report, err := s.Import(plans, ImportOptions{DryRun: true})
+	if !errors.Is(err, ErrInvalidImport) {
+		t.Fatalf("got %v, want ErrInvalidImport", err)
+	}
+	got := make(map[string]string)
+	for _, p := range report.Problems {
+		got[p.Path] = p.Message
+	}
+	for path, want := range map[string]string{
+		"plans[0].destinations[0].spots[1]":        "coordinates",
+		"plans[0].destinations[0].foods[0]":        "rating",
+		"plans[0].destinations[0].routes[1].spots": `"Gone", "s9"`,
+	} {
+		if !strings.Contains(got[path], want) {
+			t.Errorf("%s: %q, want it to mention %s", path, got[path], want)
+		}
+	}
+	if len(report.Problems) != 3 {
+		t.Errorf("problems %+v, want 3", report.Problems)
+	}
+	if plans, _ := s.ListPlans(); len(plans) != 0 {
+		t.Errorf("invalid import wrote plans: %+v", plans)
+	}
+}
+
+func TestImportRollsBack(t *testing.T) {
+	s := newTestStore(t)
+	dest := func(name string) FullDestination {
+		fd := FullDestination{Destination: Destination{Name: name}}
+		*GuideImageSection.List(&fd) = []GuideImage{{ID: "g", Base64Data: base64.StdEncoding.EncodeToString(testPNG(t, 2, 2, 0))}}
+		return fd
+	}
+	plans := []FullPlan{
+		{Plan: Plan{Name: "First"}, Destinations: []FullDestination{dest("Kyoto")}},
+		{Plan: Plan{Name: "Second"}, Destinations: []FullDestination{dest("Osaka"), dest("Nara")}},
+	}
+	// Storing the third image fails, after a plan and a half are written
+	stored := 0
+	failing := func(planID, destID string, url *string, b64 *string) error {
+		if stored == 2 {
+			return errors.New("disk full")
+		}
+		stored++
+		*url, *b64 = "/api/data/blobs/x.png", ""
+		return nil
+	}
+	_, err := s.runImport(plans, ImportOptions{OnConflict: MergeTheirs}, checkBase64Image, nil, failing)
+	if err == nil || !strings.Contains(err.Error(), "rolled back") || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("got %v, want a rolled back import", err)
+	}
+	if got, err := s.ListPlans(); err != nil || len(got) != 0 {
+		t.Errorf("plans left after rollback: %+v, %v", got, err)
+	}
+}
+
+func TestImportRenewsIDs(t *testing.T) {
+	s := newTestStore(t)
+	fd := FullDestination{Destination: Destination{Name: "Kyoto"}}
+	*SpotSection.List(&fd) = []Spot{{ID: "s1", Name: "Tower"}, {ID: "s2", Name: "Temple"}}
+	*RouteSection.List(&fd) = []Route{
+		{ID: "r1", Name: "Day 1", Spots: []string{"s2", "s1"}, Children: []Route{{ID: "r2", Name: "Morning", Spots: []string{"s1"}}}},
+		// Older exports name the spots
+		{ID: "r3", Name: "Day 2", Spots: []string{"Temple"}},
+	}
+	plans := []FullPlan{{Plan: Plan{Name: "Trip"}, Destinations: []FullDestination{fd}}}
+
+	seen := make(map[string]bool)
+	for round := 0; round < 2; round++ {
+		report, err := s.Import(plans, ImportOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := importedDestination(t, s, report.Plans[0].ID)
+		spots := *SpotSection.List(&got)
+		routes := *RouteSection.List(&got)
+		if len(spots) != 2 || len(routes) != 2 || len(routes[0].Children) != 1 {
+			t.Fatalf("imported %+v %+v", spots, routes)
+		}
+		for _, id := range []string{spots[0].ID, spots[1].ID, routes[0].ID, routes[0].Children[0].ID, routes[1].ID} {
+			if len(id) != 26 || seen[id] {
+				t.Errorf("round %d: ID %q is not a new ULID", round, id)
+			}
+			seen[id] = true
+		}
+		tower, temple := spots[0].ID, spots[1].ID
+		if r := routes[0].Spots; len(r) != 2 || r[0] != temple || r[1] != tower {
+			t.Errorf("round %d: route spots %v, want [%s %s]", round, r, temple, tower)
+		}
+		if r := routes[0].Children[0].Spots; len(r) != 1 || r[0] != tower {
+			t.Errorf("round %d: child route spots %v, want [%s]", round, r, tower)
+		}
+		if r := routes[1].Spots; len(r) != 1 || r[0] != temple {
+			t.Errorf("round %d: route spots by name %v, want [%s]", round, r, temple)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrItemNotFound is returned for an item ID a section does not hold
+	ErrItemNotFound = errors.New("item not found")
+	// ErrDuplicateItemID is returned when adding an item whose ID is taken
+	ErrDuplicateItemID = errors.New("item ID already exists")
+)
+
+// ItemSection gives access to single items of a section file holding a
+// list, so that editing one item does not rewrite the others from the
+// client. Every change is a read-modify-write of the whole file under the
+// destination lock; revisions are those of the file, as for the section.
+type ItemSection[T any] struct {
+	File string
+	ID   func(item *T) *string
+	// Children, if set, returns the items nested in an item. Their IDs
+	// are unique across the section too.
+	Children func(item *T) []T
+	// Validate, if set, checks an item before it is saved; failures wrap
+	// ErrInvalidContent
+	Validate func(item *T) error
+	// refs are the fields referring to items of other sections, which
+	// must exist when saved
+	refs []refField[T]
+}
+
+func (sec *ItemSection[T]) validateItem(item *T) error {
+	if sec.Validate == nil {
+		return nil
+	}
+	return sec.Validate(item)
+}
+
+func (sec *ItemSection[T]) find(items []T, id string) int {
+	for i := range items {
+		if *sec.ID(&items[i]) == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// walk calls fn on every item, children after their parent
+func (sec *ItemSection[T]) walk(items []T, fn func(item *T)) {
+	for i := range items {
+		fn(&items[i])
+		if sec.Children != nil {
+			sec.walk(sec.Children(&items[i]), fn)
+		}
+	}
+}
+
+// takenIDs returns the IDs used in items, except in the item at index
+// except and its children
+func (sec *ItemSection[T]) takenIDs(items []T, except int) map[string]bool {
+	taken := make(map[string]bool)
+	for i := range items {
+		if i != except {
+			sec.walk(items[i:i+1], func(item *T) { taken[*sec.ID(item)] = true })
+		}
+	}
+	return taken
+}
+
+// assignIDs gives every item, children included, that has no ID or one
+// already in taken or used before it a new ID, and returns how many it
+// gave. IDs kept are added to taken.
+func (sec *ItemSection[T]) assignIDs(items []T, taken map[string]bool) int {
+	n := 0
+	sec.walk(items, func(item *T) {
+		id := sec.ID(item)
+		if *id == "" || taken[*id] {
+			*id = newID()
+			n++
+		}
+		taken[*id] = true
+	})
+	return n
+}
+
+// fillIDs gives item an ID if it has none, and its children new IDs
+// where they have none or one in taken
+func (sec *ItemSection[T]) fillIDs(item *T, taken map[string]bool) {
+	if id := sec.ID(item); *id == "" {
+		*id = newID()
+	}
+	taken[*sec.ID(item)] = true
+	if sec.Children != nil {
+		sec.assignIDs(sec.Children(item), taken)
+	}
+}
+
+// Load returns all items, an empty list if the section was never saved
+func (sec *ItemSection[T]) Load(s *DestinationStore) ([]T, error) {
+	items := []T{}
+	_, err := s.LoadSection(sec.File, &items)
+	if items == nil {
+		items = []T{}
+	}
+	return items, err
+}
+
+// Save replaces all items unconditionally
+func (sec *ItemSection[T]) Save(s *DestinationStore, items []T) error {
+	_, err := s.SaveSection(sec.File, items, "")
+	return err
+}
+
+// Get returns the item with the given ID and the revision of the section
+func (sec *ItemSection[T]) Get(s *DestinationStore, id string) (T, string, error) {
+	var items []T
+	rev, err := s.LoadSection(sec.File, &items)
+	if err != nil {
+		var zero T
+		return zero, "", err
+	}
+	i := sec.find(items, id)
+	if i < 0 {
+		var zero T
+		return zero, rev, fmt.Errorf("%w: %s", ErrItemNotFound, id)
+	}
+	return items[i], rev, nil
+}
+
+// update applies change to the items and saves them. If ifMatch is given
+// and stale it returns ErrConflict with the current revision; otherwise a
+// concurrent save in between is retried with the new content. References
+// in the changed items are resolved, and removed items other sections
+// refer to are handled according to onDelete.
+func (sec *ItemSection[T]) update(s *DestinationStore, ifMatch string, onDelete string, change func(items []T) ([]T, error)) (string, error) {
+	for {
+		var old []T
+		rev, err := s.LoadSection(sec.File, &old)
+		if err != nil {
+			return "", err
+		}
+		if !matchRevision(ifMatch, rev) {
+			return rev, ErrConflict
+		}
+		// A copy for change to modify, old is compared against; a save in
+		// between makes SaveSection fail and the loop retry
+		var items []T
+		if _, err := s.LoadSection(sec.File, &items); err != nil {
+			return "", err
+		}
+		items, err = change(items)
+		if err != nil {
+			return rev, err
+		}
+		if err := sec.resolveRefs(s, old, items); err != nil {
+			return rev, err
+		}
+		removed := sec.removedIDs(old, items)
+		if len(removed) > 0 && onDelete == DeleteRestrict {
+			if err := checkReferrers(s, sec.File, removed); err != nil {
+				return rev, err
+			}
+		}
+		w, err := newSectionWrite(sec.File, items, rev)
+		if err != nil {
+			return "", err
+		}
+		writes := []sectionWrite{w}
+		if len(removed) > 0 && onDelete != DeleteRestrict {
+			// The references go in the same write as the removal
+			drops, err := dropReferrers(s, sec.File, removed)
+			if err != nil {
+				return rev, err
+			}
+			writes = append(writes, drops...)
+		}
+		revs, err := s.writeSections(writes)
+		if errors.Is(err, ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return revs[0], nil
+	}
+}
+
+// Add appends item, giving it and its children IDs where they have none,
+// and returns it as saved with the new revision
+func (sec *ItemSection[T]) Add(s *DestinationStore, item T, ifMatch string) (T, string, error) {
+	rev, err := sec.update(s, ifMatch, DeleteRestrict, func(items []T) ([]T, error) {
+		taken := sec.takenIDs(items, -1)
+		if id := *sec.ID(&item); id != "" && taken[id] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateItemID, id)
+		}
+		sec.fillIDs(&item, taken)
+		if err := sec.validateItem(&item); err != nil {
+			return nil, err
+		}
+		return append(items, item), nil
+	})
+	return item, rev, err
+}
+
+// Put replaces the item with the given ID, keeping its position
+func (sec *ItemSection[T]) Put(s *DestinationStore, id string, item T, ifMatch string) (T, string, error) {
+	*sec.ID(&item) = id
+	rev, err := sec.update(s, ifMatch, DeleteRestrict, func(items []T) ([]T, error) {
+		i := sec.find(items, id)
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrItemNotFound, id)
+		}
+		sec.fillIDs(&item, sec.takenIDs(items, i))
+		if err := sec.validateItem(&item); err != nil {
+			return nil, err
+		}
+		items[i] = item
+		return items, nil
+	})
+	return item, rev, err
+}
+
+// Patch sets the fields present in the JSON object patch on the item with
+// the given ID and leaves the others as they are. The ID cannot be changed.
+func (sec *ItemSection[T]) Patch(s *DestinationStore, id string, patch []byte, ifMatch string) (T, string, error) {
+	var patched T
+	rev, err := sec.update(s, ifMatch, DeleteRestrict, func(items []T) ([]T, error) {
+		i := sec.find(items, id)
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrItemNotFound, id)
+		}
+		patched = items[i]
+		if err := json.Unmarshal(patch, &patched); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidContent, err)
+		}
+		*sec.ID(&patched) = id
+		sec.fillIDs(&patched, sec.takenIDs(items, i))
+		if err := sec.validateItem(&patched); err != nil {
+			return nil, err
+		}
+		items[i] = patched
+		return items, nil
+	})
+	return patched, rev, err
+}
+
+// Delete removes the item with the given ID. If other items refer to it,
+// onDelete decides: DeleteCascade (or "") removes the references too,
+// DeleteRestrict refuses with ErrReferenced.
+func (sec *ItemSection[T]) Delete(s *DestinationStore, id string, ifMatch string, onDelete string) (string, error) {
+	return sec.update(s, ifMatch, onDelete, func(items []T) ([]T, error) {
+		i := sec.find(items, id)
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrItemNotFound, id)
+		}
+		return append(items[:i], items[i+1:]...), nil
+	})
+}
+
+// Items are the item operations of a list section on JSON, for callers
+// that do not know the item type. Bodies that do not decode, or fail
+// validation, yield ErrInvalidContent.
+type Items interface {
+	GetItem(s *DestinationStore, id string) (interface{}, string, error)
+	AddItem(s *DestinationStore, data []byte, ifMatch string) (interface{}, string, error)
+	PutItem(s *DestinationStore, id string, data []byte, ifMatch string) (interface{}, string, error)
+	PatchItem(s *DestinationStore, id string, patch []byte, ifMatch string) (interface{}, string, error)
+	DeleteItem(s *DestinationStore, id string, ifMatch string, onDelete string) (string, error)
+}
+
+func (sec *ItemSection[T]) decode(data []byte) (T, error) {
+	var item T
+	if err := json.Unmarshal(data, &item); err != nil {
+		return item, fmt.Errorf("%w: %v", ErrInvalidContent, err)
+	}
+	return item, nil
+}
+
+func (sec *ItemSection[T]) GetItem(s *DestinationStore, id string) (interface{}, string, error) {
+	return sec.Get(s, id)
+}
+
+func (sec *ItemSection[T]) AddItem(s *DestinationStore, data []byte, ifMatch string) (interface{}, string, error) {
+	item, err := sec.decode(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return sec.Add(s, item, ifMatch)
+}
+
+// PutItem refuses a body whose ID differs from id
+func (sec *ItemSection[T]) PutItem(s *DestinationStore, id string, data []byte, ifMatch string) (interface{}, string, error) {
+	item, err := sec.decode(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if bodyID := *sec.ID(&item); bodyID != "" && bodyID != id {
+		return nil, "", fmt.Errorf("%w: id %s in the body does not match %s", ErrInvalidContent, bodyID, id)
+	}
+	return sec.Put(s, id, item, ifMatch)
+}
+
+// PatchItem requires a JSON object
+func (sec *ItemSection[T]) PatchItem(s *DestinationStore, id string, patch []byte, ifMatch string) (interface{}, string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return nil, "", fmt.Errorf("%w: patch must be a JSON object: %v", ErrInvalidContent, err)
+	}
+	return sec.Patch(s, id, patch, ifMatch)
+}
+
+func (sec *ItemSection[T]) DeleteItem(s *DestinationStore, id string, ifMatch string, onDelete string) (string, error) {
+	return sec.Delete(s, id, ifMatch, onDelete)
+}
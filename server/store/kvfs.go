@@ -0,0 +1,146 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// kvEntry describes one stored key of a key-value backend
+type kvEntry struct {
+	key     string
+	dir     bool
+	size    int64
+	modTime time.Time
+}
+
+// kvSource is what a key-value backend implements to be browsable as an
+// fs.FS through kvOpen
+type kvSource interface {
+	// stat looks up exactly key
+	stat(key string) (kvEntry, bool, error)
+	// read returns the content of the file key
+	read(key string) ([]byte, error)
+	// scan returns every entry strictly below prefix ("" means all)
+	scan(prefix string) ([]kvEntry, error)
+}
+
+// kvOpen implements fs.FS.Open on top of a kvSource. Directories exist
+// either explicitly or implicitly because some key lies below them.
+func kvOpen(src kvSource, name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	info := kvEntry{key: name, dir: true}
+	explicit := name == "."
+	if name != "." {
+		e, ok, err := src.stat(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		if ok && !e.dir {
+			data, err := src.read(name)
+			if err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+			return &kvFile{info: kvFileInfo(e), Reader: bytes.NewReader(data)}, nil
+		}
+		if ok {
+			info = e
+			explicit = true
+		}
+	}
+
+	prefix := ""
+	if name != "." {
+		prefix = name + "/"
+	}
+	below, err := src.scan(prefix)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if !explicit && len(below) == 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	// Reduce everything below to the immediate children
+	children := make(map[string]kvEntry)
+	for _, e := range below {
+		rest := strings.TrimPrefix(e.key, prefix)
+		first, _, deeper := strings.Cut(rest, "/")
+		if first == "" {
+			continue
+		}
+		if deeper {
+			if _, ok := children[first]; !ok {
+				children[first] = kvEntry{key: prefix + first, dir: true}
+			}
+			continue
+		}
+		children[first] = e
+	}
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, e := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(kvFileInfo(e)))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return &kvDir{info: kvFileInfo(info), entries: entries}, nil
+}
+
+// kvFileInfo adapts a kvEntry to fs.FileInfo
+type kvFileInfo kvEntry
+
+func (i kvFileInfo) Name() string       { return path.Base(i.key) }
+func (i kvFileInfo) Size() int64        { return i.size }
+func (i kvFileInfo) ModTime() time.Time { return i.modTime }
+func (i kvFileInfo) IsDir() bool        { return i.dir }
+func (i kvFileInfo) Sys() interface{}   { return nil }
+func (i kvFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// kvFile is an open regular file; it is seekable so http.FileServer can
+// serve ranges
+type kvFile struct {
+	info kvFileInfo
+	*bytes.Reader
+}
+
+func (f *kvFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *kvFile) Close() error               { return nil }
+
+// kvDir is an open directory
+type kvDir struct {
+	info    kvFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *kvDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *kvDir) Close() error               { return nil }
+func (d *kvDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.key, Err: fs.ErrInvalid}
+}
+
+func (d *kvDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
@@ -0,0 +1,431 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LayoutVersion is the version of the on-disk layout this build reads and
+// writes. It is kept in the VersionFile of the data directory.
+//
+// History:
+//
+//	1  plans.json, plans/<id>/destinations.json and
+//	   plans/<id>/destinations/<id>/*.json, written before VERSION existed;
+//	   destinations.json and destinations/<id> may still be at the top
+//	   level from before the plan/destination split
+//	2  top-level destinations moved into a plan
+//	3  images moved from plans/<id>/destinations/<id>/images to BlobDir
+//	4  route spots refer to spots by ID rather than by name
+const LayoutVersion = 4
+
+// VersionFile holds the layout version of a data directory
+const VersionFile = "VERSION"
+
+var (
+	// ErrLayoutTooNew is returned for data written by a newer travel-map
+	ErrLayoutTooNew = errors.New("data directory is newer than this travel-map supports")
+	// ErrMigrationNeeded is returned for data of an older layout
+	ErrMigrationNeeded = errors.New("data directory needs migration, run: travel-map migrate --apply")
+)
+
+// layoutMigration upgrades the data from version from to from+1. It runs
+// under the data-directory lock, so it must not call the locking store
+// methods. It returns what it did, one line per action.
+type layoutMigration struct {
+	from        int
+	description string
+	migrate     func(s *GlobalStore) ([]string, error)
+}
+
+// layoutMigrations must form a chain from version 1 to LayoutVersion
+var layoutMigrations = []layoutMigration{
+	{
+		from:        1,
+		description: "move top-level destinations into a plan",
+		migrate:     adoptTopLevelDestinations,
+	},
+	{
+		from:        2,
+		description: "move destination images into the shared blob store",
+		migrate:     moveImagesToBlobs,
+	},
+	{
+		from:        3,
+		description: "link route spots to spots by ID",
+		migrate:     linkRouteSpots,
+	},
+}
+
+func init() {
+	for i, m := range layoutMigrations {
+		if m.from != i+1 {
+			panic(fmt.Sprintf("layout migration %d starts at version %d, expecting %d", i, m.from, i+1))
+		}
+	}
+	if len(layoutMigrations) != LayoutVersion-1 {
+		panic(fmt.Sprintf("layout migrations reach version %d, expecting %d", len(layoutMigrations)+1, LayoutVersion))
+	}
+}
+
+// MigrationStep is one pending or applied migration
+type MigrationStep struct {
+	From        int      `json:"from"`
+	To          int      `json:"to"`
+	Description string   `json:"description"`
+	Actions     []string `json:"actions,omitempty"` // set once applied
+}
+
+// MigrationStatus tells where a data directory stands
+type MigrationStatus struct {
+	Version int             `json:"version"` // 0 for an empty data directory
+	Target  int             `json:"target"`
+	Steps   []MigrationStep `json:"steps"` // pending, or applied by Migrate
+	// Backup counts the files copied to the backup before migrating
+	Backup int `json:"backup,omitempty"`
+}
+
+// Pending reports whether any migration is left to run
+func (st MigrationStatus) Pending() bool {
+	return len(st.Steps) > 0
+}
+
+// layoutVersion reads the version of the data. Data without a VersionFile
+// is version 1, or 0 if there is no data at all.
+func (s *GlobalStore) layoutVersion() (int, error) {
+	data, err := s.Backend.ReadFile(VersionFile)
+	if err == nil {
+		v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || v < 1 {
+			return 0, fmt.Errorf("invalid %s: %q", VersionFile, strings.TrimSpace(string(data)))
+		}
+		return v, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	for _, key := range []string{"plans.json", "destinations.json"} {
+		if _, err := s.Backend.ReadFile(key); err == nil {
+			return 1, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+func (s *GlobalStore) writeLayoutVersion(v int) error {
+	return s.Backend.WriteFile(VersionFile, []byte(strconv.Itoa(v)+"\n"))
+}
+
+// MigrationStatus returns the version of the data and the migrations
+// needed to bring it to LayoutVersion
+func (s *GlobalStore) MigrationStatus() (MigrationStatus, error) {
+	v, err := s.layoutVersion()
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+	st := MigrationStatus{Version: v, Target: LayoutVersion, Steps: []MigrationStep{}}
+	if v > LayoutVersion {
+		return st, fmt.Errorf("%w: version %d, this build supports up to %d", ErrLayoutTooNew, v, LayoutVersion)
+	}
+	if v == 0 {
+		// Nothing to migrate, a new data directory starts at the latest
+		return st, nil
+	}
+	for _, m := range layoutMigrations[v-1:] {
+		st.Steps = append(st.Steps, MigrationStep{From: m.from, To: m.from + 1, Description: m.description})
+	}
+	return st, nil
+}
+
+// CheckLayout makes sure the data can be served by this build: an empty
+// data directory is stamped with LayoutVersion, older data yields
+// ErrMigrationNeeded and newer data ErrLayoutTooNew.
+func (s *GlobalStore) CheckLayout() error {
+	unlock, err := s.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	st, err := s.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	if st.Pending() {
+		return fmt.Errorf("%w (version %d, current %d)", ErrMigrationNeeded, st.Version, LayoutVersion)
+	}
+	if st.Version == 0 {
+		return s.writeLayoutVersion(LayoutVersion)
+	}
+	return nil
+}
+
+// Migrate brings the data to LayoutVersion. Unless backup is nil, every
+// file is first copied to backup. VERSION is written after each step, so
+// a failed migration resumes at the step that failed.
+func (s *GlobalStore) Migrate(backup Backend) (MigrationStatus, error) {
+	unlock, err := s.Lock()
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+	defer unlock()
+	st, err := s.MigrationStatus()
+	if err != nil {
+		return st, err
+	}
+	if !st.Pending() {
+		if st.Version == 0 {
+			return st, s.writeLayoutVersion(LayoutVersion)
+		}
+		return st, nil
+	}
+
+	if backup != nil {
+		st.Backup, err = CopyBackend(backup, s.Backend)
+		if err != nil {
+			return st, fmt.Errorf("backup: %w", err)
+		}
+	}
+	for i := range st.Steps {
+		step := &st.Steps[i]
+		step.Actions, err = layoutMigrations[step.From-1].migrate(s)
+		if err != nil {
+			return st, fmt.Errorf("migrate from version %d (%s): %w", step.From, step.Description, err)
+		}
+		if err := s.writeLayoutVersion(step.To); err != nil {
+			return st, err
+		}
+		st.Version = step.To
+	}
+	return st, nil
+}
+
+// adoptTopLevelDestinations moves destinations.json and destinations/<id>
+// left at the top level into a new plan, rewriting the image URLs that
+// point into them
+func adoptTopLevelDestinations(s *GlobalStore) ([]string, error) {
+	data, err := s.Backend.ReadFile("destinations.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dests []Destination
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &dests); err != nil {
+			return nil, fmt.Errorf("destinations.json: %w", err)
+		}
+	}
+	plans, err := s.ListPlans()
+	if err != nil {
+		return nil, err
+	}
+	plan := Plan{
+		ID:        newID(),
+		Name:      "Default",
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	planPrefix := joinKey("plans", plan.ID)
+
+	var actions []string
+	for _, d := range dests {
+		from := joinKey("destinations", d.ID)
+		to := joinKey(planPrefix, "destinations", d.ID)
+		oldURL := []byte("data/" + from + "/")
+		newURL := []byte("data/" + to + "/")
+		n := 0
+		err := fs.WalkDir(s.Backend, from, func(key string, e fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return fs.SkipDir
+				}
+				return err
+			}
+			if e.IsDir() || isInternalName(e.Name()) {
+				return nil
+			}
+			content, err := s.Backend.ReadFile(key)
+			if err != nil {
+				return err
+			}
+			if strings.HasSuffix(key, ".json") {
+				content = bytes.ReplaceAll(content, oldURL, newURL)
+			}
+			n++
+			return s.Backend.WriteFile(to+strings.TrimPrefix(key, from), content)
+		})
+		if err != nil {
+			return actions, err
+		}
+		actions = append(actions, fmt.Sprintf("moved destination %q (%d files) to %s", d.Name, n, to))
+	}
+	if err := s.Backend.WriteFile(joinKey(planPrefix, "destinations.json"), data); err != nil {
+		return actions, err
+	}
+	if err := s.savePlans(append(plans, plan)); err != nil {
+		return actions, err
+	}
+	actions = append(actions, fmt.Sprintf("created plan %q (%s) for them", plan.Name, plan.ID))
+
+	// Only remove the originals once the plan is in place
+	if err := s.Backend.RemoveAll("destinations"); err != nil {
+		return actions, err
+	}
+	if err := s.Backend.RemoveAll("destinations.json"); err != nil {
+		return actions, err
+	}
+	return actions, nil
+}
+
+// moveImagesToBlobs stores the images of every destination as blobs,
+// points all data URLs at the blobs and removes the originals
+func moveImagesToBlobs(s *GlobalStore) ([]string, error) {
+	var plans []Plan
+	if err := s.readList("plans.json", &plans); err != nil {
+		return nil, fmt.Errorf("plans.json: %w", err)
+	}
+	var oldKeys []string
+	var pairs []string
+	var moved, size int64
+	for _, p := range plans {
+		listKey := joinKey("plans", p.ID, "destinations.json")
+		var dests []Destination
+		if err := s.readList(listKey, &dests); err != nil {
+			return nil, fmt.Errorf("%s: %w", listKey, err)
+		}
+		for _, d := range dests {
+			dir := joinKey("plans", p.ID, "destinations", d.ID, "images")
+			entries, err := fs.ReadDir(s.Backend, dir)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if e.IsDir() || isInternalName(e.Name()) {
+					continue
+				}
+				key := joinKey(dir, e.Name())
+				data, err := s.Backend.ReadFile(key)
+				if err != nil {
+					return nil, err
+				}
+				blob, err := s.putBlob(data, path.Ext(e.Name()))
+				if err != nil {
+					return nil, err
+				}
+				oldKeys = append(oldKeys, key)
+				pairs = append(pairs, "data/"+key, "data/"+blob)
+				moved++
+				size += int64(len(data))
+			}
+		}
+	}
+	if len(oldKeys) == 0 {
+		return nil, nil
+	}
+
+	// URLs may point into other destinations, so every file is rewritten
+	replacer := strings.NewReplacer(pairs...)
+	rewritten := 0
+	err := fs.WalkDir(s.Backend, "plans", func(key string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() || !strings.HasSuffix(key, ".json") || isInternalName(e.Name()) {
+			return nil
+		}
+		data, err := s.Backend.ReadFile(key)
+		if err != nil {
+			return err
+		}
+		updated := replacer.Replace(string(data))
+		if updated == string(data) {
+			return nil
+		}
+		rewritten++
+		return s.Backend.WriteFile(key, []byte(updated))
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range oldKeys {
+		if err := s.Backend.RemoveAll(key); err != nil {
+			return nil, err
+		}
+	}
+	return []string{
+		fmt.Sprintf("moved %d images (%d bytes) to %s", moved, size, BlobDir),
+		fmt.Sprintf("rewrote image URLs in %d files", rewritten),
+	}, nil
+}
+
+// linkRouteSpots gives spots without an ID one and points route spots
+// naming a spot at its ID. Names that match no spot, or several, are left
+// for the doctor to report.
+func linkRouteSpots(s *GlobalStore) ([]string, error) {
+	var plans []Plan
+	if err := s.readList("plans.json", &plans); err != nil {
+		return nil, fmt.Errorf("plans.json: %w", err)
+	}
+	var spotIDs, linked int
+	for _, p := range plans {
+		listKey := joinKey("plans", p.ID, "destinations.json")
+		var dests []Destination
+		if err := s.readList(listKey, &dests); err != nil {
+			return nil, fmt.Errorf("%s: %w", listKey, err)
+		}
+		for _, d := range dests {
+			prefix := joinKey("plans", p.ID, "destinations", d.ID)
+			var fd FullDestination
+			for _, sec := range []Section{SpotSection, RouteSection} {
+				key := joinKey(prefix, sec.File())
+				if err := s.readList(key, sec.field(&fd)); err != nil {
+					return nil, fmt.Errorf("%s: %w", key, err)
+				}
+			}
+			spots := SpotSection.List(&fd)
+			n := SpotSection.AssignIDs(spots)
+			if n > 0 {
+				if err := s.writeJSON(joinKey(prefix, SpotSection.File()), *spots); err != nil {
+					return nil, err
+				}
+			}
+			spotIDs += n
+			n = RouteSection.link(&fd, &fd)
+			if n > 0 {
+				if err := s.writeJSON(joinKey(prefix, RouteSection.File()), *RouteSection.List(&fd)); err != nil {
+					return nil, err
+				}
+			}
+			linked += n
+		}
+	}
+	if spotIDs == 0 && linked == 0 {
+		return nil, nil
+	}
+	return []string{
+		fmt.Sprintf("gave %d spots an ID", spotIDs),
+		fmt.Sprintf("linked %d route spots by ID", linked),
+	}, nil
+}
+
+// writeJSON writes v as indented JSON, as SaveSection does, but without
+// taking locks
+func (s *GlobalStore) writeJSON(key string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.Backend.WriteFile(key, data)
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestMigrateFromVersion1(t *testing.T) {
+	dir := t.TempDir()
+	b := NewFileBackend(dir)
+	image := testPNG(t, 4, 4, 1)
+	// Destinations at the top level, images inside them, routes naming spots
+	for key, content := range map[string]string{
+		"destinations.json":                 `[{"id":"d1","name":"Kyoto"}]`,
+		"destinations/d1/images/a.png":      string(image),
+		"destinations/d1/guide_images.json": `[{"id":"g1","url":"/api/data/destinations/d1/images/a.png"}]`,
+		"destinations/d1/spots.json":        `[{"name":"Tower"},{"name":"Temple"}]`,
+		"destinations/d1/routes.json":       `[{"id":"r1","name":"Day 1","spots":["Temple","Tower"]}]`,
+	} {
+		if err := b.WriteFile(key, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewGlobalStoreWithBackend(b)
+	if err := s.CheckLayout(); !errors.Is(err, ErrMigrationNeeded) {
+		t.Fatalf("check: %v, want ErrMigrationNeeded", err)
+	}
+
+	backup := NewFileBackend(t.TempDir())
+	st, err := s.Migrate(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Version != LayoutVersion || len(st.Steps) != LayoutVersion-1 || st.Backup != 5 {
+		t.Errorf("status %+v", st)
+	}
+	if err := s.CheckLayout(); err != nil {
+		t.Fatalf("check after migrating: %v", err)
+	}
+	if data, err := backup.ReadFile("destinations/d1/spots.json"); err != nil || !strings.Contains(string(data), "Tower") {
+		t.Errorf("backup: %q, %v", data, err)
+	}
+	for _, key := range []string{"destinations.json", "destinations"} {
+		if _, err := fs.Stat(b, key); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s left in place: %v", key, err)
+		}
+	}
+
+	plans, err := s.ListPlans()
+	if err != nil || len(plans) != 1 {
+		t.Fatalf("plans %+v: %v", plans, err)
+	}
+	ps, err := s.GetPlanStore(plans[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := ps.GetDestinationStore("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := GuideImageSection.Load(ds)
+	if err != nil || len(images) != 1 || !strings.Contains(images[0].URL, "/data/"+BlobDir+"/") {
+		t.Fatalf("guide images %+v, want a blob URL: %v", images, err)
+	}
+	key, ok := s.keyFromURL(images[0].URL)
+	if !ok {
+		t.Fatalf("URL %s does not resolve", images[0].URL)
+	}
+	if data, err := b.ReadFile(key); err != nil || string(data) != string(image) {
+		t.Errorf("blob %s: %v", key, err)
+	}
+	spots, err := SpotSection.Load(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := RouteSection.Load(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spots) != 2 || spots[0].ID == "" || spots[1].ID == "" || len(routes) != 1 {
+		t.Fatalf("spots %+v, want IDs; routes %+v", spots, routes)
+	}
+	if r := routes[0].Spots; len(r) != 2 || r[0] != spots[1].ID || r[1] != spots[0].ID {
+		t.Errorf("route spots %v, want [%s %s]", r, spots[1].ID, spots[0].ID)
+	}
+
+	// Migrating again has nothing to do
+	if st, err := s.Migrate(nil); err != nil || st.Pending() {
+		t.Errorf("second migration: %+v, %v", st, err)
+	}
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// lockFileName is the advisory lock file kept in every locked directory
+const lockFileName = ".lock"
+
+// errLocked reports a lock file held by another process
+var errLocked = errors.New("locked by another process")
+
+// dirLocks holds one in-process mutex per locked directory, keyed by its
+// absolute path, so goroutines serialize before touching the file lock.
+var dirLocks keyLocks
+
+// lockDir takes an exclusive lock on dir, both within this process and,
+// where the platform supports it, against other travel-map processes
+// sharing the same data directory. The returned func releases the lock.
+// dir must exist: locking never creates it, so a writer that waited for
+// the lock of a directory removed meanwhile gets an error matching
+// fs.ErrNotExist instead of bringing it back.
+//
+// Locks nest from the data directory down to plans and destinations;
+// callers must always acquire them in that order.
+func lockDir(dir string) (func(), error) {
+	key, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	unlock := dirLocks.lock(key)
+
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+		unlock()
+	}, nil
+}
+
+// lockExisting takes the backend lock of the directory key and fails with
+// notFound if the directory does not exist, e.g. because it was removed
+// while waiting for the lock
+func lockExisting(b Backend, key string, notFound error) (func(), error) {
+	unlock, err := b.Lock(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, notFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fs.Stat(b, key); err != nil {
+		unlock()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, notFound
+		}
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// notFoundError returns err for the ID the key prefix ends in
+func notFoundError(err error, prefix string) error {
+	return fmt.Errorf("%w: %s", err, path.Base(prefix))
+}
+
+// keyLocks is a set of in-process mutexes keyed by store key, for
+// backends that have no directory to put a lock file in. A mutex is
+// dropped once nobody holds or waits for it.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int // holders and waiters, guarded by keyLocks.mu
+}
+
+func (l *keyLocks) lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyLock)
+	}
+	kl := l.locks[key]
+	if kl == nil {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+		l.mu.Lock()
+		kl.refs--
+		if kl.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// size returns the number of mutexes held or waited for
+func (l *keyLocks) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.locks)
+}
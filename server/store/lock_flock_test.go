@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTryLockFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "travel-map.db"+sqliteLockSuffix)
+	open := func() *os.File {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	first, second := open(), open()
+	if err := tryLockFile(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := tryLockFile(second); err != errLocked {
+		t.Fatalf("second lock: %v, want errLocked", err)
+	}
+	releaseLockFile(first)
+	if err := tryLockFile(second); err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+}
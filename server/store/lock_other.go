@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package store
+
+import "os"
+
+// Advisory file locks are not available here; only the in-process
+// mutex in lockDir protects the data directory.
+
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
+
+func tryLockFile(f *os.File) error {
+	return nil
+}
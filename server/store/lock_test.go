@@ -0,0 +1,87 @@
+package store
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func TestLockedWriteAfterDeleteDoesNotRecreateDestination(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		s    *GlobalStore
+	}{
+		{"file", newTestStore(t)},
+		{"memory", NewMemoryStore()},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.s
+			planStore, destStore := newTestDestination(t, s)
+
+			// Hold the destination lock while a writer queues up behind it
+			unlock, err := destStore.Lock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved := make(chan error, 1)
+			go func() {
+				_, err := destStore.SaveSection(SpotSection.File(), []Spot{{ID: "a", Name: "Temple"}}, "")
+				saved <- err
+			}()
+			time.Sleep(20 * time.Millisecond)
+
+			// The delete removes the directory once the writer is through,
+			// whichever gets the lock first; release ours to let them run
+			deleted := make(chan error, 1)
+			go func() {
+				dests, err := planStore.ListDestinations()
+				if err != nil {
+					deleted <- err
+					return
+				}
+				deleted <- planStore.DeleteDestination(dests[0].ID)
+			}()
+			time.Sleep(20 * time.Millisecond)
+			unlock()
+
+			if err := <-deleted; err != nil {
+				t.Fatal(err)
+			}
+			if err := <-saved; err != nil && !errors.Is(err, ErrDestinationNotFound) {
+				t.Fatalf("save: %v, want nil or ErrDestinationNotFound", err)
+			}
+			if _, err := fs.Stat(s.Backend, destStore.Prefix); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("destination directory exists after delete: %v", err)
+			}
+
+			// Later writers fail instead of bringing it back
+			if _, err := destStore.SaveSection(SpotSection.File(), []Spot{}, ""); !errors.Is(err, ErrDestinationNotFound) {
+				t.Fatalf("save after delete: %v, want ErrDestinationNotFound", err)
+			}
+			if _, err := fs.Stat(s.Backend, destStore.Prefix); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("save after delete recreated the directory: %v", err)
+			}
+		})
+	}
+}
+
+func TestKeyLocksShrink(t *testing.T) {
+	var l keyLocks
+	done := make(chan struct{})
+	unlock := l.lock("a")
+	go func() {
+		l.lock("a")()
+		close(done)
+	}()
+	l.lock("b")()
+	time.Sleep(10 * time.Millisecond)
+	if n := l.size(); n != 1 {
+		t.Fatalf("%d locks while one is held, want 1", n)
+	}
+	unlock()
+	<-done
+	if n := l.size(); n != 0 {
+		t.Fatalf("%d locks left after release, want 0", n)
+	}
+}
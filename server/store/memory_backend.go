@@ -0,0 +1,159 @@
+package store
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps every key in memory. It is meant for tests, demos
+// and embedding: nothing touches the filesystem and nothing survives the
+// process.
+type MemoryBackend struct {
+	mu    sync.RWMutex
+	files map[string]memoryFile
+	locks keyLocks
+}
+
+type memoryFile struct {
+	entry kvEntry
+	data  []byte
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{files: make(map[string]memoryFile)}
+}
+
+// NewMemoryStore returns a GlobalStore on a fresh MemoryBackend
+func NewMemoryStore() *GlobalStore {
+	return NewGlobalStoreWithBackend(NewMemoryBackend())
+}
+
+func (b *MemoryBackend) Open(name string) (fs.File, error) {
+	return kvOpen(b, name)
+}
+
+func (b *MemoryBackend) stat(key string) (kvEntry, bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	f, ok := b.files[key]
+	return f.entry, ok, nil
+}
+
+func (b *MemoryBackend) read(key string) ([]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	f, ok := b.files[key]
+	if !ok || f.entry.dir {
+		return nil, fs.ErrNotExist
+	}
+	// Callers may modify what they get back
+	return append([]byte{}, f.data...), nil
+}
+
+func (b *MemoryBackend) scan(prefix string) ([]kvEntry, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var entries []kvEntry
+	for key, f := range b.files {
+		if strings.HasPrefix(key, prefix) && key != strings.TrimSuffix(prefix, "/") {
+			entries = append(entries, f.entry)
+		}
+	}
+	return entries, nil
+}
+
+func (b *MemoryBackend) ReadFile(key string) ([]byte, error) {
+	if err := checkKey("read", key); err != nil {
+		return nil, err
+	}
+	data, err := b.read(key)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: key, Err: err}
+	}
+	return data, nil
+}
+
+// mkdirAllLocked records key and its parents as directories; b.mu must
+// be held
+func (b *MemoryBackend) mkdirAllLocked(key string, now time.Time) {
+	for key != "" && key != "." {
+		if _, ok := b.files[key]; !ok {
+			b.files[key] = memoryFile{entry: kvEntry{key: key, dir: true, modTime: now}}
+		}
+		key = path.Dir(key)
+	}
+}
+
+func (b *MemoryBackend) WriteFile(key string, data []byte) error {
+	return b.WriteFiles([]FileChange{{Key: key, Data: data}})
+}
+
+func (b *MemoryBackend) MkdirAll(key string) error {
+	if err := checkKey("mkdir", key); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mkdirAllLocked(key, time.Now())
+	return nil
+}
+
+func (b *MemoryBackend) RemoveAll(key string) error {
+	return b.WriteFiles([]FileChange{{Key: key, Remove: true}})
+}
+
+// WriteFiles applies the changes under one hold of the mutex, so readers
+// see all of them or none
+func (b *MemoryBackend) WriteFiles(changes []FileChange) error {
+	for _, c := range changes {
+		op := "write"
+		if c.Remove {
+			op = "remove"
+		}
+		if err := checkKey(op, c.Key); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range changes {
+		if c.Remove {
+			b.removeAllLocked(c.Key)
+			continue
+		}
+		b.mkdirAllLocked(path.Dir(c.Key), now)
+		b.files[c.Key] = memoryFile{
+			entry: kvEntry{key: c.Key, size: int64(len(c.Data)), modTime: now},
+			data:  append([]byte{}, c.Data...),
+		}
+	}
+	return nil
+}
+
+// removeAllLocked deletes key and everything below it; b.mu must be held
+func (b *MemoryBackend) removeAllLocked(key string) {
+	if key == "" || key == "." {
+		b.files = make(map[string]memoryFile)
+		return
+	}
+	for k := range b.files {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(b.files, k)
+		}
+	}
+}
+
+func (b *MemoryBackend) Lock(key string) (func(), error) {
+	if err := checkKey("lock", key); err != nil {
+		return nil, err
+	}
+	return b.locks.lock(key), nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
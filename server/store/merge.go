@@ -0,0 +1,429 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Merge policies for items that exist on both sides but differ
+const (
+	MergeTheirs = "theirs" // take the incoming version (default)
+	MergeOurs   = "ours"   // keep the existing version and report a conflict
+)
+
+// CheckConflictPolicy accepts MergeTheirs, MergeOurs and "" for the
+// default
+func CheckConflictPolicy(policy string) error {
+	switch policy {
+	case "", MergeTheirs, MergeOurs:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy %q, expecting %s or %s", policy, MergeTheirs, MergeOurs)
+}
+
+// Actions of an ImportChange
+const (
+	ChangeAdded    = "added"
+	ChangeUpdated  = "updated"
+	ChangeConflict = "conflict"
+)
+
+// coordTolerance is how far apart, in degrees, two places with the same
+// name may be and still count as the same place (about 50m)
+const coordTolerance = 0.0005
+
+// ImportChange is one thing a merge import did, or would do in a dry run.
+// Unchanged items are not reported.
+type ImportChange struct {
+	Destination string `json:"destination"`
+	Section     string `json:"section,omitempty"` // empty for the destination itself
+	Item        string `json:"item,omitempty"`
+	Action      string `json:"action"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+// merger merges incoming destinations into existing ones and records
+// what changed
+type merger struct {
+	s      *GlobalStore
+	policy string
+	// resolve returns the content of an incoming image that is neither
+	// base64 nor stored, i.e. an archive entry
+	resolve func(url string) ([]byte, bool)
+
+	changes []ImportChange
+	dest    string // destination currently merged, for the changes
+	// ids maps IDs of incoming items to ours, for the destination
+	// currently merged
+	ids    idMap
+	hashes map[string]string // backend key -> content hash
+}
+
+func newMerger(s *GlobalStore, policy string, resolve func(url string) ([]byte, bool)) *merger {
+	return &merger{
+		s:       s,
+		policy:  policy,
+		resolve: resolve,
+		changes: []ImportChange{},
+		hashes:  make(map[string]string),
+	}
+}
+
+func (m *merger) change(section string, item string, action string, detail string) {
+	m.changes = append(m.changes, ImportChange{Destination: m.dest, Section: section, Item: item, Action: action, Detail: detail})
+}
+
+// imageKey identifies image content no matter whether it is stored,
+// embedded as base64 or an archive entry
+func (m *merger) imageKey(url string, b64 string) string {
+	var data []byte
+	if b64 != "" {
+		if d, err := base64.StdEncoding.DecodeString(b64); err == nil {
+			data = d
+		}
+	} else if key, ok := m.s.keyFromURL(url); ok {
+		if h, ok := m.hashes[key]; ok {
+			return h
+		}
+		if d, err := m.s.Backend.ReadFile(key); err == nil {
+			sum := sha256.Sum256(d)
+			m.hashes[key] = hex.EncodeToString(sum[:])
+			return m.hashes[key]
+		}
+	} else if m.resolve != nil {
+		if d, ok := m.resolve(url); ok {
+			data = d
+		}
+	}
+	if data == nil {
+		return "url:" + url
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// fingerprint renders an item for comparison: IDs, its own and those of
+// nested items, are dropped and each image field pair (url field, base64
+// field) is replaced by its content
+func (m *merger) fingerprint(v interface{}, images ...[2]string) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return string(data)
+	}
+	dropIDs(obj)
+	for _, f := range images {
+		url, _ := obj[f[0]].(string)
+		b64, _ := obj[f[1]].(string)
+		if url != "" || b64 != "" {
+			obj[f[0]] = m.imageKey(url, b64)
+		}
+		delete(obj, f[1])
+	}
+	// Map keys are marshaled in sorted order
+	out, _ := json.Marshal(obj)
+	return string(out)
+}
+
+// dropIDs deletes the "id" fields of a decoded JSON object and of the
+// objects within it
+func dropIDs(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		delete(v, "id")
+		for _, e := range v {
+			dropIDs(e)
+		}
+	case []interface{}:
+		for _, e := range v {
+			dropIDs(e)
+		}
+	}
+}
+
+// mergeRules describe how the items of one section are matched
+type mergeRules[T any] struct {
+	section string
+	key     func(T) string // items with equal keys are the same item
+	label   func(T) string // how an item is named in the report (default: key)
+	// coords, if set, keep items with the same key but at different
+	// places apart: the incoming one is added next to ours
+	coords func(T) (lat, lng float64)
+	id     func(*T) *string
+	images [][2]string // image field pairs, see fingerprint
+}
+
+// mergeItems merges theirs into ours: unknown items are added, matched
+// items that differ are updated or kept according to the policy. Added
+// items get new IDs, matched ones keep ours, recorded in m.ids.
+func mergeItems[T any](m *merger, rules mergeRules[T], ours []T, theirs []T) ([]T, bool) {
+	merged := append([]T{}, ours...)
+	used := make([]bool, len(ours))
+	changed := false
+	for _, t := range theirs {
+		k := rules.key(t)
+		label := k
+		if rules.label != nil {
+			label = rules.label(t)
+		}
+		idx, elsewhere := -1, -1
+		for i := range ours {
+			if used[i] || rules.key(ours[i]) != k {
+				continue
+			}
+			if rules.coords != nil && !sameItemPlace(rules.coords, ours[i], t) {
+				if elsewhere < 0 {
+					elsewhere = i
+				}
+				continue
+			}
+			idx = i
+			break
+		}
+		theirID := *rules.id(&t)
+		if idx < 0 {
+			detail := ""
+			if elsewhere >= 0 {
+				oLat, oLng := rules.coords(ours[elsewhere])
+				tLat, tLng := rules.coords(t)
+				detail = fmt.Sprintf("same name as an item at a different place (%.5f,%.5f here, %.5f,%.5f incoming), added separately", oLat, oLng, tLat, tLng)
+			}
+			*rules.id(&t) = newID()
+			m.ids.set(rules.section, theirID, *rules.id(&t))
+			merged = append(merged, t)
+			changed = true
+			m.change(rules.section, label, ChangeAdded, detail)
+			continue
+		}
+		used[idx] = true
+		o := ours[idx]
+		m.ids.set(rules.section, theirID, *rules.id(&o))
+		if m.fingerprint(o, rules.images...) == m.fingerprint(t, rules.images...) {
+			continue
+		}
+		if m.policy == MergeOurs {
+			m.change(rules.section, label, ChangeConflict, "differs, kept the existing version")
+			continue
+		}
+		*rules.id(&t) = *rules.id(&o)
+		merged[idx] = t
+		changed = true
+		m.change(rules.section, label, ChangeUpdated, "")
+	}
+	return merged, changed
+}
+
+// sameItemPlace compares the places of two items
+func sameItemPlace[T any](coords func(T) (lat, lng float64), a T, b T) bool {
+	aLat, aLng := coords(a)
+	bLat, bLng := coords(b)
+	return samePlace(aLat, aLng, bLat, bLng)
+}
+
+// samePlace compares coordinates; a place without coordinates matches
+// any place
+func samePlace(lat1, lng1, lat2, lng2 float64) bool {
+	if (lat1 == 0 && lng1 == 0) || (lat2 == 0 && lng2 == 0) {
+		return true
+	}
+	return math.Abs(lat1-lat2) <= coordTolerance && math.Abs(lng1-lng2) <= coordTolerance
+}
+
+func trimKey(s string) string {
+	return strings.TrimSpace(s)
+}
+
+// mergeDestination merges theirs into ours section by section and
+// returns the section files that changed
+func (m *merger) mergeDestination(ours *FullDestination, theirs *FullDestination) map[string]bool {
+	changed := make(map[string]bool)
+	m.ids = make(idMap)
+	for _, sec := range Sections {
+		if sec.merge(m, ours, theirs) {
+			changed[sec.File()] = true
+		}
+	}
+	return changed
+}
+
+func shortKey(key string) string {
+	if len(key) > 12 {
+		return key[:12]
+	}
+	return key
+}
+
+// mergeRollback records what a merge wrote so it can be undone. Stored
+// images are blobs other destinations may share, so they are left for gc.
+type mergeRollback struct {
+	sections []sectionBackup
+	dests    []string // IDs of added destinations
+}
+
+type sectionBackup struct {
+	name  string // of the destination, for errors
+	store *DestinationStore
+	file  string
+	data  []byte // nil if the file did not exist
+	rev   string // written by the merge
+}
+
+// undo deletes the added destinations and restores the merged sections.
+// A section edited since the merge wrote it is left alone and reported
+// as a conflict, as a stale save would be.
+func (rb *mergeRollback) undo(planStore *PlanStore) error {
+	var errs []error
+	for _, id := range rb.dests {
+		if err := planStore.DeleteDestination(id); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for i := len(rb.sections) - 1; i >= 0; i-- {
+		b := rb.sections[i]
+		if _, err := b.store.writeSection(b.file, b.data, b.rev); err != nil {
+			errs = append(errs, fmt.Errorf("%s/%s: %w", b.name, b.file, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// mergePlan merges fp into the existing plan planID: destinations are
+// matched by name, unmatched ones are added. Sections are saved with the
+// revision they were read at, so a concurrent edit fails the merge
+// instead of being overwritten. On failure everything written is undone.
+func (s *GlobalStore) mergePlan(planID string, fp FullPlan, opts ImportOptions, resolve func(url string) ([]byte, bool), importImage importImageFunc) ([]ImportChange, error) {
+	planStore, err := s.GetPlanStore(planID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := planStore.ListDestinations()
+	if err != nil {
+		return nil, err
+	}
+	m := newMerger(s, opts.OnConflict, resolve)
+
+	type pendingMerge struct {
+		name    string
+		store   *DestinationStore
+		dest    FullDestination
+		revs    map[string]string
+		changed map[string]bool
+	}
+	var merges []pendingMerge
+	var adds []FullDestination
+	used := make(map[string]bool)
+	for i := range fp.Destinations {
+		fd := &fp.Destinations[i]
+		name := trimKey(fd.Destination.Name)
+		m.dest = name
+
+		var match *Destination
+		for j := range existing {
+			if !used[existing[j].ID] && trimKey(existing[j].Name) == name {
+				match = &existing[j]
+				break
+			}
+		}
+		if match == nil {
+			adds = append(adds, *fd)
+			m.change("", "", ChangeAdded, fmt.Sprintf("new destination with %d spots, %d foods", len(*SpotSection.List(fd)), len(*FoodSection.List(fd))))
+			continue
+		}
+		used[match.ID] = true
+
+		destStore, err := planStore.GetDestinationStore(match.ID)
+		if err != nil {
+			return nil, err
+		}
+		current := FullDestination{Destination: *match}
+		revs := make(map[string]string)
+		for _, sec := range current.sections() {
+			rev, err := destStore.LoadSection(sec.file, sec.value)
+			if err != nil {
+				return nil, fmt.Errorf("%s/%s: %w", name, sec.file, err)
+			}
+			revs[sec.file] = rev
+		}
+		changed := m.mergeDestination(&current, fd)
+		if len(changed) > 0 {
+			merges = append(merges, pendingMerge{name: name, store: destStore, dest: current, revs: revs, changed: changed})
+		}
+	}
+	if opts.DryRun {
+		return m.changes, nil
+	}
+
+	var rb mergeRollback
+	apply := func() error {
+		for _, pm := range merges {
+			destID := pm.dest.Destination.ID
+			// Only incoming items still carry base64 or archive images
+			err := pm.dest.eachImage(func(field string, url *string, b64 *string) error {
+				if err := importImage(planID, destID, url, b64); err != nil {
+					return fmt.Errorf("%s/%s: %w", pm.name, field, err)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			// The changed sections are saved together
+			var writes []sectionWrite
+			var backups []sectionBackup
+			for _, sec := range pm.dest.sections() {
+				if !pm.changed[sec.file] {
+					continue
+				}
+				old, err := pm.store.readSection(sec.file)
+				if err != nil {
+					return err
+				}
+				w, err := newSectionWrite(sec.file, sec.value, pm.revs[sec.file])
+				if err != nil {
+					return err
+				}
+				writes = append(writes, w)
+				backups = append(backups, sectionBackup{name: pm.name, store: pm.store, file: sec.file, data: old})
+			}
+			revs, err := pm.store.writeSections(writes)
+			if err != nil {
+				for i, rev := range revs {
+					if rev != "" {
+						return fmt.Errorf("%s/%s: %w", pm.name, writes[i].file, err)
+					}
+				}
+				return fmt.Errorf("%s: %w", pm.name, err)
+			}
+			for i := range backups {
+				backups[i].rev = revs[i]
+			}
+			rb.sections = append(rb.sections, backups...)
+		}
+		for _, fd := range adds {
+			dest, err := s.importDestination(planID, fd, importImage, false)
+			if dest.ID != "" {
+				rb.dests = append(rb.dests, dest.ID)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", fd.Destination.Name, err)
+			}
+		}
+		return nil
+	}
+	if err := apply(); err != nil {
+		if rbErr := rb.undo(planStore); rbErr != nil {
+			return m.changes, fmt.Errorf("merge failed: %w; rollback failed: %w", err, rbErr)
+		}
+		return m.changes, fmt.Errorf("merge failed, rolled back: %w", err)
+	}
+	return m.changes, nil
+}
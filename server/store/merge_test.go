@@ -0,0 +1,124 @@
+package store
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// planID returns the ID of the plan of ps
+func planID(ps *PlanStore) string {
+	return strings.TrimPrefix(ps.Prefix, "plans/")
+}
+
+// exportOne exports the plan of ps
+func exportOne(t *testing.T, s *GlobalStore, ps *PlanStore) FullPlan {
+	t.Helper()
+	plans, err := s.ExportPlans([]string{planID(ps)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 1 {
+		t.Fatalf("exported %d plans, want 1", len(plans))
+	}
+	return plans[0]
+}
+
+func TestMergeSameNameAtDifferentPlace(t *testing.T) {
+	s := newTestStore(t)
+	ps, ds := newTestDestination(t, s)
+	if _, err := ds.SaveSection(SpotSection.File(), []Spot{{ID: newID(), Name: "Tower", Lat: 35.0, Lng: 135.0}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	fp := exportOne(t, s, ps)
+	*SpotSection.List(&fp.Destinations[0]) = []Spot{
+		{ID: newID(), Name: "Tower", Lat: 34.7, Lng: 135.5},
+		{ID: newID(), Name: "Tower", Lat: 35.0001, Lng: 135.0001, Story: "nearby, the same spot"},
+	}
+
+	report, err := s.Import([]FullPlan{fp}, ImportOptions{PlanID: planID(ps)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spots []Spot
+	if _, err := ds.LoadSection(SpotSection.File(), &spots); err != nil {
+		t.Fatal(err)
+	}
+	if len(spots) != 2 {
+		t.Fatalf("got %d spots, want the nearby one merged and the distant one added: %+v", len(spots), spots)
+	}
+	if spots[0].Story != "nearby, the same spot" || spots[1].Lat != 34.7 {
+		t.Errorf("spots: %+v", spots)
+	}
+	var added *ImportChange
+	for i, c := range report.Changes {
+		if c.Action == ChangeConflict {
+			t.Errorf("conflict reported: %+v", c)
+		}
+		if c.Section == "spots" && c.Action == ChangeAdded {
+			added = &report.Changes[i]
+		}
+	}
+	if added == nil || !strings.Contains(added.Detail, "different place") {
+		t.Errorf("added spot not reported with a reason: %+v", report.Changes)
+	}
+
+	// Merging the same file again finds both
+	report, err = s.Import([]FullPlan{fp}, ImportOptions{PlanID: planID(ps)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changes) != 0 {
+		t.Errorf("second merge changed: %+v", report.Changes)
+	}
+}
+
+func TestMergeRollback(t *testing.T) {
+	for _, edited := range []bool{false, true} {
+		s := newTestStore(t)
+		ps, ds := newTestDestination(t, s)
+		file := SpotSection.File()
+		if _, err := ds.SaveSection(file, []Spot{{ID: newID(), Name: "Tower"}}, ""); err != nil {
+			t.Fatal(err)
+		}
+		fp := exportOne(t, s, ps)
+		*SpotSection.List(&fp.Destinations[0]) = append(*SpotSection.List(&fp.Destinations[0]), Spot{ID: newID(), Name: "Temple"})
+		added := FullDestination{Destination: Destination{Name: "Osaka"}}
+		*GuideImageSection.List(&added) = []GuideImage{{ID: "g", Base64Data: base64.StdEncoding.EncodeToString(testPNG(t, 2, 2, 0))}}
+		fp.Destinations = append(fp.Destinations, added)
+
+		// The added destination fails after Kyoto is merged, and someone
+		// edits Kyoto in between if edited
+		failing := func(planID, destID string, url *string, b64 *string) error {
+			if *b64 == "" {
+				return nil
+			}
+			if edited {
+				if _, err := ds.SaveSection(file, []Spot{{ID: newID(), Name: "Shrine"}}, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return errors.New("disk full")
+		}
+		_, err := s.runImport([]FullPlan{fp}, ImportOptions{PlanID: planID(ps), OnConflict: MergeTheirs}, checkBase64Image, nil, failing)
+		if err == nil || !strings.Contains(err.Error(), "disk full") {
+			t.Fatalf("edited %v: got %v, want the failure", edited, err)
+		}
+		if errors.Is(err, ErrConflict) != edited {
+			t.Errorf("edited %v: got %v, conflict reported: %v", edited, err, !edited)
+		}
+
+		want := "Tower"
+		if edited {
+			want = "Shrine"
+		}
+		var spots []Spot
+		if _, err := ds.LoadSection(file, &spots); err != nil || len(spots) != 1 || spots[0].Name != want {
+			t.Errorf("edited %v: spots %+v, want only %s: %v", edited, spots, want, err)
+		}
+		if dests, err := ps.ListDestinations(); err != nil || len(dests) != 1 {
+			t.Errorf("edited %v: destinations %+v left: %v", edited, dests, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrReferenced is returned for removing items that other items refer
+// to, under DeleteRestrict
+var ErrReferenced = errors.New("item is referenced")
+
+// What removing an item that other items refer to does, e.g. a spot on
+// a route
+const (
+	DeleteCascade  = "cascade"  // the references are removed too
+	DeleteRestrict = "restrict" // the removal is refused with ErrReferenced
+)
+
+// DefaultDeletePolicy applies when no policy is given
+const DefaultDeletePolicy = DeleteCascade
+
+// CheckDeletePolicy accepts DeleteCascade, DeleteRestrict and "" for the
+// default
+func CheckDeletePolicy(policy string) error {
+	switch policy {
+	case "", DeleteCascade, DeleteRestrict:
+		return nil
+	}
+	return fmt.Errorf("unknown delete policy %q, expecting %s or %s", policy, DeleteCascade, DeleteRestrict)
+}
+
+// refField is a field of T holding IDs of items in another section.
+// References written as the item's name, as routes did before they
+// linked spots by ID, are turned into the ID on save.
+type refField[T any] struct {
+	field string // JSON name
+	to    Section
+	get   func(v *T) []string
+	set   func(v *T, ids []string)
+}
+
+// idMap maps the old IDs of items given new ones to the new IDs, by
+// section name
+type idMap map[string]map[string]string
+
+// set records the first new ID given for old
+func (ids idMap) set(section string, old string, id string) {
+	if old == "" {
+		return
+	}
+	if ids[section] == nil {
+		ids[section] = make(map[string]string)
+	}
+	if _, ok := ids[section][old]; !ok {
+		ids[section][old] = id
+	}
+}
+
+// loadSection reads one section of s into an otherwise empty destination
+func loadSection(s *DestinationStore, sec Section) (*FullDestination, error) {
+	fd := &FullDestination{}
+	_, err := s.LoadSection(sec.File(), sec.field(fd))
+	return fd, err
+}
+
+// checkReferrers returns ErrReferenced if items of any section of s
+// refer to the given items of the section saved in file
+func checkReferrers(s *DestinationStore, file string, ids map[string]bool) error {
+	for _, sec := range Sections {
+		referrers, err := sec.referrers(s, file, ids)
+		if err != nil {
+			return err
+		}
+		if len(referrers) > 0 {
+			return fmt.Errorf("%w: %s used by %s %s", ErrReferenced, strings.Join(sortedKeys(ids), ", "), sec.Name(), strings.Join(referrers, ", "))
+		}
+	}
+	return nil
+}
+
+// dropReferrers returns the writes removing the references to the given
+// items of the section saved in file from every section of s
+func dropReferrers(s *DestinationStore, file string, ids map[string]bool) ([]sectionWrite, error) {
+	var writes []sectionWrite
+	for _, sec := range Sections {
+		w, err := sec.dropRefs(s, file, ids)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sec.Name(), err)
+		}
+		if w != nil {
+			writes = append(writes, *w)
+		}
+	}
+	return writes, nil
+}
+
+// removedIDs returns the IDs in old that are not in items
+func (sec *ItemSection[T]) removedIDs(old []T, items []T) map[string]bool {
+	kept := sec.takenIDs(items, -1)
+	removed := make(map[string]bool)
+	sec.walk(old, func(item *T) {
+		if id := *sec.ID(item); id != "" && !kept[id] {
+			removed[id] = true
+		}
+	})
+	return removed
+}
+
+// resolveRefs turns references by name into IDs and fails with
+// ErrInvalidContent for references to nothing, unless old had them
+// already, so data that was broken before does not block every save
+func (sec *ItemSection[T]) resolveRefs(s *DestinationStore, old []T, items []T) error {
+	for _, f := range sec.refs {
+		target, err := loadSection(s, f.to)
+		if err != nil {
+			return err
+		}
+		targets := f.to.targets(target)
+		before := make(map[string]bool)
+		sec.walk(old, func(item *T) {
+			for _, ref := range f.get(item) {
+				before[ref] = true
+			}
+		})
+		var unknown []string
+		sec.walk(items, func(item *T) {
+			refs := f.get(item)
+			for i, ref := range refs {
+				if id, ok := targets[ref]; ok {
+					refs[i] = id
+				} else if !before[ref] {
+					unknown = append(unknown, fmt.Sprintf("%q", ref))
+				}
+			}
+		})
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return &FieldError{Field: f.field, Err: fmt.Errorf("%w: no %s with the ID or name %s", ErrInvalidContent, f.to.Name(), strings.Join(unknown, ", "))}
+		}
+	}
+	return nil
+}
+
+// linkRefs turns references in items by name into IDs, looking the
+// names up in in
+func (sec *ItemSection[T]) linkRefs(items []T, in *FullDestination) int {
+	n := 0
+	for _, f := range sec.refs {
+		targets := f.to.targets(in)
+		sec.walk(items, func(item *T) {
+			refs := f.get(item)
+			for i, ref := range refs {
+				if id, ok := targets[ref]; ok && id != ref {
+					refs[i] = id
+					n++
+				}
+			}
+		})
+	}
+	return n
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"strings"
+)
+
+// ErrConflict is returned when a conditional save finds that the file
+// changed since the revision the caller last read.
+var ErrConflict = errors.New("revision conflict")
+
+// revisionOf returns the ETag of a file's raw content. A missing or empty
+// file has the revision of empty content, so the first save can be
+// conditional too.
+func revisionOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// matchRevision reports whether an If-Match header value accepts rev.
+// An empty header means unconditional.
+func matchRevision(ifMatch string, rev string) bool {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == rev {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DestinationStore) readSection(filename string) ([]byte, error) {
+	data, err := s.Backend.ReadFile(joinKey(s.Prefix, filename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// LoadSection decodes the section file into v and returns its revision
+func (s *DestinationStore) LoadSection(filename string, v interface{}) (string, error) {
+	data, err := s.readSection(filename)
+	if err != nil {
+		return "", err
+	}
+	rev := revisionOf(data)
+	if len(data) == 0 {
+		return rev, nil // Return empty/default
+	}
+	return rev, json.Unmarshal(data, v)
+}
+
+// SaveSection writes v to the section file if its current revision matches
+// ifMatch, and returns the new revision. On a mismatch it returns
+// ErrConflict together with the current revision, leaving the file as is.
+func (s *DestinationStore) SaveSection(filename string, v interface{}, ifMatch string) (string, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return s.writeSection(filename, data, ifMatch)
+}
+
+// writeSection is SaveSection for raw content; nil data removes the file
+func (s *DestinationStore) writeSection(filename string, data []byte, ifMatch string) (string, error) {
+	revs, err := s.writeSections([]sectionWrite{{file: filename, data: data, ifMatch: ifMatch}})
+	if revs == nil {
+		return "", err
+	}
+	return revs[0], err
+}
+
+// sectionWrite is one file of a writeSections batch
+type sectionWrite struct {
+	file    string
+	data    []byte // nil removes the file
+	ifMatch string
+}
+
+// newSectionWrite marshals v for writing to the section file
+func newSectionWrite(filename string, v interface{}, ifMatch string) (sectionWrite, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	return sectionWrite{file: filename, data: data, ifMatch: ifMatch}, err
+}
+
+// writeSections writes several section files as one change, if the
+// current revision of each matches its ifMatch, and returns their new
+// revisions. On a mismatch nothing is written, and ErrConflict is
+// returned with the current revision of the file that changed in its
+// place, the others left empty.
+func (s *DestinationStore) writeSections(writes []sectionWrite) ([]string, error) {
+	unlock, err := s.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	revs := make([]string, len(writes))
+	for i, w := range writes {
+		if strings.TrimSpace(w.ifMatch) == "" {
+			continue
+		}
+		current, err := s.readSection(w.file)
+		if err != nil {
+			return nil, err
+		}
+		if rev := revisionOf(current); !matchRevision(w.ifMatch, rev) {
+			revs[i] = rev
+			return revs, ErrConflict
+		}
+	}
+	changes := make([]FileChange, len(writes))
+	for i, w := range writes {
+		changes[i] = FileChange{Key: joinKey(s.Prefix, w.file), Data: w.data, Remove: w.data == nil}
+		revs[i] = revisionOf(w.data)
+	}
+	if err := s.Backend.WriteFiles(changes); err != nil {
+		return nil, err
+	}
+	return revs, nil
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSaveSectionIfMatch(t *testing.T) {
+	s := newTestStore(t)
+	_, ds := newTestDestination(t, s)
+	file := SpotSection.File()
+
+	var spots []Spot
+	empty, err := ds.LoadSection(file, &spots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := ds.SaveSection(file, []Spot{{ID: "a", Name: "Tower"}}, empty)
+	if err != nil {
+		t.Fatalf("first save against the empty revision: %v", err)
+	}
+
+	// The revision read before that save is stale now
+	current, err := ds.SaveSection(file, []Spot{{ID: "b", Name: "Temple"}}, empty)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("stale save: %v, want ErrConflict", err)
+	}
+	if current != rev {
+		t.Errorf("stale save returned revision %s, want the current %s", current, rev)
+	}
+	if _, err := ds.LoadSection(file, &spots); err != nil || len(spots) != 1 || spots[0].ID != "a" {
+		t.Fatalf("stale save changed the file: %+v, %v", spots, err)
+	}
+
+	// A list of tags, a weak tag and no condition at all are accepted
+	for _, ifMatch := range []string{`"x", ` + rev, "W/" + rev, "*", ""} {
+		if rev, err = ds.SaveSection(file, []Spot{{ID: "a", Name: "Tower"}}, ifMatch); err != nil {
+			t.Errorf("If-Match %s: %v", ifMatch, err)
+		}
+	}
+}
+
+func TestItemIfMatch(t *testing.T) {
+	s := newTestStore(t)
+	_, ds := newTestDestination(t, s)
+	items := &SpotSection.ItemSection
+
+	spot, rev, err := items.Add(ds, Spot{Name: "Tower"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spot.ID == "" {
+		t.Fatalf("added spot has no ID")
+	}
+	_, newRev, err := items.Add(ds, Spot{Name: "Temple"}, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale := Spot{Name: "Tower, renamed"}
+	if _, current, err := items.Put(ds, spot.ID, stale, rev); !errors.Is(err, ErrConflict) || current != newRev {
+		t.Errorf("stale put: %v with revision %s, want ErrConflict with %s", err, current, newRev)
+	}
+	if _, current, err := items.Patch(ds, spot.ID, []byte(`{"name":"x"}`), rev); !errors.Is(err, ErrConflict) || current != newRev {
+		t.Errorf("stale patch: %v with revision %s, want ErrConflict with %s", err, current, newRev)
+	}
+	if current, err := items.Delete(ds, spot.ID, rev, ""); !errors.Is(err, ErrConflict) || current != newRev {
+		t.Errorf("stale delete: %v with revision %s, want ErrConflict with %s", err, current, newRev)
+	}
+
+	got, _, err := items.Get(ds, spot.ID)
+	if err != nil || got.Name != "Tower" {
+		t.Errorf("stale writes changed the spot: %+v, %v", got, err)
+	}
+	if _, _, err := items.Put(ds, spot.ID, stale, newRev); err != nil {
+		t.Errorf("put with the current revision: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ExportVersion is the schema version of exports written by this build.
+//
+// History:
+//
+//	1  a bare JSON array of FullPlan, written before exports were versioned
+//	2  the Export envelope
+const ExportVersion = 2
+
+// ErrExportTooNew is returned for exports written by a newer travel-map
+var ErrExportTooNew = errors.New("export is newer than this travel-map supports")
+
+// Export is the envelope of an export file and of the manifest of an
+// export archive
+type Export struct {
+	Version    int        `json:"version"`
+	ExportedAt string     `json:"exported_at,omitempty"`
+	Plans      []FullPlan `json:"plans"`
+}
+
+// NewExport wraps plans in an envelope of the current version
+func NewExport(plans []FullPlan) Export {
+	if plans == nil {
+		plans = []FullPlan{}
+	}
+	return Export{
+		Version:    ExportVersion,
+		ExportedAt: time.Now().Format(time.RFC3339),
+		Plans:      plans,
+	}
+}
+
+// exportMigration upgrades a payload from version from to from+1. It
+// works on the generic JSON value so it can handle shapes the current
+// structs no longer describe.
+type exportMigration struct {
+	from        int
+	description string
+	migrate     func(doc interface{}) (interface{}, error)
+}
+
+// exportMigrations must form a chain from version 1 to ExportVersion
+var exportMigrations = []exportMigration{
+	{
+		from:        1,
+		description: "wrap the bare plan array in a versioned envelope",
+		migrate: func(doc interface{}) (interface{}, error) {
+			plans, ok := doc.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expecting an array of plans")
+			}
+			return map[string]interface{}{
+				"version": 2,
+				"plans":   plans,
+			}, nil
+		},
+	},
+}
+
+func init() {
+	for i, m := range exportMigrations {
+		if m.from != i+1 {
+			panic(fmt.Sprintf("export migration %d starts at version %d, expecting %d", i, m.from, i+1))
+		}
+	}
+	if len(exportMigrations) != ExportVersion-1 {
+		panic(fmt.Sprintf("export migrations reach version %d, expecting %d", len(exportMigrations)+1, ExportVersion))
+	}
+}
+
+// exportVersionOf tells the schema version of a decoded payload
+func exportVersionOf(doc interface{}) (int, error) {
+	switch v := doc.(type) {
+	case []interface{}:
+		return 1, nil
+	case map[string]interface{}:
+		n, ok := v["version"].(float64)
+		if !ok || n != float64(int(n)) || n < 1 {
+			return 0, fmt.Errorf("invalid export: missing or bad \"version\"")
+		}
+		return int(n), nil
+	default:
+		return 0, fmt.Errorf("invalid export: expecting an object or an array")
+	}
+}
+
+// DecodeExport parses an export of any known version, upgrading older
+// payloads through the migration chain. It also returns the version the
+// payload was written with.
+func DecodeExport(data []byte) (Export, int, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return Export{}, 0, fmt.Errorf("invalid export: %w", err)
+	}
+	version, err := exportVersionOf(doc)
+	if err != nil {
+		return Export{}, 0, err
+	}
+	if version > ExportVersion {
+		return Export{}, version, fmt.Errorf("%w: the file has schema version %d, this build reads up to %d; upgrade travel-map to import it", ErrExportTooNew, version, ExportVersion)
+	}
+	for v := version; v < ExportVersion; v++ {
+		m := exportMigrations[v-1]
+		doc, err = m.migrate(doc)
+		if err != nil {
+			return Export{}, version, fmt.Errorf("invalid export: migrate from version %d (%s): %w", v, m.description, err)
+		}
+	}
+
+	// Round-trip the migrated value into the current structs
+	if version < ExportVersion {
+		if data, err = json.Marshal(doc); err != nil {
+			return Export{}, version, err
+		}
+	}
+	var exp Export
+	if err := json.Unmarshal(data, &exp); err != nil {
+		return Export{}, version, fmt.Errorf("invalid export: %w", err)
+	}
+	exp.Version = ExportVersion
+	return exp, version, nil
+}
@@ -0,0 +1,617 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidContent is returned for section content that fails validation
+var ErrInvalidContent = errors.New("invalid content")
+
+// FieldError tells which field of the content, or of the request, an
+// error is about
+type FieldError struct {
+	Field string // e.g. "spots[2]"
+	Err   error
+}
+
+func (e *FieldError) Error() string { return e.Field + ": " + e.Err.Error() }
+func (e *FieldError) Unwrap() error { return e.Err }
+
+// Section is one section file of a destination. Each is declared once in
+// Sections, which drives everything that handles sections generically:
+// storage, the HTTP routes, item endpoints, export, import and merging,
+// image handling and the API listing. Adding a section takes its item
+// type and a declaration here.
+type Section interface {
+	Name() string // field name in exports and reports, e.g. "guide_images"
+	Path() string // URL path under the API prefix, e.g. "/guide-images"
+	File() string // file in the destination directory
+	Doc() string  // one line for the API listing
+	// New returns a pointer to an empty value, e.g. *[]Spot
+	New() interface{}
+	// Validate checks a value of the type returned by New before it is
+	// saved; failures wrap ErrInvalidContent
+	Validate(v interface{}) error
+	// AssignIDs gives the items of a value of the type returned by New
+	// that have no ID, or one used before them, a new ID, and returns how
+	// many it gave
+	AssignIDs(v interface{}) int
+	// Replace saves v, a value of the type returned by New, as the whole
+	// section: it assigns IDs, validates, resolves references like a save
+	// of items does and applies onDelete to the items v drops. A stale
+	// ifMatch yields ErrConflict with the current revision.
+	Replace(s *DestinationStore, v interface{}, ifMatch string, onDelete string) (string, error)
+	// Items returns the item operations of a list section, nil otherwise
+	Items() Items
+
+	// field returns the content of the section in fd, a value of the type
+	// returned by New, adding an empty one if fd has none
+	field(fd *FullDestination) interface{}
+	eachImage(fd *FullDestination, fn imageFunc) error
+	// renewIDs gives every item a new ID, recording the old ones in ids
+	renewIDs(fd *FullDestination, ids idMap)
+	// remapRefs points references to items of other sections at the IDs
+	// they were given in ids
+	remapRefs(fd *FullDestination, ids idMap)
+	// link turns references by name into IDs, looking the names up in in,
+	// and returns how many it turned
+	link(fd *FullDestination, in *FullDestination) int
+	// checkRefs returns an error for every item of fd referring to items
+	// fd does not have, by ID or by name
+	checkRefs(fd *FullDestination) []error
+	// targets maps what references to the items of fd may be, their IDs
+	// and unambiguous names, to the IDs
+	targets(fd *FullDestination) map[string]string
+	// referrers returns the IDs of the items in s that refer to the given
+	// items of the section saved in file
+	referrers(s *DestinationStore, file string, ids map[string]bool) ([]string, error)
+	// dropRefs returns the write removing the references to the given
+	// items of the section saved in file from the items in s, or nil if
+	// there are none
+	dropRefs(s *DestinationStore, file string, ids map[string]bool) (*sectionWrite, error)
+	merge(m *merger, ours *FullDestination, theirs *FullDestination) bool
+}
+
+type imageFunc func(field string, url *string, b64 *string) error
+
+// imageField is a pair of fields of T holding an image: its URL and, in
+// exports, its base64 content
+type imageField[T any] struct {
+	url string // JSON names, e.g. "icon"
+	b64 string // e.g. "icon_base64"
+	get func(v *T) (url *string, b64 *string)
+}
+
+// ListSection is a section holding a list of items with IDs
+type ListSection[T any] struct {
+	ItemSection[T]
+	name   string
+	path   string
+	doc    string
+	images []imageField[T]
+	// title, if set, is the name references may use for an item instead
+	// of its ID
+	title func(v *T) string
+
+	// How items are matched when merging an import, see mergeRules
+	key    func(m *merger, item T) string
+	label  func(m *merger, item T) string
+	coords func(item T) (lat, lng float64)
+}
+
+func (sec *ListSection[T]) Name() string     { return sec.name }
+func (sec *ListSection[T]) Path() string     { return sec.path }
+func (sec *ListSection[T]) File() string     { return sec.ItemSection.File }
+func (sec *ListSection[T]) Doc() string      { return sec.doc }
+func (sec *ListSection[T]) New() interface{} { return &[]T{} }
+func (sec *ListSection[T]) Items() Items     { return &sec.ItemSection }
+
+func (sec *ListSection[T]) Validate(v interface{}) error {
+	items := *v.(*[]T)
+	for i := range items {
+		if err := sec.validateItem(&items[i]); err != nil {
+			return &FieldError{Field: fmt.Sprintf("%s[%d]", sec.name, i), Err: err}
+		}
+	}
+	seen := make(map[string]bool)
+	var dup string
+	sec.walk(items, func(item *T) {
+		id := *sec.ID(item)
+		if id != "" && seen[id] && dup == "" {
+			dup = id
+		}
+		seen[id] = true
+	})
+	if dup != "" {
+		return &FieldError{Field: sec.name, Err: fmt.Errorf("%w: ID %s is used twice", ErrInvalidContent, dup)}
+	}
+	return nil
+}
+
+// List returns the items of the section in fd. A missing or nil list is
+// made an empty one, so that sections never saved are exported and saved
+// as [] rather than null.
+func (sec *ListSection[T]) List(fd *FullDestination) *[]T {
+	p, ok := fd.Sections[sec.name].(*[]T)
+	if !ok {
+		p = &[]T{}
+		fd.setSection(sec.name, p)
+	}
+	if *p == nil {
+		*p = []T{}
+	}
+	return p
+}
+
+func (sec *ListSection[T]) field(fd *FullDestination) interface{} {
+	return sec.List(fd)
+}
+
+func (sec *ListSection[T]) eachImage(fd *FullDestination, fn imageFunc) error {
+	items := *sec.List(fd)
+	for i := range items {
+		for _, f := range sec.images {
+			url, b64 := f.get(&items[i])
+			if err := fn(fmt.Sprintf("%s[%d].%s", sec.name, i, f.url), url, b64); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (sec *ListSection[T]) AssignIDs(v interface{}) int {
+	return sec.assignIDs(*v.(*[]T), make(map[string]bool))
+}
+
+func (sec *ListSection[T]) renewIDs(fd *FullDestination, ids idMap) {
+	sec.walk(*sec.List(fd), func(item *T) {
+		id := sec.ID(item)
+		old := *id
+		*id = newID()
+		ids.set(sec.name, old, *id)
+	})
+}
+
+func (sec *ListSection[T]) remapRefs(fd *FullDestination, ids idMap) {
+	if len(sec.refs) == 0 {
+		return
+	}
+	sec.walk(*sec.List(fd), func(item *T) {
+		for _, f := range sec.refs {
+			refs := f.get(item)
+			for i, ref := range refs {
+				if id, ok := ids[f.to.Name()][ref]; ok {
+					refs[i] = id
+				}
+			}
+		}
+	})
+}
+
+func (sec *ListSection[T]) link(fd *FullDestination, in *FullDestination) int {
+	return sec.linkRefs(*sec.List(fd), in)
+}
+
+func (sec *ListSection[T]) checkRefs(fd *FullDestination) []error {
+	var errs []error
+	items := *sec.List(fd)
+	for _, f := range sec.refs {
+		targets := f.to.targets(fd)
+		for i := range items {
+			var unknown []string
+			sec.walk(items[i:i+1], func(item *T) {
+				for _, ref := range f.get(item) {
+					if _, ok := targets[ref]; !ok {
+						unknown = append(unknown, fmt.Sprintf("%q", ref))
+					}
+				}
+			})
+			if len(unknown) > 0 {
+				sort.Strings(unknown)
+				errs = append(errs, &FieldError{
+					Field: fmt.Sprintf("%s[%d].%s", sec.name, i, f.field),
+					Err:   fmt.Errorf("%w: no %s with the ID or name %s", ErrInvalidContent, f.to.Name(), strings.Join(unknown, ", ")),
+				})
+			}
+		}
+	}
+	return errs
+}
+
+func (sec *ListSection[T]) targets(fd *FullDestination) map[string]string {
+	targets := make(map[string]string)
+	items := *sec.List(fd)
+	sec.walk(items, func(item *T) {
+		if id := *sec.ID(item); id != "" {
+			targets[id] = id
+		}
+	})
+	if sec.title == nil {
+		return targets
+	}
+	names := make(map[string][]string)
+	sec.walk(items, func(item *T) {
+		if name, id := trimKey(sec.title(item)), *sec.ID(item); name != "" && id != "" {
+			names[name] = append(names[name], id)
+		}
+	})
+	for name, ids := range names {
+		if _, isID := targets[name]; !isID && len(ids) == 1 {
+			targets[name] = ids[0]
+		}
+	}
+	return targets
+}
+
+func (sec *ListSection[T]) referrers(s *DestinationStore, file string, ids map[string]bool) ([]string, error) {
+	fields := sec.refsTo(file)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	items, err := sec.Load(s)
+	if err != nil {
+		return nil, err
+	}
+	var referrers []string
+	sec.walk(items, func(item *T) {
+		for _, f := range fields {
+			for _, ref := range f.get(item) {
+				if ids[ref] {
+					referrers = append(referrers, *sec.ID(item))
+					return
+				}
+			}
+		}
+	})
+	return referrers, nil
+}
+
+func (sec *ListSection[T]) dropRefs(s *DestinationStore, file string, ids map[string]bool) (*sectionWrite, error) {
+	fields := sec.refsTo(file)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	var items []T
+	rev, err := s.LoadSection(sec.File(), &items)
+	if err != nil {
+		return nil, err
+	}
+	dropped := false
+	sec.walk(items, func(item *T) {
+		for _, f := range fields {
+			refs := f.get(item)
+			kept := make([]string, 0, len(refs))
+			for _, ref := range refs {
+				if !ids[ref] {
+					kept = append(kept, ref)
+				}
+			}
+			if len(kept) < len(refs) {
+				f.set(item, kept)
+				dropped = true
+			}
+		}
+	})
+	if !dropped {
+		return nil, nil
+	}
+	w, err := newSectionWrite(sec.File(), items, rev)
+	return &w, err
+}
+
+// refsTo returns the fields referring to the section saved in file
+func (sec *ListSection[T]) refsTo(file string) []refField[T] {
+	var fields []refField[T]
+	for _, f := range sec.refs {
+		if f.to.File() == file {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func (sec *ListSection[T]) Replace(s *DestinationStore, v interface{}, ifMatch string, onDelete string) (string, error) {
+	sec.AssignIDs(v)
+	if err := sec.Validate(v); err != nil {
+		return "", err
+	}
+	items := *v.(*[]T)
+	return sec.update(s, ifMatch, onDelete, func([]T) ([]T, error) { return items, nil })
+}
+
+// merge matches theirs against ours after pointing their references at
+// our IDs, and records which of our IDs each of their items got for the
+// sections merged later. References by name are looked up in ours, which
+// holds the referred sections merged already.
+func (sec *ListSection[T]) merge(m *merger, ours *FullDestination, theirs *FullDestination) bool {
+	sec.remapRefs(theirs, m.ids)
+	sec.link(theirs, ours)
+	rules := mergeRules[T]{
+		section: sec.name,
+		key:     func(item T) string { return sec.key(m, item) },
+		coords:  sec.coords,
+		id:      sec.ID,
+	}
+	if sec.label != nil {
+		rules.label = func(item T) string { return sec.label(m, item) }
+	}
+	for _, f := range sec.images {
+		rules.images = append(rules.images, [2]string{f.url, f.b64})
+	}
+	merged, changed := mergeItems(m, rules, *sec.List(ours), *sec.List(theirs))
+	if changed {
+		// Children of added and updated items keep their IDs, which may
+		// be taken here
+		sec.assignIDs(merged, make(map[string]bool))
+	}
+	*sec.List(ours) = merged
+	return changed
+}
+
+// ValueSection is a section holding a single value
+type ValueSection[T any] struct {
+	name     string
+	path     string
+	file     string
+	doc      string
+	validate func(v *T) error
+	images   []imageField[T]
+}
+
+func (sec *ValueSection[T]) Name() string     { return sec.name }
+func (sec *ValueSection[T]) Path() string     { return sec.path }
+func (sec *ValueSection[T]) File() string     { return sec.file }
+func (sec *ValueSection[T]) Doc() string      { return sec.doc }
+func (sec *ValueSection[T]) New() interface{} { return new(T) }
+func (sec *ValueSection[T]) Items() Items     { return nil }
+
+// Load returns the value, the zero value if it was never saved
+func (sec *ValueSection[T]) Load(s *DestinationStore) (T, error) {
+	var v T
+	_, err := s.LoadSection(sec.file, &v)
+	return v, err
+}
+
+// Save replaces the value unconditionally
+func (sec *ValueSection[T]) Save(s *DestinationStore, v T) error {
+	_, err := s.SaveSection(sec.file, v, "")
+	return err
+}
+
+func (sec *ValueSection[T]) Validate(v interface{}) error {
+	if sec.validate == nil {
+		return nil
+	}
+	if err := sec.validate(v.(*T)); err != nil {
+		return &FieldError{Field: sec.name, Err: err}
+	}
+	return nil
+}
+
+// Value returns the value of the section in fd, adding the zero value if
+// fd has none
+func (sec *ValueSection[T]) Value(fd *FullDestination) *T {
+	p, ok := fd.Sections[sec.name].(*T)
+	if !ok {
+		p = new(T)
+		fd.setSection(sec.name, p)
+	}
+	return p
+}
+
+func (sec *ValueSection[T]) field(fd *FullDestination) interface{} {
+	return sec.Value(fd)
+}
+
+func (sec *ValueSection[T]) eachImage(fd *FullDestination, fn imageFunc) error {
+	for _, f := range sec.images {
+		url, b64 := f.get(sec.Value(fd))
+		if err := fn(sec.name+"."+f.url, url, b64); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sec *ValueSection[T]) Replace(s *DestinationStore, v interface{}, ifMatch string, onDelete string) (string, error) {
+	if err := sec.Validate(v); err != nil {
+		return "", err
+	}
+	return s.SaveSection(sec.file, v, ifMatch)
+}
+
+func (sec *ValueSection[T]) AssignIDs(v interface{}) int                       { return 0 }
+func (sec *ValueSection[T]) renewIDs(fd *FullDestination, ids idMap)           {}
+func (sec *ValueSection[T]) remapRefs(fd *FullDestination, ids idMap)          {}
+func (sec *ValueSection[T]) link(fd *FullDestination, in *FullDestination) int { return 0 }
+func (sec *ValueSection[T]) checkRefs(fd *FullDestination) []error             { return nil }
+func (sec *ValueSection[T]) targets(fd *FullDestination) map[string]string     { return nil }
+func (sec *ValueSection[T]) referrers(s *DestinationStore, file string, ids map[string]bool) ([]string, error) {
+	return nil, nil
+}
+func (sec *ValueSection[T]) dropRefs(s *DestinationStore, file string, ids map[string]bool) (*sectionWrite, error) {
+	return nil, nil
+}
+
+// merge takes theirs if ours is empty, otherwise follows the policy
+func (sec *ValueSection[T]) merge(m *merger, ours *FullDestination, theirs *FullDestination) bool {
+	var images [][2]string
+	for _, f := range sec.images {
+		images = append(images, [2]string{f.url, f.b64})
+	}
+	var zero T
+	o, t := sec.Value(ours), sec.Value(theirs)
+	oursPrint := m.fingerprint(*o, images...)
+	if oursPrint == m.fingerprint(*t, images...) {
+		return false
+	}
+	switch {
+	case oursPrint == m.fingerprint(zero, images...):
+		m.change(sec.name, "", ChangeAdded, "")
+	case m.policy == MergeOurs:
+		m.change(sec.name, "", ChangeConflict, "differs, kept the existing version")
+		return false
+	default:
+		m.change(sec.name, "", ChangeUpdated, "")
+	}
+	*o = *t
+	return true
+}
+
+// The sections of a destination
+var (
+	SpotSection = &ListSection[Spot]{
+		ItemSection: ItemSection[Spot]{
+			File:     "spots.json",
+			ID:       func(v *Spot) *string { return &v.ID },
+			Validate: func(v *Spot) error { return firstErr(checkCoords(v.Lat, v.Lng), checkRating(v.Rating)) },
+		},
+		name:   "spots",
+		path:   "/spots",
+		doc:    "places to visit, shown on the map",
+		title:  func(v *Spot) string { return v.Name },
+		images: []imageField[Spot]{{"icon", "icon_base64", func(v *Spot) (*string, *string) { return &v.Icon, &v.IconBase64 }}},
+		key:    func(_ *merger, v Spot) string { return trimKey(v.Name) },
+		coords: func(v Spot) (float64, float64) { return v.Lat, v.Lng },
+	}
+	FoodSection = &ListSection[Food]{
+		ItemSection: ItemSection[Food]{
+			File:     "foods.json",
+			ID:       func(v *Food) *string { return &v.ID },
+			Validate: func(v *Food) error { return firstErr(checkCoords(v.Lat, v.Lng), checkRating(v.Rating)) },
+		},
+		name:   "foods",
+		path:   "/foods",
+		doc:    "dishes and restaurants",
+		key:    func(_ *merger, v Food) string { return trimKey(v.Name) },
+		coords: func(v Food) (float64, float64) { return v.Lat, v.Lng },
+	}
+	RouteSection = &ListSection[Route]{
+		ItemSection: ItemSection[Route]{
+			File:     "routes.json",
+			ID:       func(v *Route) *string { return &v.ID },
+			Children: func(v *Route) []Route { return v.Children },
+			refs: []refField[Route]{{
+				field: "spots",
+				to:    SpotSection,
+				get:   func(v *Route) []string { return v.Spots },
+				set:   func(v *Route, ids []string) { v.Spots = ids },
+			}},
+		},
+		name: "routes",
+		path: "/routes",
+		doc:  "routes through the spots, as a tree, linked to spots by ID; item endpoints address top-level routes",
+		key:  func(_ *merger, v Route) string { return trimKey(v.Name) },
+	}
+	QuestionSection = &ListSection[Question]{
+		ItemSection: ItemSection[Question]{
+			File: "questions.json",
+			ID:   func(v *Question) *string { return &v.ID },
+		},
+		name: "questions",
+		path: "/questions",
+		doc:  "open questions and their answers",
+		key:  func(_ *merger, v Question) string { return trimKey(v.Question) },
+	}
+	ReferenceSection = &ListSection[Reference]{
+		ItemSection: ItemSection[Reference]{
+			File: "references.json",
+			ID:   func(v *Reference) *string { return &v.ID },
+		},
+		name:   "references",
+		path:   "/references",
+		doc:    "links and pictures to look things up",
+		images: []imageField[Reference]{{"link", "link_base64", func(v *Reference) (*string, *string) { return &v.Link, &v.LinkBase64 }}},
+		key:    func(_ *merger, v Reference) string { return trimKey(v.Description) },
+	}
+	ConfigSection = &ValueSection[Config]{
+		name:   "config",
+		path:   "/config",
+		file:   "config.json",
+		doc:    "map settings and the destination's own position",
+		images: []imageField[Config]{{"map_image", "map_image_base64", func(v *Config) (*string, *string) { return &v.MapImage, &v.MapImageBase64 }}},
+		validate: func(v *Config) error {
+			if v.Destination != nil {
+				return checkCoords(v.Destination.Lat, v.Destination.Lng)
+			}
+			return nil
+		},
+	}
+	GuideImageSection = &ListSection[GuideImage]{
+		ItemSection: ItemSection[GuideImage]{
+			File:     "guide_images.json",
+			ID:       func(v *GuideImage) *string { return &v.ID },
+			Validate: func(v *GuideImage) error { return checkCoords(v.Lat, v.Lng) },
+		},
+		name:   "guide_images",
+		path:   "/guide-images",
+		doc:    "guide maps and photos",
+		images: []imageField[GuideImage]{{"url", "base64_data", func(v *GuideImage) (*string, *string) { return &v.URL, &v.Base64Data }}},
+		// The same picture is the same guide image
+		key:   func(m *merger, v GuideImage) string { return m.imageKey(v.URL, v.Base64Data) },
+		label: func(m *merger, v GuideImage) string { return "image " + shortKey(m.imageKey(v.URL, v.Base64Data)) },
+	}
+	ScheduleSection = &ListSection[Schedule]{
+		ItemSection: ItemSection[Schedule]{
+			File: "schedules.json",
+			ID:   func(v *Schedule) *string { return &v.ID },
+		},
+		name: "schedules",
+		path: "/schedules",
+		doc:  "notes on the days of the stay",
+		key:  func(_ *merger, v Schedule) string { return trimKey(v.Content) },
+	}
+	ItinerarySection = &ListSection[ItineraryItem]{
+		ItemSection: ItemSection[ItineraryItem]{
+			File: "itineraries.json",
+			ID:   func(v *ItineraryItem) *string { return &v.ID },
+		},
+		name: "itineraries",
+		path: "/itineraries",
+		doc:  "the timetable of activities",
+		key:  func(_ *merger, v ItineraryItem) string { return trimKey(v.Time) + " " + trimKey(v.Activity) },
+	}
+)
+
+// Sections lists every section of a destination, in export order
+var Sections = []Section{
+	SpotSection,
+	FoodSection,
+	RouteSection,
+	QuestionSection,
+	ReferenceSection,
+	ConfigSection,
+	GuideImageSection,
+	ScheduleSection,
+	ItinerarySection,
+}
+
+// checkCoords accepts 0,0 as "no position"
+func checkCoords(lat, lng float64) error {
+	if math.IsNaN(lat) || math.IsNaN(lng) || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return fmt.Errorf("%w: coordinates %v,%v out of range", ErrInvalidContent, lat, lng)
+	}
+	return nil
+}
+
+// checkRating accepts 0 as "not rated"
+func checkRating(r float64) error {
+	if math.IsNaN(r) || r < 0 || r > 5 {
+		return fmt.Errorf("%w: rating %v is not between 0 and 5", ErrInvalidContent, r)
+	}
+	return nil
+}
+
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
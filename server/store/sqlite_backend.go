@@ -0,0 +1,267 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sqliteDriverName is the database/sql driver the sqlite backend uses,
+// registered by sqlite_driver.go
+const sqliteDriverName = "sqlite"
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS files (
+	key      TEXT PRIMARY KEY,
+	is_dir   INTEGER NOT NULL DEFAULT 0,
+	data     BLOB,
+	mod_time INTEGER NOT NULL
+)`
+
+// SQLiteBackend is a single-file key-value store: every key is a row of
+// one SQLite table, so a whole data set can be copied and backed up as a
+// unit. WriteFiles batches are SQLite transactions.
+//
+// The store's locks are in-process mutexes here, so only one process
+// may use the database at a time. OpenSQLiteBackend enforces that by
+// holding an exclusive lock file next to the database until Close.
+type SQLiteBackend struct {
+	Path  string
+	db    *sql.DB
+	owner *os.File // the held lock file
+	locks keyLocks
+}
+
+func OpenSQLiteBackend(dbPath string) (*SQLiteBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return nil, err
+	}
+	owner, err := os.OpenFile(dbPath+sqliteLockSuffix, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := tryLockFile(owner); err != nil {
+		owner.Close()
+		if errors.Is(err, errLocked) {
+			return nil, fmt.Errorf("%s is in use by another travel-map process", dbPath)
+		}
+		return nil, err
+	}
+	db, err := sql.Open(sqliteDriverName, dbPath)
+	if err != nil {
+		releaseLockFile(owner)
+		return nil, err
+	}
+	// A single connection keeps pragmas in effect and serializes writers
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA busy_timeout=5000",
+		sqliteSchema,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			releaseLockFile(owner)
+			return nil, fmt.Errorf("init sqlite %s: %w", dbPath, err)
+		}
+	}
+	return &SQLiteBackend{Path: dbPath, db: db, owner: owner}, nil
+}
+
+// sqliteLockSuffix names the lock file kept next to the database
+const sqliteLockSuffix = ".lock"
+
+// releaseLockFile unlocks and closes a lock file taken with tryLockFile
+func releaseLockFile(f *os.File) {
+	unlockFile(f)
+	f.Close()
+}
+
+// checkKey rejects keys that are not clean slash paths inside the store
+func checkKey(op string, key string) error {
+	if key == "" || fs.ValidPath(key) {
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: key, Err: fs.ErrInvalid}
+}
+
+// likePrefix returns a LIKE pattern matching every key below key
+func likePrefix(key string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(key) + "/%"
+}
+
+func (b *SQLiteBackend) Open(name string) (fs.File, error) {
+	return kvOpen(b, name)
+}
+
+func (b *SQLiteBackend) stat(key string) (kvEntry, bool, error) {
+	var isDir bool
+	var size, modTime int64
+	err := b.db.QueryRow("SELECT is_dir, COALESCE(length(data), 0), mod_time FROM files WHERE key = ?", key).Scan(&isDir, &size, &modTime)
+	if errors.Is(err, sql.ErrNoRows) {
+		return kvEntry{}, false, nil
+	}
+	if err != nil {
+		return kvEntry{}, false, err
+	}
+	return kvEntry{key: key, dir: isDir, size: size, modTime: time.Unix(0, modTime)}, true, nil
+}
+
+func (b *SQLiteBackend) read(key string) ([]byte, error) {
+	var data []byte
+	err := b.db.QueryRow("SELECT data FROM files WHERE key = ? AND is_dir = 0", key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return data, nil
+}
+
+func (b *SQLiteBackend) scan(prefix string) ([]kvEntry, error) {
+	query := "SELECT key, is_dir, COALESCE(length(data), 0), mod_time FROM files"
+	var args []interface{}
+	if prefix != "" {
+		query += ` WHERE key LIKE ? ESCAPE '\'`
+		args = append(args, likePrefix(strings.TrimSuffix(prefix, "/")))
+	}
+	rows, err := b.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []kvEntry
+	for rows.Next() {
+		var e kvEntry
+		var modTime int64
+		if err := rows.Scan(&e.key, &e.dir, &e.size, &modTime); err != nil {
+			return nil, err
+		}
+		e.modTime = time.Unix(0, modTime)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (b *SQLiteBackend) ReadFile(key string) ([]byte, error) {
+	if err := checkKey("read", key); err != nil {
+		return nil, err
+	}
+	data, err := b.read(key)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: key, Err: err}
+	}
+	return data, nil
+}
+
+// mkdirAll inserts directory rows for key and all its parents
+func mkdirAll(tx *sql.Tx, key string, now int64) error {
+	for key != "" && key != "." {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO files (key, is_dir, mod_time) VALUES (?, 1, ?)", key, now); err != nil {
+			return err
+		}
+		key = path.Dir(key)
+	}
+	return nil
+}
+
+func (b *SQLiteBackend) WriteFile(key string, data []byte) error {
+	return b.WriteFiles([]FileChange{{Key: key, Data: data}})
+}
+
+func (b *SQLiteBackend) MkdirAll(key string) error {
+	if err := checkKey("mkdir", key); err != nil {
+		return err
+	}
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := mkdirAll(tx, key, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (b *SQLiteBackend) RemoveAll(key string) error {
+	return b.WriteFiles([]FileChange{{Key: key, Remove: true}})
+}
+
+// WriteFiles applies the changes in one SQLite transaction
+func (b *SQLiteBackend) WriteFiles(changes []FileChange) error {
+	for _, c := range changes {
+		op := "write"
+		if c.Remove {
+			op = "remove"
+		}
+		if err := checkKey(op, c.Key); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UnixNano()
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, c := range changes {
+		if c.Remove {
+			err = removeAll(tx, c.Key)
+		} else {
+			err = writeKey(tx, c.Key, c.Data, now)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// writeKey stores data under key, creating its parent directories
+func writeKey(tx *sql.Tx, key string, data []byte, now int64) error {
+	if data == nil {
+		data = []byte{}
+	}
+	if err := mkdirAll(tx, path.Dir(key), now); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO files (key, is_dir, data, mod_time) VALUES (?, 0, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET is_dir = 0, data = excluded.data, mod_time = excluded.mod_time`, key, data, now)
+	return err
+}
+
+// removeAll deletes the rows of key and everything below it
+func removeAll(tx *sql.Tx, key string) error {
+	if key == "" || key == "." {
+		_, err := tx.Exec("DELETE FROM files")
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM files WHERE key = ? OR key LIKE ? ESCAPE '\'`, key, likePrefix(key))
+	return err
+}
+
+// Lock serializes writers within this process, the only one using the
+// database while it is open
+func (b *SQLiteBackend) Lock(key string) (func(), error) {
+	if err := checkKey("lock", key); err != nil {
+		return nil, err
+	}
+	return b.locks.lock(key), nil
+}
+
+func (b *SQLiteBackend) Close() error {
+	err := b.db.Close()
+	releaseLockFile(b.owner)
+	return err
+}
@@ -0,0 +1,4 @@
+package store
+
+// Registers the pure-Go SQLite driver under the name "sqlite"
+import _ "modernc.org/sqlite"
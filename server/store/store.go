@@ -1,12 +1,14 @@
 package store
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
-	"os"
-	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -105,6 +107,10 @@ type GuideImage struct {
 	ID         string `json:"id"`
 	URL        string `json:"url"`
 	Base64Data string `json:"base64_data,omitempty"`
+	// Where and when the photo was taken, from its EXIF data
+	Lat     float64 `json:"lat,omitempty"`
+	Lng     float64 `json:"lng,omitempty"`
+	TakenAt string  `json:"taken_at,omitempty"`
 	// potentially caption, etc.
 }
 
@@ -121,17 +127,112 @@ type ItineraryItem struct {
 	Reference   string `json:"reference"`
 }
 
+// FullDestination is a destination with the content of its sections, as
+// exported. Sections holds the content by section name, each a value of
+// the type the section's New returns, e.g. *[]Spot; ListSection.List and
+// ValueSection.Value get it typed. In JSON the sections are fields next
+// to "destination", in the order of Sections.
 type FullDestination struct {
-	Destination Destination     `json:"destination"`
-	Spots       []Spot          `json:"spots"`
-	Foods       []Food          `json:"foods"`
-	Routes      []Route         `json:"routes"`
-	Questions   []Question      `json:"questions"`
-	References  []Reference     `json:"references"`
-	Config      Config          `json:"config"`
-	GuideImages []GuideImage    `json:"guide_images"`
-	Schedules   []Schedule      `json:"schedules"`
-	Itineraries []ItineraryItem `json:"itineraries"`
+	Destination Destination
+	Sections    map[string]interface{}
+}
+
+// setSection stores the content of the named section
+func (fd *FullDestination) setSection(name string, v interface{}) {
+	if fd.Sections == nil {
+		fd.Sections = make(map[string]interface{}, len(Sections))
+	}
+	fd.Sections[name] = v
+}
+
+func (fd FullDestination) MarshalJSON() ([]byte, error) {
+	dest, err := json.Marshal(fd.Destination)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"destination":`)
+	buf.Write(dest)
+	for _, sec := range Sections {
+		v, ok := fd.Sections[sec.Name()]
+		if !ok {
+			v = sec.New()
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sec.Name(), err)
+		}
+		buf.WriteString(`,"` + sec.Name() + `":`)
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON reads the fields of the known sections; others are ignored
+func (fd *FullDestination) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*fd = FullDestination{}
+	if raw, ok := fields["destination"]; ok {
+		if err := json.Unmarshal(raw, &fd.Destination); err != nil {
+			return fmt.Errorf("destination: %w", err)
+		}
+	}
+	for _, sec := range Sections {
+		if raw, ok := fields[sec.Name()]; ok {
+			if err := json.Unmarshal(raw, sec.field(fd)); err != nil {
+				return fmt.Errorf("%s: %w", sec.Name(), err)
+			}
+		}
+		// A null list reads as an empty one
+		sec.field(fd)
+	}
+	return nil
+}
+
+// EmbeddedImages counts the images carried as base64
+func (fd *FullDestination) EmbeddedImages() int {
+	n := 0
+	fd.eachImage(func(_ string, _ *string, b64 *string) error {
+		if *b64 != "" {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// eachImage calls fn with the URL and base64 field of every image the
+// destination refers to: spot icons, reference links, guide images and
+// the map image. field names the image for error reports, e.g.
+// "spots[2].icon".
+func (fd *FullDestination) eachImage(fn func(field string, url *string, b64 *string) error) error {
+	for _, sec := range Sections {
+		if err := sec.eachImage(fd, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fullSection pairs a section file with the field of a FullDestination
+// holding its content
+type fullSection struct {
+	file  string
+	value interface{}
+}
+
+// sections lists the section files of the destination with pointers to
+// the matching fields
+func (fd *FullDestination) sections() []fullSection {
+	secs := make([]fullSection, len(Sections))
+	for i, sec := range Sections {
+		secs[i] = fullSection{sec.File(), sec.field(fd)}
+	}
+	return secs
 }
 
 type FullPlan struct {
@@ -141,12 +242,17 @@ type FullPlan struct {
 
 // GlobalStore manages plans
 type GlobalStore struct {
-	Dir       string
+	Backend   Backend
 	APIPrefix string
 }
 
+// NewGlobalStore returns a store backed by plain files under dir
 func NewGlobalStore(dir string) *GlobalStore {
-	return &GlobalStore{Dir: dir, APIPrefix: "/api"} // Default
+	return NewGlobalStoreWithBackend(NewFileBackend(dir))
+}
+
+func NewGlobalStoreWithBackend(backend Backend) *GlobalStore {
+	return &GlobalStore{Backend: backend, APIPrefix: "/api"} // Default
 }
 
 func (s *GlobalStore) SetAPIPrefix(prefix string) {
@@ -154,28 +260,27 @@ func (s *GlobalStore) SetAPIPrefix(prefix string) {
 }
 
 func (s *GlobalStore) EnsureDir() error {
-	if _, err := os.Stat(s.Dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(s.Dir, 0755); err != nil {
-			return err
-		}
-	}
-	// Also ensure plans directory
-	plansDir := filepath.Join(s.Dir, "plans")
-	if _, err := os.Stat(plansDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(plansDir, 0755); err != nil {
-			return err
-		}
+	// Also ensures the data directory itself
+	return s.Backend.MkdirAll("plans")
+}
+
+// Recover repairs leftovers of interrupted writes if the backend can have
+// any; see FileBackend.Recover.
+func (s *GlobalStore) Recover() ([]RecoveryAction, error) {
+	if r, ok := s.Backend.(interface {
+		Recover() ([]RecoveryAction, error)
+	}); ok {
+		return r.Recover()
 	}
-	return nil
+	return nil, nil
 }
 
 func (s *GlobalStore) ListPlans() ([]Plan, error) {
 	if err := s.EnsureDir(); err != nil {
 		return nil, err
 	}
-	path := filepath.Join(s.Dir, "plans.json")
-	data, err := os.ReadFile(path)
-	if os.IsNotExist(err) {
+	data, err := s.Backend.ReadFile("plans.json")
+	if errors.Is(err, fs.ErrNotExist) {
 		return []Plan{}, nil
 	}
 	if err != nil {
@@ -191,34 +296,55 @@ func (s *GlobalStore) ListPlans() ([]Plan, error) {
 	return plans, nil
 }
 
+// Lock takes the data-directory lock that guards plans.json
+func (s *GlobalStore) Lock() (func(), error) {
+	return s.Backend.Lock("")
+}
+
 func (s *GlobalStore) SavePlans(plans []Plan) error {
+	unlock, err := s.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.savePlans(plans)
+}
+
+func (s *GlobalStore) savePlans(plans []Plan) error {
 	if err := s.EnsureDir(); err != nil {
 		return err
 	}
-	path := filepath.Join(s.Dir, "plans.json")
 	data, err := json.MarshalIndent(plans, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0644)
+	return s.Backend.WriteFile("plans.json", data)
 }
 
 func (s *GlobalStore) CreatePlan(name string) (Plan, error) {
+	unlock, err := s.Lock()
+	if err != nil {
+		return Plan{}, err
+	}
+	defer unlock()
 	plans, err := s.ListPlans()
 	if err != nil {
 		return Plan{}, err
 	}
 	newPlan := Plan{
-		ID:        fmt.Sprintf("%d", time.Now().UnixMilli()),
+		ID:        newID(),
 		Name:      name,
 		CreatedAt: time.Now().Format(time.RFC3339),
 	}
 	plans = append(plans, newPlan)
-	if err := s.SavePlans(plans); err != nil {
+	if err := s.savePlans(plans); err != nil {
 		return Plan{}, err
 	}
 	// Ensure plan directory exists
-	planStore := s.GetPlanStore(newPlan.ID)
+	planStore, err := s.GetPlanStore(newPlan.ID)
+	if err != nil {
+		return Plan{}, err
+	}
 	if err := planStore.EnsureDir(); err != nil {
 		return Plan{}, err
 	}
@@ -226,6 +352,11 @@ func (s *GlobalStore) CreatePlan(name string) (Plan, error) {
 }
 
 func (s *GlobalStore) UpdatePlan(id string, update Plan) error {
+	unlock, err := s.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	plans, err := s.ListPlans()
 	if err != nil {
 		return err
@@ -235,13 +366,22 @@ func (s *GlobalStore) UpdatePlan(id string, update Plan) error {
 			if update.Name != "" {
 				plans[i].Name = update.Name
 			}
-			return s.SavePlans(plans)
+			return s.savePlans(plans)
 		}
 	}
-	return fmt.Errorf("plan not found")
+	return fmt.Errorf("%w: %s", ErrPlanNotFound, id)
 }
 
 func (s *GlobalStore) DeletePlan(id string) error {
+	planStore, err := s.GetPlanStore(id)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	plans, err := s.ListPlans()
 	if err != nil {
 		return err
@@ -252,35 +392,160 @@ func (s *GlobalStore) DeletePlan(id string) error {
 			newPlans = append(newPlans, p)
 		}
 	}
-	if err := s.SavePlans(newPlans); err != nil {
+	if len(newPlans) == len(plans) {
+		return fmt.Errorf("%w: %s", ErrPlanNotFound, id)
+	}
+	if err := s.savePlans(newPlans); err != nil {
+		return err
+	}
+	// Wait for in-flight writers of this plan before removing it
+	unlockPlan, err := planStore.Lock()
+	if errors.Is(err, ErrPlanNotFound) {
+		// No directory to remove
+		return nil
+	}
+	if err != nil {
 		return err
 	}
+	defer unlockPlan()
 	// Remove directory
-	return os.RemoveAll(filepath.Join(s.Dir, "plans", id))
+	return s.Backend.RemoveAll(planStore.Prefix)
 }
 
-func (s *GlobalStore) GetPlanStore(planID string) *PlanStore {
-	return &PlanStore{Dir: filepath.Join(s.Dir, "plans", planID)}
+// findPlan returns the plan with the given ID
+func (s *GlobalStore) findPlan(id string) (Plan, error) {
+	plans, err := s.ListPlans()
+	if err != nil {
+		return Plan{}, err
+	}
+	for _, p := range plans {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return Plan{}, fmt.Errorf("%w: %s", ErrPlanNotFound, id)
 }
 
-func (s *GlobalStore) readBase64FromURL(url string) string {
+var (
+	// ErrInvalidID is returned for plan and destination IDs that are not
+	// safe to use as a directory name
+	ErrInvalidID = errors.New("invalid id")
+	// ErrPlanNotFound is returned for a plan ID that is not listed
+	ErrPlanNotFound = errors.New("plan not found")
+	// ErrDestinationNotFound is returned for a destination ID the plan
+	// does not list
+	ErrDestinationNotFound = errors.New("destination not found")
+)
+
+// maxIDLength bounds plan and destination IDs
+const maxIDLength = 64
+
+// ValidateID checks that id is a plan or destination ID: 1 to 64 ASCII
+// letters, digits, '-' or '_'. IDs name directories, so anything else,
+// like "..", could reach outside the plan.
+func ValidateID(id string) error {
+	if id == "" || len(id) > maxIDLength {
+		return fmt.Errorf("%w %q: must be 1 to %d characters", ErrInvalidID, id, maxIDLength)
+	}
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return fmt.Errorf("%w %q: only letters, digits, '-' and '_' are allowed", ErrInvalidID, id)
+		}
+	}
+	return nil
+}
+
+// GetPlanStore returns the store of the plan planID, which must be a
+// valid ID. The plan need not exist.
+func (s *GlobalStore) GetPlanStore(planID string) (*PlanStore, error) {
+	if err := ValidateID(planID); err != nil {
+		return nil, err
+	}
+	return &PlanStore{Backend: s.Backend, Prefix: joinKey("plans", planID)}, nil
+}
+
+// OpenPlan returns the store of the plan planID, which must be listed,
+// ErrPlanNotFound otherwise
+func (s *GlobalStore) OpenPlan(planID string) (*PlanStore, error) {
+	planStore, err := s.GetPlanStore(planID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.findPlan(planID); err != nil {
+		return nil, err
+	}
+	return planStore, nil
+}
+
+// dataPrefix is the URL prefix under which the backend keys are served
+func (s *GlobalStore) dataPrefix() string {
 	dataPrefix := s.APIPrefix
 	if !strings.HasSuffix(dataPrefix, "/") {
 		dataPrefix += "/"
 	}
-	dataPrefix += "data/"
+	return dataPrefix + "data/"
+}
+
+// dataSegment separates the API prefix of a data URL from the key
+const dataSegment = "/data/"
+
+// keyFromURL maps a data URL back to its backend key; ok is false for
+// URLs that do not point into the store. URLs keep the API prefix they
+// were saved with, which may not be the current one, so any prefix is
+// accepted as long as a stored-image key follows the data segment.
+func (s *GlobalStore) keyFromURL(url string) (key string, ok bool) {
+	if !isLocalURL(url) {
+		return "", false
+	}
+	rest := url
+	for {
+		i := strings.Index(rest, dataSegment)
+		if i < 0 {
+			return "", false
+		}
+		rest = rest[i+len(dataSegment):]
+		if isImageKey(rest) {
+			return rest, true
+		}
+	}
+}
+
+// isLocalURL reports whether url is a path on this server, as the URLs
+// of stored images are, rather than a link elsewhere
+func isLocalURL(url string) bool {
+	return strings.HasPrefix(url, "/") && !strings.HasPrefix(url, "//")
+}
+
+// looksLikeDataURL reports whether url has the shape of a data URL,
+// whether or not keyFromURL can resolve it
+func looksLikeDataURL(url string) bool {
+	return isLocalURL(url) && strings.Contains(url, dataSegment)
+}
 
-	var relPath string
-	if strings.HasPrefix(url, dataPrefix) {
-		relPath = strings.TrimPrefix(url, dataPrefix)
-	} else if strings.HasPrefix(url, "/data/") {
-		relPath = strings.TrimPrefix(url, "/data/")
-	} else {
+// isImageKey reports whether key is where an image is stored: a blob, a
+// resized variant, or an image of a destination from before blobs
+func isImageKey(key string) bool {
+	if !fs.ValidPath(key) {
+		return false
+	}
+	if isBlobKey(key) {
+		return validBlobKey(key)
+	}
+	if strings.HasPrefix(key, ThumbDir+"/") {
+		return isImageKey(thumbOriginal(key))
+	}
+	// plans/<id>/destinations/<id>/images/<name>
+	parts := strings.Split(key, "/")
+	return len(parts) == 6 && parts[0] == "plans" && parts[2] == "destinations" && parts[4] == "images" &&
+		ValidateID(parts[1]) == nil && ValidateID(parts[3]) == nil
+}
+func (s *GlobalStore) readBase64FromURL(url string) string {
+	relPath, ok := s.keyFromURL(url)
+	if !ok {
 		return ""
 	}
 
-	fullPath := filepath.Join(s.Dir, relPath)
-	data, err := os.ReadFile(fullPath)
+	data, err := s.Backend.ReadFile(relPath)
 	if err != nil {
 		return ""
 	}
@@ -288,7 +553,26 @@ func (s *GlobalStore) readBase64FromURL(url string) string {
 }
 
 // ExportPlans exports specific plans and their data. If planIds is empty, exports all plans.
+// Images are embedded as base64.
 func (s *GlobalStore) ExportPlans(planIds []string) ([]FullPlan, error) {
+	return s.exportPlans(planIds, s.embedBase64Image)
+}
+
+// embedBase64Image replaces the URL of a stored image with its content
+func (s *GlobalStore) embedBase64Image(url *string, b64 *string) error {
+	if *url == "" {
+		return nil
+	}
+	if data := s.readBase64FromURL(*url); data != "" {
+		*b64 = data
+		*url = ""
+	}
+	return nil
+}
+
+// exportPlans collects the plans with all IDs zeroed out and hands every
+// image reference to exportImage, which decides how the image travels.
+func (s *GlobalStore) exportPlans(planIds []string, exportImage func(url *string, b64 *string) error) ([]FullPlan, error) {
 	plans, err := s.ListPlans()
 	if err != nil {
 		return nil, err
@@ -306,7 +590,10 @@ func (s *GlobalStore) ExportPlans(planIds []string) ([]FullPlan, error) {
 			continue
 		}
 
-		planStore := s.GetPlanStore(p.ID)
+		planStore, err := s.GetPlanStore(p.ID)
+		if err != nil {
+			return nil, err
+		}
 
 		// Clone plan to avoid modifying original
 		exportedPlan := p
@@ -320,86 +607,24 @@ func (s *GlobalStore) ExportPlans(planIds []string) ([]FullPlan, error) {
 		}
 
 		for _, d := range dests {
-			destStore := planStore.GetDestinationStore(d.ID)
-
-			// Load all data
-			spots, _ := destStore.LoadSpots()
-			foods, _ := destStore.LoadFoods()
-			routes, _ := destStore.LoadRoutes()
-			questions, _ := destStore.LoadQuestions()
-			references, _ := destStore.LoadReferences()
-			config, _ := destStore.LoadConfig()
-			images, _ := destStore.LoadGuideImages()
-			schedules, _ := destStore.LoadSchedules()
-			itineraries, _ := destStore.LoadItineraries()
-
-			// Zero out IDs for all sub-items and embed base64
-			d.ID = ""
-			for i := range spots {
-				if spots[i].Icon != "" {
-					b64 := s.readBase64FromURL(spots[i].Icon)
-					if b64 != "" {
-						spots[i].IconBase64 = b64
-						spots[i].Icon = ""
-					}
-				}
-				spots[i].ID = ""
-			}
-			for i := range foods {
-				foods[i].ID = ""
-			}
-			for i := range routes {
-				routes[i].ID = ""
-			}
-			for i := range questions {
-				questions[i].ID = ""
-			}
-			for i := range references {
-				if references[i].Link != "" {
-					b64 := s.readBase64FromURL(references[i].Link)
-					if b64 != "" {
-						references[i].LinkBase64 = b64
-						references[i].Link = ""
-					}
-				}
-				references[i].ID = ""
-			}
-			for i := range images {
-				b64 := s.readBase64FromURL(images[i].URL)
-				if b64 != "" {
-					images[i].Base64Data = b64
-					images[i].URL = ""
-				}
-				images[i].ID = ""
-			}
-
-			if config.MapImage != "" {
-				b64 := s.readBase64FromURL(config.MapImage)
-				if b64 != "" {
-					config.MapImageBase64 = b64
-					config.MapImage = ""
-				}
+			destStore, err := planStore.GetDestinationStore(d.ID)
+			if err != nil {
+				return nil, err
 			}
 
-			for i := range schedules {
-				schedules[i].ID = ""
-			}
-			for i := range itineraries {
-				itineraries[i].ID = ""
+			// Load all data, a section that does not load is left empty
+			d.ID = ""
+			fd := FullDestination{Destination: d}
+			for _, sec := range Sections {
+				destStore.LoadSection(sec.File(), sec.field(&fd))
 			}
-
-			fullPlan.Destinations = append(fullPlan.Destinations, FullDestination{
-				Destination: d,
-				Spots:       spots,
-				Foods:       foods,
-				Routes:      routes,
-				Questions:   questions,
-				References:  references,
-				Config:      config,
-				GuideImages: images,
-				Schedules:   schedules,
-				Itineraries: itineraries,
+			err = fd.eachImage(func(_ string, url *string, b64 *string) error {
+				return exportImage(url, b64)
 			})
+			if err != nil {
+				return nil, err
+			}
+			fullPlan.Destinations = append(fullPlan.Destinations, fd)
 		}
 		fullPlans = append(fullPlans, fullPlan)
 	}
@@ -411,7 +636,7 @@ func (s *GlobalStore) ExportAll() ([]FullPlan, error) {
 	return s.ExportPlans(nil)
 }
 
-func (s *GlobalStore) saveBase64Image(planID, destID, base64Data string) (string, error) {
+func (s *GlobalStore) saveBase64Image(base64Data string) (string, error) {
 	if base64Data == "" {
 		return "", nil
 	}
@@ -419,148 +644,50 @@ func (s *GlobalStore) saveBase64Image(planID, destID, base64Data string) (string
 	if err != nil {
 		return "", err
 	}
+	return s.saveImage(data)
+}
 
-	destStore := s.GetPlanStore(planID).GetDestinationStore(destID)
-	if err := destStore.EnsureDir(); err != nil {
-		return "", err
-	}
-	imagesDir := filepath.Join(destStore.Dir, "images")
-	if err := os.MkdirAll(imagesDir, 0755); err != nil {
-		return "", err
-	}
-
-	contentType := http.DetectContentType(data)
-	ext := ".png" // Default
-	switch contentType {
+// detectImageExt returns the file extension for image content, or false
+// if data is not an image type the app can show
+func detectImageExt(data []byte) (string, bool) {
+	switch http.DetectContentType(data) {
 	case "image/jpeg":
-		ext = ".jpg"
+		return ".jpg", true
 	case "image/png":
-		ext = ".png"
+		return ".png", true
 	case "image/gif":
-		ext = ".gif"
-	case "image/svg+xml":
-		ext = ".svg"
+		return ".gif", true
+	case "image/webp":
+		return ".webp", true
 	}
-
-	filename := fmt.Sprintf("%d-import%s", time.Now().UnixNano(), ext)
-	path := filepath.Join(imagesDir, filename)
-	if err := os.WriteFile(path, data, 0644); err != nil {
-		return "", err
+	// Content sniffing does not know SVG, which is XML or plain text
+	head := data
+	if len(head) > 512 {
+		head = head[:512]
 	}
-
-	dataPrefix := s.APIPrefix
-	if !strings.HasSuffix(dataPrefix, "/") {
-		dataPrefix += "/"
+	if bytes.Contains(head, []byte("<svg")) {
+		return ".svg", true
 	}
-	dataPrefix += "data/"
-
-	return fmt.Sprintf("%splans/%s/destinations/%s/images/%s", dataPrefix, planID, destID, filename), nil
-}
-
-// ImportPlans imports a list of full plans
-func (s *GlobalStore) ImportPlans(plans []FullPlan) error {
-	for _, fp := range plans {
-		// Create new plan
-		newPlan, err := s.CreatePlan(fp.Plan.Name)
-		if err != nil {
-			return err
-		}
-
-		planStore := s.GetPlanStore(newPlan.ID)
-
-		for _, fd := range fp.Destinations {
-			// Create destination
-			newDest, err := planStore.CreateDestination(fd.Destination.Name)
-			if err != nil {
-				return err
-			}
-
-			// Update destination order if needed (CreateDestination sets order to last)
-			if newDest.Order != fd.Destination.Order {
-				newDest.Order = fd.Destination.Order
-				planStore.UpdateDestination(newDest.ID, newDest)
-			}
-
-			destStore := planStore.GetDestinationStore(newDest.ID)
-
-			// Process images before saving metadata
-			for i := range fd.Spots {
-				if fd.Spots[i].IconBase64 != "" {
-					newUrl, err := s.saveBase64Image(newPlan.ID, newDest.ID, fd.Spots[i].IconBase64)
-					if err == nil {
-						fd.Spots[i].Icon = newUrl
-					}
-				}
-			}
-
-			for i := range fd.GuideImages {
-				if fd.GuideImages[i].Base64Data != "" {
-					newUrl, err := s.saveBase64Image(newPlan.ID, newDest.ID, fd.GuideImages[i].Base64Data)
-					if err == nil {
-						fd.GuideImages[i].URL = newUrl
-					}
-				}
-			}
-
-			if fd.Config.MapImageBase64 != "" {
-				newUrl, err := s.saveBase64Image(newPlan.ID, newDest.ID, fd.Config.MapImageBase64)
-				if err == nil {
-					fd.Config.MapImage = newUrl
-				}
-			}
-
-			for i := range fd.References {
-				if fd.References[i].LinkBase64 != "" {
-					newUrl, err := s.saveBase64Image(newPlan.ID, newDest.ID, fd.References[i].LinkBase64)
-					if err == nil {
-						fd.References[i].Link = newUrl
-					}
-				}
-			}
-
-			// Save all data
-			destStore.SaveSpots(fd.Spots)
-			destStore.SaveFoods(fd.Foods)
-			destStore.SaveRoutes(fd.Routes)
-			destStore.SaveQuestions(fd.Questions)
-			destStore.SaveReferences(fd.References)
-			destStore.SaveConfig(fd.Config)
-			destStore.SaveGuideImages(fd.GuideImages)
-			destStore.SaveSchedules(fd.Schedules)
-			destStore.SaveItineraries(fd.Itineraries)
-		}
-	}
-	return nil
+	return "", false
 }
 
 // PlanStore manages data for a specific plan (which contains destinations)
 type PlanStore struct {
-	Dir string
+	Backend Backend
+	Prefix  string // key prefix, "plans/<id>"
 }
 
 func (s *PlanStore) EnsureDir() error {
-	if _, err := os.Stat(s.Dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(s.Dir, 0755); err != nil {
-			return err
-		}
-	}
 	// Ensure destinations directory
-	destDir := filepath.Join(s.Dir, "destinations")
-	if _, err := os.Stat(destDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(destDir, 0755); err != nil {
-			return err
-		}
-	}
-	return nil
+	return s.Backend.MkdirAll(joinKey(s.Prefix, "destinations"))
 }
 
 func (s *PlanStore) ListDestinations() ([]Destination, error) {
 	if err := s.EnsureDir(); err != nil {
 		return nil, err
 	}
-	path := filepath.Join(s.Dir, "destinations.json")
-	data, err := os.ReadFile(path)
-	if os.IsNotExist(err) {
+	data, err := s.Backend.ReadFile(joinKey(s.Prefix, "destinations.json"))
+	if errors.Is(err, fs.ErrNotExist) {
 		return []Destination{}, nil
 	}
 	if err != nil {
@@ -576,35 +703,57 @@ func (s *PlanStore) ListDestinations() ([]Destination, error) {
 	return dests, nil
 }
 
+// Lock takes the plan lock that guards destinations.json. It fails with
+// ErrPlanNotFound if the plan directory does not exist (any more).
+func (s *PlanStore) Lock() (func(), error) {
+	return lockExisting(s.Backend, s.Prefix, notFoundError(ErrPlanNotFound, s.Prefix))
+}
+
 func (s *PlanStore) SaveDestinations(dests []Destination) error {
+	unlock, err := s.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.saveDestinations(dests)
+}
+
+func (s *PlanStore) saveDestinations(dests []Destination) error {
 	if err := s.EnsureDir(); err != nil {
 		return err
 	}
-	path := filepath.Join(s.Dir, "destinations.json")
 	data, err := json.MarshalIndent(dests, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0644)
+	return s.Backend.WriteFile(joinKey(s.Prefix, "destinations.json"), data)
 }
 
 func (s *PlanStore) CreateDestination(name string) (Destination, error) {
+	unlock, err := s.Lock()
+	if err != nil {
+		return Destination{}, err
+	}
+	defer unlock()
 	dests, err := s.ListDestinations()
 	if err != nil {
 		return Destination{}, err
 	}
 	newDest := Destination{
-		ID:        fmt.Sprintf("%d", time.Now().UnixMilli()),
+		ID:        newID(),
 		Name:      name,
 		CreatedAt: time.Now().Format(time.RFC3339),
 		Order:     len(dests),
 	}
 	dests = append(dests, newDest)
-	if err := s.SaveDestinations(dests); err != nil {
+	if err := s.saveDestinations(dests); err != nil {
 		return Destination{}, err
 	}
 	// Ensure destination directory exists
-	destStore := s.GetDestinationStore(newDest.ID)
+	destStore, err := s.GetDestinationStore(newDest.ID)
+	if err != nil {
+		return Destination{}, err
+	}
 	if err := destStore.EnsureDir(); err != nil {
 		return Destination{}, err
 	}
@@ -612,6 +761,11 @@ func (s *PlanStore) CreateDestination(name string) (Destination, error) {
 }
 
 func (s *PlanStore) UpdateDestination(id string, update Destination) error {
+	unlock, err := s.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	dests, err := s.ListDestinations()
 	if err != nil {
 		return err
@@ -622,185 +776,139 @@ func (s *PlanStore) UpdateDestination(id string, update Destination) error {
 				dests[i].Name = update.Name
 			}
 			dests[i].Order = update.Order
-			return s.SaveDestinations(dests)
+			return s.saveDestinations(dests)
 		}
 	}
-	return fmt.Errorf("destination not found")
+	return fmt.Errorf("%w: %s", ErrDestinationNotFound, id)
 }
 
-func (s *PlanStore) DeleteDestination(id string) error {
+// ReorderDestinations moves the given destinations to the front in the
+// given order, keeps the others behind them in their current order, and
+// renumbers Order accordingly.
+func (s *PlanStore) ReorderDestinations(ids []string) ([]Destination, error) {
+	unlock, err := s.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	dests, err := s.ListDestinations()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var newDests []Destination
+	sort.SliceStable(dests, func(i, j int) bool { return dests[i].Order < dests[j].Order })
+
+	byID := make(map[string]Destination, len(dests))
 	for _, d := range dests {
-		if d.ID != id {
-			newDests = append(newDests, d)
+		byID[d.ID] = d
+	}
+	reordered := make([]Destination, 0, len(dests))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		d, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrDestinationNotFound, id)
 		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate destination: %s", id)
+		}
+		seen[id] = true
+		reordered = append(reordered, d)
 	}
-	if err := s.SaveDestinations(newDests); err != nil {
-		return err
-	}
-	// Remove directory
-	return os.RemoveAll(filepath.Join(s.Dir, "destinations", id))
-}
-
-func (s *PlanStore) GetDestinationStore(destID string) *DestinationStore {
-	return &DestinationStore{Dir: filepath.Join(s.Dir, "destinations", destID)}
-}
-
-// DestinationStore manages data for a specific destination (was PlanStore)
-type DestinationStore struct {
-	Dir string
-}
-
-func (s *DestinationStore) EnsureDir() error {
-	if _, err := os.Stat(s.Dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(s.Dir, 0755); err != nil {
-			return err
+	for _, d := range dests {
+		if !seen[d.ID] {
+			reordered = append(reordered, d)
 		}
 	}
-	return nil
+	for i := range reordered {
+		reordered[i].Order = i
+	}
+	if err := s.saveDestinations(reordered); err != nil {
+		return nil, err
+	}
+	return reordered, nil
 }
 
-func (s *DestinationStore) loadFile(filename string, v interface{}) error {
-	path := filepath.Join(s.Dir, filename)
-	data, err := os.ReadFile(path)
-	if os.IsNotExist(err) {
-		return nil // Return empty/default
-	}
+func (s *PlanStore) DeleteDestination(id string) error {
+	destStore, err := s.GetDestinationStore(id)
 	if err != nil {
 		return err
 	}
-	if len(data) == 0 {
-		return nil
-	}
-	return json.Unmarshal(data, v)
-}
-
-func (s *DestinationStore) saveFile(filename string, v interface{}) error {
-	if err := s.EnsureDir(); err != nil {
+	unlock, err := s.Lock()
+	if err != nil {
 		return err
 	}
-	path := filepath.Join(s.Dir, filename)
-	data, err := json.MarshalIndent(v, "", "  ")
+	defer unlock()
+	dests, err := s.ListDestinations()
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0644)
-}
-
-func (s *DestinationStore) LoadSpots() ([]Spot, error) {
-	var spots []Spot
-	err := s.loadFile("spots.json", &spots)
-	if spots == nil {
-		spots = []Spot{}
+	var newDests []Destination
+	for _, d := range dests {
+		if d.ID != id {
+			newDests = append(newDests, d)
+		}
 	}
-	return spots, err
-}
-
-func (s *DestinationStore) SaveSpots(spots []Spot) error {
-	return s.saveFile("spots.json", spots)
-}
-
-func (s *DestinationStore) LoadFoods() ([]Food, error) {
-	var foods []Food
-	err := s.loadFile("foods.json", &foods)
-	if foods == nil {
-		foods = []Food{}
+	if len(newDests) == len(dests) {
+		return fmt.Errorf("%w: %s", ErrDestinationNotFound, id)
 	}
-	return foods, err
-}
-
-func (s *DestinationStore) SaveFoods(foods []Food) error {
-	return s.saveFile("foods.json", foods)
-}
-
-func (s *DestinationStore) LoadRoutes() ([]Route, error) {
-	var routes []Route
-	err := s.loadFile("routes.json", &routes)
-	if routes == nil {
-		routes = []Route{}
+	if err := s.saveDestinations(newDests); err != nil {
+		return err
 	}
-	return routes, err
-}
-
-func (s *DestinationStore) SaveRoutes(routes []Route) error {
-	return s.saveFile("routes.json", routes)
-}
-
-func (s *DestinationStore) LoadQuestions() ([]Question, error) {
-	var questions []Question
-	err := s.loadFile("questions.json", &questions)
-	if questions == nil {
-		questions = []Question{}
+	// Wait for in-flight writers of this destination before removing it
+	unlockDest, err := destStore.Lock()
+	if errors.Is(err, ErrDestinationNotFound) {
+		// No directory to remove
+		return nil
 	}
-	return questions, err
-}
-
-func (s *DestinationStore) SaveQuestions(questions []Question) error {
-	return s.saveFile("questions.json", questions)
-}
-
-func (s *DestinationStore) LoadReferences() ([]Reference, error) {
-	var references []Reference
-	err := s.loadFile("references.json", &references)
-	if references == nil {
-		references = []Reference{}
+	if err != nil {
+		return err
 	}
-	return references, err
-}
-
-func (s *DestinationStore) SaveReferences(references []Reference) error {
-	return s.saveFile("references.json", references)
-}
-
-func (s *DestinationStore) LoadConfig() (Config, error) {
-	var config Config
-	err := s.loadFile("config.json", &config)
-	return config, err
-}
-
-func (s *DestinationStore) SaveConfig(config Config) error {
-	return s.saveFile("config.json", config)
+	defer unlockDest()
+	// Remove directory
+	return s.Backend.RemoveAll(destStore.Prefix)
 }
 
-func (s *DestinationStore) LoadGuideImages() ([]GuideImage, error) {
-	var images []GuideImage
-	err := s.loadFile("guide_images.json", &images)
-	if images == nil {
-		images = []GuideImage{}
+// GetDestinationStore returns the store of the destination destID, which
+// must be a valid ID. The destination need not exist.
+func (s *PlanStore) GetDestinationStore(destID string) (*DestinationStore, error) {
+	if err := ValidateID(destID); err != nil {
+		return nil, err
 	}
-	return images, err
-}
-
-func (s *DestinationStore) SaveGuideImages(images []GuideImage) error {
-	return s.saveFile("guide_images.json", images)
+	return &DestinationStore{Backend: s.Backend, Prefix: joinKey(s.Prefix, "destinations", destID)}, nil
 }
 
-func (s *DestinationStore) LoadSchedules() ([]Schedule, error) {
-	var schedules []Schedule
-	err := s.loadFile("schedules.json", &schedules)
-	if schedules == nil {
-		schedules = []Schedule{}
+// OpenDestination returns the store of the destination destID, which must
+// be listed in the plan, ErrDestinationNotFound otherwise
+func (s *PlanStore) OpenDestination(destID string) (*DestinationStore, error) {
+	destStore, err := s.GetDestinationStore(destID)
+	if err != nil {
+		return nil, err
+	}
+	dests, err := s.ListDestinations()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dests {
+		if d.ID == destID {
+			return destStore, nil
+		}
 	}
-	return schedules, err
+	return nil, fmt.Errorf("%w: %s", ErrDestinationNotFound, destID)
 }
 
-func (s *DestinationStore) SaveSchedules(schedules []Schedule) error {
-	return s.saveFile("schedules.json", schedules)
+// DestinationStore manages data for a specific destination (was PlanStore)
+type DestinationStore struct {
+	Backend Backend
+	Prefix  string // key prefix, "plans/<id>/destinations/<id>"
 }
 
-func (s *DestinationStore) LoadItineraries() ([]ItineraryItem, error) {
-	var itineraries []ItineraryItem
-	err := s.loadFile("itineraries.json", &itineraries)
-	if itineraries == nil {
-		itineraries = []ItineraryItem{}
-	}
-	return itineraries, err
+func (s *DestinationStore) EnsureDir() error {
+	return s.Backend.MkdirAll(s.Prefix)
 }
 
-func (s *DestinationStore) SaveItineraries(itineraries []ItineraryItem) error {
-	return s.saveFile("itineraries.json", itineraries)
+// Lock takes the destination lock that guards its section files. It
+// fails with ErrDestinationNotFound if the destination directory does not
+// exist (any more), e.g. because it was deleted while waiting.
+func (s *DestinationStore) Lock() (func(), error) {
+	return lockExisting(s.Backend, s.Prefix, notFoundError(ErrDestinationNotFound, s.Prefix))
 }
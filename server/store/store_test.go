@@ -0,0 +1,125 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// newTestStore returns a store on plain files in a temp directory
+func newTestStore(t *testing.T) *GlobalStore {
+	t.Helper()
+	s := NewGlobalStore(t.TempDir())
+	if err := s.CheckLayout(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newTestDestination creates a plan with one destination
+func newTestDestination(t *testing.T, s *GlobalStore) (*PlanStore, *DestinationStore) {
+	t.Helper()
+	plan, err := s.CreatePlan("Trip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	planStore, err := s.OpenPlan(plan.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := planStore.CreateDestination("Kyoto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	destStore, err := planStore.OpenDestination(dest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return planStore, destStore
+}
+
+// testPNG returns a w x h PNG; seed makes its content distinct
+func testPNG(t *testing.T, w, h int, seed uint8) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: seed, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestKeyFromURL(t *testing.T) {
+	s := NewMemoryStore()
+	blob := blobKey("ab"+string(bytes.Repeat([]byte("0"), 62)), ".png")
+	tests := []struct {
+		url string
+		key string
+		ok  bool
+	}{
+		{"/api/data/" + blob, blob, true},
+		{"/x/api/data/" + blob, blob, true},
+		{"/data/" + blob, blob, true},
+		{"/api/data/thumbs/320/" + blob, "thumbs/320/" + blob, true},
+		{"/api/data/plans/p1/destinations/d1/images/a.png", "plans/p1/destinations/d1/images/a.png", true},
+		{"/api/data/blobs/zz/bogus.png", "", false},
+		{"/api/data/plans.json", "", false},
+		{"/api/data/../" + blob, "", false},
+		{"https://example.com/data/" + blob, "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		key, ok := s.keyFromURL(tt.url)
+		if key != tt.key || ok != tt.ok {
+			t.Errorf("keyFromURL(%q) = %q, %v, want %q, %v", tt.url, key, ok, tt.key, tt.ok)
+		}
+	}
+}
+
+func TestFullDestinationJSON(t *testing.T) {
+	var fd FullDestination
+	in := `{"destination":{"id":"d","name":"Kyoto","created_at":"2024-01-01T00:00:00Z"},"spots":[{"id":"s","name":"Temple"}],"config":{"map_image":"m.png"},"routes":null,"unknown":1}`
+	if err := json.Unmarshal([]byte(in), &fd); err != nil {
+		t.Fatal(err)
+	}
+	if spots := *SpotSection.List(&fd); len(spots) != 1 || spots[0].Name != "Temple" {
+		t.Errorf("spots: %+v", spots)
+	}
+	if c := ConfigSection.Value(&fd); c.MapImage != "m.png" {
+		t.Errorf("config: %+v", c)
+	}
+	out, err := json.Marshal(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.Token()
+	for dec.More() {
+		key, _ := dec.Token()
+		fields = append(fields, key.(string))
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		if string(v) == "null" {
+			t.Errorf("%s is null in %s", key, out)
+		}
+	}
+	want := []string{"destination"}
+	for _, sec := range Sections {
+		want = append(want, sec.Name())
+	}
+	if strings.Join(fields, ",") != strings.Join(want, ",") {
+		t.Errorf("fields %v, want %v", fields, want)
+	}
+}
@@ -0,0 +1,243 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+)
+
+// ThumbDir caches resized variants of images: thumbs/<width>/<key of
+// the original>. Blobs never change, so a variant stays valid until gc
+// removes it together with its original.
+const ThumbDir = "thumbs"
+
+// ThumbWidths are the widths variants are made at. A requested width is
+// rounded up to one of them so the cache stays small.
+var ThumbWidths = []int{160, 320, 640, 1280}
+
+// maxThumbPixels bounds the images decoded for resizing, as image.DecodeConfig
+// reports them before anything is decoded; bigger ones are served as they
+// are. At the limit a 4:2:0 JPEG takes about 36MB decoded, which resize
+// reads in place. Other formats take 4 bytes a pixel and as much again
+// when resize converts them to RGBA, about 200MB, which is why thumbSlots
+// bounds how many are decoded at once.
+const maxThumbPixels = 24 << 20
+
+// thumbSlots limits how many images are decoded at once
+var thumbSlots = make(chan struct{}, 2)
+
+// ErrNoThumbnail is returned when the original should be served instead:
+// it is no larger than the width asked for, or not a format that can be
+// resized (SVG, WebP, or too big to decode)
+var ErrNoThumbnail = errors.New("no thumbnail for this image")
+
+// thumbWidth rounds w up to one of ThumbWidths, capped at the largest
+func thumbWidth(w int) int {
+	for _, tw := range ThumbWidths {
+		if w <= tw {
+			return tw
+		}
+	}
+	return ThumbWidths[len(ThumbWidths)-1]
+}
+
+// thumbKey returns the key of the variant of the image key at width w.
+// Variants are JPEG or PNG like their original, GIFs become PNG.
+func thumbKey(key string, w int) string {
+	k := joinKey(ThumbDir, strconv.Itoa(w), key)
+	if strings.EqualFold(path.Ext(key), ".gif") {
+		return k + ".png"
+	}
+	return k
+}
+
+// thumbOriginal returns the key of the original of the variant key
+func thumbOriginal(key string) string {
+	_, rest, _ := strings.Cut(strings.TrimPrefix(key, ThumbDir+"/"), "/")
+	if strings.HasSuffix(rest, ".gif.png") {
+		return strings.TrimSuffix(rest, ".png")
+	}
+	return rest
+}
+
+// Thumbnail returns the key of a variant of the image key at most about
+// width pixels wide, creating and caching it on first use. It returns
+// ErrNoThumbnail if the original should be served instead.
+func (s *GlobalStore) Thumbnail(key string, width int) (string, error) {
+	if !fs.ValidPath(key) {
+		return "", &fs.PathError{Op: "thumbnail", Path: key, Err: fs.ErrInvalid}
+	}
+	if width <= 0 || strings.HasPrefix(key, ThumbDir+"/") {
+		return "", ErrNoThumbnail
+	}
+	w := thumbWidth(width)
+	tk := thumbKey(key, w)
+	if _, err := fs.Stat(s.Backend, tk); err == nil {
+		return tk, nil
+	}
+
+	thumbSlots <- struct{}{}
+	defer func() { <-thumbSlots }()
+	// Another request may have made it meanwhile
+	if _, err := fs.Stat(s.Backend, tk); err == nil {
+		return tk, nil
+	}
+	data, err := s.Backend.ReadFile(key)
+	if err != nil {
+		return "", err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		// Not a format the standard library decodes
+		return "", ErrNoThumbnail
+	}
+	// Variants lose the EXIF data, so they are turned upright here.
+	// Orientations 5 to 8 swap width and height.
+	var orientation int
+	if format == "jpeg" {
+		info, _ := ReadPhotoInfo(data)
+		orientation = info.Orientation
+	}
+	uw, uh := cfg.Width, cfg.Height // upright
+	if orientation >= 5 {
+		uw, uh = uh, uw
+	}
+	if uw <= w || cfg.Width*cfg.Height > maxThumbPixels {
+		return "", ErrNoThumbnail
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", ErrNoThumbnail
+	}
+	h := uh * w / uw
+	if h < 1 {
+		h = 1
+	}
+	var dst *image.RGBA
+	if orientation >= 5 {
+		dst = orient(resize(src, h, w), orientation)
+	} else {
+		dst = orient(resize(src, w, h), orientation)
+	}
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := s.Backend.WriteFile(tk, buf.Bytes()); err != nil {
+		return "", err
+	}
+	return tk, nil
+}
+
+// removeThumbnails deletes every variant of the image key
+func (s *GlobalStore) removeThumbnails(key string) error {
+	for _, w := range ThumbWidths {
+		if err := s.Backend.RemoveAll(thumbKey(key, w)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resize scales src to w x h by averaging the source pixels that fall
+// into each destination pixel, which is what downscaling photos needs
+func resize(src image.Image, w int, h int) *image.RGBA {
+	b := src.Bounds()
+	// Read pixels without going through color.Model. JPEGs are read as
+	// decoded, other images are converted to RGBA first.
+	var pixel func(x, y int) (r, g, b, a uint8)
+	if ycc, ok := src.(*image.YCbCr); ok {
+		pixel = func(x, y int) (uint8, uint8, uint8, uint8) {
+			ci := ycc.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(ycc.Y[ycc.YOffset(x, y)], ycc.Cb[ci], ycc.Cr[ci])
+			return r, g, b, 255
+		}
+	} else {
+		rgba, ok := src.(*image.RGBA)
+		if !ok {
+			rgba = image.NewRGBA(b)
+			draw.Draw(rgba, b, src, b.Min, draw.Src)
+		}
+		pixel = func(x, y int) (uint8, uint8, uint8, uint8) {
+			i := rgba.PixOffset(x, y)
+			return rgba.Pix[i], rgba.Pix[i+1], rgba.Pix[i+2], rgba.Pix[i+3]
+		}
+	}
+	sw, sh := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := y * sh / h
+		y1 := (y + 1) * sh / h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := x * sw / w
+			x1 := (x + 1) * sw / w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := pixel(sx+b.Min.X, sy+b.Min.Y)
+					r += uint64(pr)
+					g += uint64(pg)
+					bl += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(bl / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// orient turns img upright according to an EXIF orientation: 2 to 4 flip
+// or turn it half way, 5 to 8 turn it a quarter and swap its sides
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	// source returns the pixel of img shown at x, y
+	source := map[int]func(x, y int) (int, int){
+		2: func(x, y int) (int, int) { return w - 1 - x, y },
+		3: func(x, y int) (int, int) { return w - 1 - x, h - 1 - y },
+		4: func(x, y int) (int, int) { return x, h - 1 - y },
+		5: func(x, y int) (int, int) { return y, x },
+		6: func(x, y int) (int, int) { return y, h - 1 - x },
+		7: func(x, y int) (int, int) { return w - 1 - y, h - 1 - x },
+		8: func(x, y int) (int, int) { return w - 1 - y, x },
+	}[orientation]
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := source(x, y)
+			si := img.PixOffset(sx+img.Rect.Min.X, sy+img.Rect.Min.Y)
+			copy(dst.Pix[dst.PixOffset(x, y):][:4], img.Pix[si:si+4])
+		}
+	}
+	return dst
+}
@@ -5,6 +5,7 @@ import { api } from './api';
 import type { Spot, Route as RouteType, Question, Reference, Food, Config, GuideImage, Schedule, ItineraryItem } from './api';
 import './App.css';
 import { useParams, useNavigate } from 'react-router-dom';
+import { saveList, saveValue } from './utils/conflict';
 
 import { MapSection } from './components/MapSection';
 import { GuideMapSection } from './components/GuideMapSection';
@@ -88,6 +89,19 @@ function DestinationDetail() {
   if (!planId || !destId) return <div>Invalid URL</div>;
   if (loading) return <div style={{ display: 'flex', justifyContent: 'center', alignItems: 'center', height: '100vh' }}><Spin size="large" /></div>;
 
+  // Saves are based on the revision last loaded; one that finds the section
+  // changed elsewhere merges with that change, see utils/conflict.ts
+  const listSaver = <T extends { id: string }>(
+    what: string,
+    current: T[],
+    set: (items: T[]) => void,
+    save: (planId: string, destId: string, items: T[]) => Promise<unknown>,
+    load: (planId: string, destId: string) => Promise<T[]>,
+  ) => (items: T[]) => {
+    set(items);
+    saveList({ what, base: current, mine: items, save: (v) => save(planId, destId, v), load: () => load(planId, destId), onMerged: set });
+  };
+
   return (
     <Layout style={{ minHeight: '100vh' }}>
       <Header style={{ display: 'flex', alignItems: 'center', background: '#fff', borderBottom: '1px solid #f0f0f0', padding: '0 24px' }}>
@@ -103,30 +117,25 @@ function DestinationDetail() {
             spots={spots}
             onSaveConfig={(c) => {
               setConfig(c);
-              api.saveConfig(planId, destId, c);
-            }}
-            onSaveSpots={(s) => {
-              setSpots(s);
-              api.saveSpots(planId, destId, s);
+              saveValue({ what: '地图设置', base: config, mine: c, save: (v) => api.saveConfig(planId, destId, v), load: () => api.getConfig(planId, destId), onMerged: setConfig });
             }}
+            onSaveSpots={listSaver('景点', spots, setSpots, api.saveSpots, api.getSpots)}
           />
 
-          <GuideMapSection images={guideImages} onSave={(g) => {
-            setGuideImages(g);
-            api.saveGuideImages(planId, destId, g);
-          }} />
+          <GuideMapSection
+            images={guideImages}
+            onSave={listSaver('攻略图片', guideImages, setGuideImages, api.saveGuideImages, api.getGuideImages)}
+            onAddSpot={async (spot) => {
+              const saved = await api.spots.add(planId, destId, spot);
+              setSpots((current) => [...current, saved]);
+            }}
+          />
 
-          <ScheduleListSection schedules={schedules} onSave={(s) => {
-            setSchedules(s);
-            api.saveSchedules(planId, destId, s);
-          }} />
+          <ScheduleListSection schedules={schedules} onSave={listSaver('日程', schedules, setSchedules, api.saveSchedules, api.getSchedules)} />
 
           <ItinerarySection
             itineraries={itineraries}
-            onSave={(i) => {
-              setItineraries(i);
-              api.saveItineraries(planId, destId, i);
-            }}
+            onSave={listSaver('行程', itineraries, setItineraries, api.saveItineraries, api.getItineraries)}
             destinationName={config.destination?.name}
             spots={spots}
           />
@@ -134,31 +143,16 @@ function DestinationDetail() {
           <SpotListSection
             spots={spots}
             destinationName={config.destination?.name}
-            onSave={(s) => {
-              setSpots(s);
-              api.saveSpots(planId, destId, s);
-            }}
+            onSave={listSaver('景点', spots, setSpots, api.saveSpots, api.getSpots)}
           />
 
-          <FoodListSection foods={foods} onSave={(f) => {
-            setFoods(f);
-            api.saveFoods(planId, destId, f);
-          }} />
-
-          <RouteListSection routes={routes} onSave={(r) => {
-            setRoutes(r);
-            api.saveRoutes(planId, destId, r);
-          }} />
-
-          <QuestionListSection questions={questions} onSave={(q) => {
-            setQuestions(q);
-            api.saveQuestions(planId, destId, q);
-          }} />
-
-          <ReferenceListSection references={references} onSave={(r) => {
-            setReferences(r);
-            api.saveReferences(planId, destId, r);
-          }} />
+          <FoodListSection foods={foods} onSave={listSaver('美食', foods, setFoods, api.saveFoods, api.getFoods)} />
+
+          <RouteListSection routes={routes} onSave={listSaver('路线', routes, setRoutes, api.saveRoutes, api.getRoutes)} />
+
+          <QuestionListSection questions={questions} onSave={listSaver('问题', questions, setQuestions, api.saveQuestions, api.getQuestions)} />
+
+          <ReferenceListSection references={references} onSave={listSaver('参考资料', references, setReferences, api.saveReferences, api.getReferences)} />
         </Space>
       </Content>
       <Footer style={{ textAlign: 'center' }}>旅游地图助手 ©{new Date().getFullYear()}</Footer>
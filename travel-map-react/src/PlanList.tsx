@@ -3,7 +3,7 @@ import { Layout, List, Card, Button, Input, Modal, Typography, Popconfirm, Spin,
 import { PlusOutlined, DeleteOutlined, RightOutlined, EditOutlined, ExportOutlined, ImportOutlined, UploadOutlined } from '@ant-design/icons';
 import { useNavigate } from 'react-router-dom';
 import { api } from './api';
-import type { Plan, FullPlan } from './api';
+import type { Plan, FullPlan, ExportFile } from './api';
 
 const { Header, Content, Footer } = Layout;
 const { Title } = Typography;
@@ -23,6 +23,7 @@ export default function PlanList() {
     // Import state
     const [isImportModalOpen, setIsImportModalOpen] = useState(false);
     const [importedPlans, setImportedPlans] = useState<FullPlan[]>([]);
+    const [importEnvelope, setImportEnvelope] = useState<ExportFile | null>(null);
     const [importData, setImportData] = useState<{ key: string; name: string; status: string; statusText: string }[]>([]);
     const [selectedImportIndices, setSelectedImportIndices] = useState<React.Key[]>([]);
     const [hasConflict, setHasConflict] = useState(false);
@@ -96,12 +97,16 @@ export default function PlanList() {
     const handleImportFile = async (file: File) => {
         try {
             const text = await file.text();
-            const parsedPlans: FullPlan[] = JSON.parse(text);
+            const parsed = JSON.parse(text);
+            // Older exports are a bare array of plans
+            const envelope: ExportFile | null = Array.isArray(parsed) ? null : parsed;
+            const parsedPlans: FullPlan[] = envelope ? envelope.plans : parsed;
 
             if (!Array.isArray(parsedPlans)) {
                 throw new Error("Invalid format: expected array of plans");
             }
 
+            setImportEnvelope(envelope);
             setImportedPlans(parsedPlans);
 
             let foundConflict = false;
@@ -128,8 +133,10 @@ export default function PlanList() {
 
     const confirmImport = async () => {
         const plansToImport = importedPlans.filter((_, index) => selectedImportIndices.includes(index.toString()));
-        await api.importPlans(plansToImport);
+        // Keep the version so the server can upgrade the payload
+        await api.importPlans(importEnvelope ? { ...importEnvelope, plans: plansToImport } : plansToImport);
         setIsImportModalOpen(false);
+        setImportEnvelope(null);
         setImportedPlans([]);
         setImportData([]);
         setSelectedImportIndices([]);
@@ -219,6 +226,7 @@ export default function PlanList() {
                     onOk={confirmImport}
                     onCancel={() => {
                         setIsImportModalOpen(false);
+                        setImportEnvelope(null);
                         setImportedPlans([]);
                         setImportData([]);
                         setSelectedImportIndices([]);
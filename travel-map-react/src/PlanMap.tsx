@@ -14,6 +14,7 @@ import { useMapSearch } from './hooks/useMapSearch';
 import { useMapInteractions } from './hooks/useMapInteractions';
 import { useDebounce } from './hooks/useDebounce';
 import { DEFAULT_MAP_CENTER } from './utils/mapConstants';
+import { saveList, saveValue } from './utils/conflict';
 
 // Fix leaflet marker icons
 import icon from 'leaflet/dist/images/marker-icon.png';
@@ -69,14 +70,13 @@ export default function PlanMap() {
         spots,
         onSaveConfig: async (newConfig) => {
             setConfig(newConfig);
-            if (planId && destId) {
-                await api.saveConfig(planId, destId, newConfig);
-            }
+            await saveConfig(config, newConfig);
         },
         onSaveSpots: async (newSpots) => {
             setSpots(newSpots);
             if (planId && destId) {
-                await api.saveSpots(planId, destId, newSpots);
+                // A save that finds the spots changed elsewhere merges with that change
+                await saveList({ what: '景点', base: spots, mine: newSpots, save: (v) => api.saveSpots(planId, destId, v), load: () => api.getSpots(planId, destId), onMerged: setSpots });
             }
         }
     });
@@ -93,11 +93,16 @@ export default function PlanMap() {
         hookHandleSearch(value, immediate);
     };
 
-    // Debounced save
-    const debouncedSaveConfig = useDebounce((newConfig: Config) => {
+    // saveConfig saves an edit of base, merging with changes made elsewhere
+    async function saveConfig(base: Config, newConfig: Config) {
         if (planId && destId) {
-            api.saveConfig(planId, destId, newConfig);
+            await saveValue({ what: '地图设置', base, mine: newConfig, save: (v) => api.saveConfig(planId, destId, v), load: () => api.getConfig(planId, destId), onMerged: setConfig });
         }
+    }
+
+    // Debounced save
+    const debouncedSaveConfig = useDebounce((base: Config, newConfig: Config) => {
+        saveConfig(base, newConfig);
     }, 1000);
 
     useEffect(() => {
@@ -172,7 +177,7 @@ export default function PlanMap() {
         setConfig(newConfig);
 
         // Trigger debounced save
-        debouncedSaveConfig(newConfig);
+        debouncedSaveConfig(config, newConfig);
     };
 
     if (!planId || !destId) return <div>Invalid URL</div>;
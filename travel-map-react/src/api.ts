@@ -7,6 +7,15 @@ const getUrl = (url: string) => {
     return `${API_BASE}${url}`;
 };
 
+// thumbnailUrl asks the server for a variant of a stored image about
+// width pixels wide; other URLs are returned unchanged
+export const thumbnailUrl = (url: string, width: number) => {
+    if (!url || !url.includes('/data/') || url.includes('?')) {
+        return url;
+    }
+    return `${url}?w=${width}`;
+};
+
 export interface Plan {
     id: string;
     name: string;
@@ -57,6 +66,7 @@ export interface Route {
     id: string;
     name: string;
     time: string;
+    // Ids of the spots on the route; the server turns spot names into ids
     spots: string[];
     duration: string;
     story: string;
@@ -100,6 +110,21 @@ export interface GuideImage {
     id: string;
     url: string;
     base64_data?: string;
+    // Where and when the photo was taken, from its EXIF data
+    lat?: number;
+    lng?: number;
+    taken_at?: string;
+}
+
+export interface GuideImageUpload {
+    url: string;
+    lat?: number;
+    lng?: number;
+    taken_at?: string;
+    // Set for photos with a GPS position: a spot to add there, or the
+    // spot the server added when asked to with createSpot
+    suggested_spot?: Spot;
+    spot?: Spot;
 }
 
 export interface Schedule {
@@ -133,6 +158,14 @@ export interface FullPlan {
     destinations: FullDestination[];
 }
 
+// An export file. Files from before versioning are a bare FullPlan[],
+// the server upgrades those on import.
+export interface ExportFile {
+    version: number;
+    exported_at?: string;
+    plans: FullPlan[];
+}
+
 const API_BASE = (import.meta as any).env?.VITE_API_PREFIX || '/api';
 
 
@@ -144,35 +177,123 @@ export interface SearchResult {
     [key: string]: any;
 }
 
+// Revisions (ETags) of section resources last seen by this client, keyed by url.
+// They are sent back as If-Match so the server rejects saves based on stale data.
+const revisions = new Map<string, string>();
+
+const rememberRevision = (url: string, res: Response) => {
+    const etag = res.headers.get('ETag');
+    if (etag) {
+        revisions.set(url, etag);
+    }
+};
+
+// ConflictError is thrown when a save is rejected because someone else changed
+// the resource first. The revision the save was based on is kept, so retrying
+// fails again until the change is merged; see utils/conflict.ts. Sections send
+// their current content along, which takeCurrent hands over.
+export class ConflictError extends Error {
+    url: string;
+    current?: unknown;
+    revision?: string;
+    constructor(url: string, current?: unknown, revision?: string) {
+        super(`Conflict saving ${url}: it was changed elsewhere, reload to merge`);
+        this.name = 'ConflictError';
+        this.url = url;
+        this.current = current;
+        this.revision = revision;
+    }
+}
+
+// takeCurrent returns the content a conflict was sent with, adopting its
+// revision now that the client has seen it, or undefined if there is none
+export const takeCurrent = <T>(err: ConflictError): T | undefined => {
+    if (err.current === undefined || !err.revision) {
+        return undefined;
+    }
+    revisions.set(err.url, err.revision);
+    return err.current as T;
+};
+
+// ApiError is thrown when a request fails. The server answers with
+// {"error": {code, message, field, request_id}}; `code` is one of the codes
+// listed in the README, e.g. 'plan_not_found' or 'amap_key_missing', and
+// `field` the parameter or content field at fault, if any.
+export class ApiError extends Error {
+    status: number;
+    code: string;
+    field?: string;
+    requestId?: string;
+    constructor(status: number, code: string, message: string, field?: string, requestId?: string) {
+        super(message);
+        this.name = 'ApiError';
+        this.status = status;
+        this.code = code;
+        this.field = field;
+        this.requestId = requestId;
+    }
+}
+
+export const isApiError = (err: unknown, code: string): err is ApiError =>
+    err instanceof ApiError && err.code === code;
+
+const parseJSON = (text: string): any => {
+    try {
+        return JSON.parse(text);
+    } catch {
+        return undefined;
+    }
+};
+
+// apiError builds the error of a failed response from its body. Responses
+// without the error envelope, e.g. from a proxy in between, get an empty code.
+const apiError = (res: Response, action: string, text: string): ApiError => {
+    const error = parseJSON(text)?.error;
+    if (error?.code) {
+        return new ApiError(res.status, error.code, `${action}: ${error.message}`, error.field, error.request_id);
+    }
+    const requestId = res.headers.get('X-Request-ID') || undefined;
+    return new ApiError(res.status, '', `${action}: ${res.status} ${text.trim() || res.statusText}`, undefined, requestId);
+};
+
+const failure = async (res: Response, action: string) => apiError(res, action, await res.text());
+
 // Core API Helpers
 export const get = async <T>(url: string, init?: RequestInit): Promise<T> => {
     const res = await fetch(getUrl(url), init);
     if (!res.ok) {
-        if (res.status === 401) {
-            // Let caller handle 401 if needed, or throw specific error
-            // For searchGaode we need to detect 401. 
-            // But get() is generic.
-            // We'll throw an error with status attached if possible, or just standard Error.
-            // But wait, the previous code had specific logic for 401 in searchGaode.
-        }
-        throw new Error(`Failed to fetch ${url}: ${res.status} ${res.statusText}`);
+        throw await failure(res, `Failed to fetch ${url}`);
     }
+    rememberRevision(url, res);
     return res.json();
 };
 
 export const postJSON = async <T>(url: string, data: any, init?: RequestInit): Promise<T> => {
+    const revision = revisions.get(url);
     const res = await fetch(getUrl(url), {
         ...init,
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
+            ...(revision ? { 'If-Match': revision } : {}),
             ...(init?.headers || {})
         },
         body: JSON.stringify(data),
     });
     if (!res.ok) {
-        throw new Error(`Failed to post to ${url}: ${res.status} ${res.statusText}`);
+        // A stale revision gets code 'conflict'; other conflicts, like
+        // removing a spot routes use under the restrict policy, have their
+        // own codes. The ETag of a conflict is only adopted along with the
+        // content it came with, by takeCurrent.
+        const text = await res.text();
+        const err = apiError(res, `Failed to post to ${url}`, text);
+        if (err.code === 'conflict') {
+            const current = parseJSON(text)?.error?.current;
+            throw new ConflictError(url, current, res.headers.get('ETag') || undefined);
+        }
+        throw err;
     }
+    rememberRevision(url, res);
     const text = await res.text();
     return (text ? JSON.parse(text) : undefined) as T;
 };
@@ -188,7 +309,7 @@ export const putJSON = async <T = void>(url: string, data: any, init?: RequestIn
         body: JSON.stringify(data),
     });
     if (!res.ok) {
-        throw new Error(`Failed to put to ${url}: ${res.status} ${res.statusText}`);
+        throw await failure(res, `Failed to put to ${url}`);
     }
     const text = await res.text();
     return (text ? JSON.parse(text) : undefined) as T;
@@ -200,31 +321,61 @@ export const del = async (url: string, init?: RequestInit): Promise<void> => {
         method: 'DELETE',
     });
     if (!res.ok) {
-        throw new Error(`Failed to delete ${url}: ${res.status} ${res.statusText}`);
+        throw await failure(res, `Failed to delete ${url}`);
+    }
+};
+
+// Item endpoints of list sections, {section}/{id}. They share the revision of
+// the whole section, so changes are sent with and recorded under the section url
+// and a later whole-section save still passes If-Match.
+const itemRequest = async <T>(method: string, sectionUrl: string, url: string, data?: any): Promise<T> => {
+    const revision = revisions.get(sectionUrl);
+    const res = await fetch(getUrl(url), {
+        method,
+        headers: {
+            ...(data !== undefined ? { 'Content-Type': 'application/json' } : {}),
+            ...(revision ? { 'If-Match': revision } : {}),
+        },
+        body: data !== undefined ? JSON.stringify(data) : undefined,
+    });
+    if (!res.ok) {
+        throw await failure(res, `Failed to ${method.toLowerCase()} ${url}`);
     }
+    rememberRevision(sectionUrl, res);
+    const text = await res.text();
+    return (text ? JSON.parse(text) : undefined) as T;
+};
+
+export const sectionItems = <T extends { id: string }>(section: string) => {
+    const sectionUrl = (planId: string, destId: string) => `/${section}?planId=${planId}&destId=${destId}`;
+    const itemUrl = (planId: string, destId: string, id: string) => `/${section}/${encodeURIComponent(id)}?planId=${planId}&destId=${destId}`;
+    return {
+        // The server assigns an id if the item has none
+        add: (planId: string, destId: string, item: Omit<T, 'id'> & { id?: string }) =>
+            itemRequest<T>('POST', sectionUrl(planId, destId), sectionUrl(planId, destId), item),
+        get: (planId: string, destId: string, id: string) =>
+            itemRequest<T>('GET', sectionUrl(planId, destId), itemUrl(planId, destId, id)),
+        replace: (planId: string, destId: string, item: T) =>
+            itemRequest<T>('PUT', sectionUrl(planId, destId), itemUrl(planId, destId, item.id), item),
+        // Only the given fields change
+        update: (planId: string, destId: string, id: string, patch: Partial<T>) =>
+            itemRequest<T>('PATCH', sectionUrl(planId, destId), itemUrl(planId, destId, id), patch),
+        remove: (planId: string, destId: string, id: string) =>
+            itemRequest<void>('DELETE', sectionUrl(planId, destId), itemUrl(planId, destId, id)),
+    };
 };
 
 export const api = {
     // Search APIs
     searchGaode: async (query: string, signal?: AbortSignal): Promise<SearchResult[]> => {
-        // searchGaode has specific error handling for 401, so we might want to keep using fetch
-        // or wrap get() and catch the error.
-        // But get() throws "Failed to fetch...".
-        // Let's keep using fetch directly for searchGaode as it's a proxy call with specific error handling logic 
-        // that differs from standard REST API calls. 
-        // OR we can make get() take an option to not throw?
-        // Simpler: just use fetch here as it was, but use API_BASE.
-
+        // Not get(): the response is Gaode's, not one of ours. Without a key
+        // configured the server answers with code 'amap_key_missing'.
         const response = await fetch(`${API_BASE}/proxy/search?keywords=${encodeURIComponent(query)}`, {
             signal
         });
 
-        if (response.status === 401) {
-            throw new Error('AMAP_KEY_MISSING');
-        }
-
         if (!response.ok) {
-            throw new Error('Network response was not ok');
+            throw await failure(response, 'Search failed');
         }
 
         const json = await response.json();
@@ -272,28 +423,36 @@ export const api = {
     deleteDestination: (planId: string, destId: string) => del(`/destinations?planId=${planId}&id=${destId}`),
 
     // Destination Specific APIs (Spots, Routes, etc.)
+    // Saves resolve to the section as stored: the server gives items without
+    // an id, or with one used twice, a new id
     getSpots: (planId: string, destId: string) => get<Spot[]>(`/spots?planId=${planId}&destId=${destId}`),
-    saveSpots: (planId: string, destId: string, spots: Spot[]) => postJSON(`/spots?planId=${planId}&destId=${destId}`, spots),
+    saveSpots: (planId: string, destId: string, spots: Spot[]) => postJSON<Spot[]>(`/spots?planId=${planId}&destId=${destId}`, spots),
+    spots: sectionItems<Spot>('spots'),
 
     getFoods: (planId: string, destId: string) => get<Food[]>(`/foods?planId=${planId}&destId=${destId}`),
-    saveFoods: (planId: string, destId: string, foods: Food[]) => postJSON(`/foods?planId=${planId}&destId=${destId}`, foods),
+    saveFoods: (planId: string, destId: string, foods: Food[]) => postJSON<Food[]>(`/foods?planId=${planId}&destId=${destId}`, foods),
+    foods: sectionItems<Food>('foods'),
 
     getRoutes: (planId: string, destId: string) => get<Route[]>(`/routes?planId=${planId}&destId=${destId}`),
-    saveRoutes: (planId: string, destId: string, routes: Route[]) => postJSON(`/routes?planId=${planId}&destId=${destId}`, routes),
+    saveRoutes: (planId: string, destId: string, routes: Route[]) => postJSON<Route[]>(`/routes?planId=${planId}&destId=${destId}`, routes),
+    routes: sectionItems<Route>('routes'),
 
     getQuestions: (planId: string, destId: string) => get<Question[]>(`/questions?planId=${planId}&destId=${destId}`),
-    saveQuestions: (planId: string, destId: string, questions: Question[]) => postJSON(`/questions?planId=${planId}&destId=${destId}`, questions),
+    saveQuestions: (planId: string, destId: string, questions: Question[]) => postJSON<Question[]>(`/questions?planId=${planId}&destId=${destId}`, questions),
+    questions: sectionItems<Question>('questions'),
 
     getReferences: (planId: string, destId: string) => get<Reference[]>(`/references?planId=${planId}&destId=${destId}`),
-    saveReferences: (planId: string, destId: string, references: Reference[]) => postJSON(`/references?planId=${planId}&destId=${destId}`, references),
+    saveReferences: (planId: string, destId: string, references: Reference[]) => postJSON<Reference[]>(`/references?planId=${planId}&destId=${destId}`, references),
+    references: sectionItems<Reference>('references'),
 
     getConfig: (planId: string, destId: string) => get<Config>(`/config?planId=${planId}&destId=${destId}`),
-    saveConfig: (planId: string, destId: string, config: Config) => postJSON(`/config?planId=${planId}&destId=${destId}`, config),
+    saveConfig: (planId: string, destId: string, config: Config) => postJSON<Config>(`/config?planId=${planId}&destId=${destId}`, config),
 
     getGuideImages: (planId: string, destId: string) => get<GuideImage[]>(`/guide-images?planId=${planId}&destId=${destId}`),
-    saveGuideImages: (planId: string, destId: string, images: GuideImage[]) => postJSON(`/guide-images?planId=${planId}&destId=${destId}`, images),
+    saveGuideImages: (planId: string, destId: string, images: GuideImage[]) => postJSON<GuideImage[]>(`/guide-images?planId=${planId}&destId=${destId}`, images),
+    guideImages: sectionItems<GuideImage>('guide-images'),
 
-    uploadGuideImage: async (planId: string, destId: string, file: File): Promise<string> => {
+    uploadGuideImage: async (planId: string, destId: string, file: File): Promise<GuideImageUpload> => {
         const formData = new FormData();
         formData.append('file', file);
         formData.append('planId', planId);
@@ -302,16 +461,18 @@ export const api = {
             method: 'POST',
             body: formData,
         });
-        if (!res.ok) throw new Error('Failed to upload image');
-        const data = await res.json();
-        return data.url;
+        // 413 when over the size limit, 415 for types other than JPEG, PNG, GIF and WebP
+        if (!res.ok) throw await failure(res, 'Failed to upload image');
+        return res.json();
     },
 
     getSchedules: (planId: string, destId: string) => get<Schedule[]>(`/schedules?planId=${planId}&destId=${destId}`),
-    saveSchedules: (planId: string, destId: string, schedules: Schedule[]) => postJSON(`/schedules?planId=${planId}&destId=${destId}`, schedules),
+    saveSchedules: (planId: string, destId: string, schedules: Schedule[]) => postJSON<Schedule[]>(`/schedules?planId=${planId}&destId=${destId}`, schedules),
+    schedules: sectionItems<Schedule>('schedules'),
 
     getItineraries: (planId: string, destId: string) => get<ItineraryItem[]>(`/itineraries?planId=${planId}&destId=${destId}`),
-    saveItineraries: (planId: string, destId: string, itineraries: ItineraryItem[]) => postJSON(`/itineraries?planId=${planId}&destId=${destId}`, itineraries),
+    saveItineraries: (planId: string, destId: string, itineraries: ItineraryItem[]) => postJSON<ItineraryItem[]>(`/itineraries?planId=${planId}&destId=${destId}`, itineraries),
+    itineraries: sectionItems<ItineraryItem>('itineraries'),
 
     // Import/Export
     exportPlans: async (planIds?: string[]) => {
@@ -322,7 +483,7 @@ export const api = {
 
         const res = await fetch(getUrl(url));
         if (!res.ok) {
-            throw new Error(`Failed to export plans: ${res.status} ${res.statusText}`);
+            throw await failure(res, 'Failed to export plans');
         }
 
         const blob = await res.blob();
@@ -335,5 +496,5 @@ export const api = {
         document.body.removeChild(a);
         window.URL.revokeObjectURL(downloadUrl);
     },
-    importPlans: (plans: FullPlan[]) => postJSON(`/import`, plans),
+    importPlans: (payload: ExportFile | FullPlan[]) => postJSON(`/import`, payload),
 };
@@ -1,8 +1,8 @@
 import { useState } from 'react';
-import { Card, Button, Row, Col, Empty, message, Tooltip, Image } from 'antd';
+import { Card, Button, Row, Col, Empty, message, Tooltip, Image, Modal } from 'antd';
 import { PlusOutlined, UploadOutlined, QuestionCircleOutlined } from '@ant-design/icons';
-import type { GuideImage } from '../api';
-import { api } from '../api';
+import type { GuideImage, Spot } from '../api';
+import { api, thumbnailUrl } from '../api';
 import { useParams } from 'react-router-dom';
 import { GUIDE_MAP_HELP } from './help';
 import { ImageUploadModal } from './ImageUploadModal';
@@ -10,9 +10,11 @@ import { ImageUploadModal } from './ImageUploadModal';
 interface GuideMapSectionProps {
     images: GuideImage[];
     onSave: (g: GuideImage[]) => void;
+    // Called to add a spot where an uploaded photo was taken
+    onAddSpot?: (spot: Spot) => void | Promise<void>;
 }
 
-export const GuideMapSection = ({ images, onSave }: GuideMapSectionProps) => {
+export const GuideMapSection = ({ images, onSave, onAddSpot }: GuideMapSectionProps) => {
     const { planId, destId } = useParams<{ planId: string; destId: string }>();
     const [uploading, setUploading] = useState(false);
     const [isModalOpen, setIsModalOpen] = useState(false);
@@ -21,11 +23,29 @@ export const GuideMapSection = ({ images, onSave }: GuideMapSectionProps) => {
         if (!planId || !destId) return;
         setUploading(true);
         try {
-            const url = await api.uploadGuideImage(planId, destId, file);
-            const newImage = { id: Date.now().toString(), url: url };
+            const res = await api.uploadGuideImage(planId, destId, file);
+            const newImage: GuideImage = {
+                id: Date.now().toString(),
+                url: res.url,
+                lat: res.lat,
+                lng: res.lng,
+                taken_at: res.taken_at,
+            };
             onSave([...images, newImage]);
             message.success('图片上传成功');
             setIsModalOpen(false);
+            const suggested = res.suggested_spot;
+            if (suggested && onAddSpot) {
+                Modal.confirm({
+                    title: '照片包含位置信息',
+                    content: `是否在拍摄位置添加景点“${suggested.name}”？`,
+                    okText: '添加',
+                    cancelText: '不用了',
+                    onOk: () => onAddSpot(suggested),
+                });
+            }
+        } catch (e) {
+            message.error(`图片上传失败：${(e as Error).message}`);
         } finally {
             setUploading(false);
         }
@@ -51,7 +71,8 @@ export const GuideMapSection = ({ images, onSave }: GuideMapSectionProps) => {
                     {images.map((img) => (
                         <Col span={24} key={img.id}>
                             <Image
-                                src={img.url}
+                                src={thumbnailUrl(img.url, 1280)}
+                                preview={{ src: img.url }}
                                 width="100%"
                                 style={{
                                     maxHeight: '500px',
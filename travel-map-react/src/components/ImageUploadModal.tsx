@@ -70,6 +70,8 @@ export const ImageUploadModal: React.FC<ImageUploadModalProps> = ({ open, onCanc
     const uploadProps: UploadProps = {
         name: 'file',
         multiple: false,
+        // The server only accepts these, by content
+        accept: 'image/jpeg,image/png,image/gif,image/webp',
         fileList: fileList,
         beforeUpload: (file) => {
             handleFileSelect(file);
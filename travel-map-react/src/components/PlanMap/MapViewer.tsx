@@ -4,7 +4,7 @@ import { DeleteOutlined, EditOutlined, CloseOutlined } from '@ant-design/icons';
 import { MapContainer, TileLayer, Marker, Popup, useMap, useMapEvents } from 'react-leaflet';
 import L from 'leaflet';
 import type { Spot, Config } from '../../api';
-import { api } from '../../api';
+import { api, isApiError } from '../../api';
 import type { SearchResult } from '../../api';
 import { MapContextMenu } from './MapContextMenu';
 import { DestinationOverlay } from './DestinationOverlay';
@@ -199,7 +199,7 @@ const MapSearchHandler = ({ query, onResults, provider }: { query: string, onRes
             api.searchGaode(query)
                 .then(onResults)
                 .catch(err => {
-                    if (err.message === 'AMAP_KEY_MISSING') {
+                    if (isApiError(err, 'amap_key_missing')) {
                         showError('未配置高德API Key');
                         onResults([]);
                         return;
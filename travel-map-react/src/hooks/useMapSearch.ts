@@ -1,5 +1,5 @@
 import { useState, useRef } from 'react';
-import { api } from '../api';
+import { api, isApiError } from '../api';
 import type { SearchResult } from '../api';
 
 export { type SearchResult };
@@ -31,7 +31,7 @@ export const useMapSearch = (provider: string = 'gaode') => {
                 console.log('Search aborted');
                 return;
             }
-            if (error.message === 'AMAP_KEY_MISSING') {
+            if (isApiError(error, 'amap_key_missing')) {
                 setSearchResults([]);
                 throw new Error('未配置高德API Key');
             }
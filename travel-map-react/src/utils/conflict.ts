@@ -0,0 +1,90 @@
+import { Modal, message } from 'antd';
+import { ConflictError, takeCurrent } from '../api';
+
+const same = (a: unknown, b: unknown) => JSON.stringify(a) === JSON.stringify(b);
+
+// merge3 merges my edit of base with theirs, entry by entry: an entry only
+// one side changed takes that side's version, including removal. Entries both
+// sides changed differently are clashes, resolved by preferMine.
+const merge3 = <T>(base: Map<string, T>, mine: Map<string, T>, theirs: Map<string, T>, preferMine: boolean) => {
+    const merged = new Map<string, T>();
+    const clashes: string[] = [];
+    const keys = [...mine.keys(), ...[...theirs.keys()].filter((k) => !mine.has(k))];
+    for (const key of keys) {
+        const b = base.get(key), m = mine.get(key), t = theirs.get(key);
+        let v: T | undefined;
+        if (same(m, t) || same(b, t)) {
+            v = m;
+        } else if (same(b, m)) {
+            v = t;
+        } else {
+            clashes.push(key);
+            v = preferMine ? m : t;
+        }
+        if (v !== undefined) {
+            merged.set(key, v);
+        }
+    }
+    return { merged, clashes };
+};
+
+// confirmKeepMine asks whether my version of the clashing entries wins
+const confirmKeepMine = (what: string, clashes: string[]) =>
+    new Promise<boolean>((resolve) => {
+        Modal.confirm({
+            title: `${what}已在别处被修改`,
+            content: `${clashes.length} 项在两处都有改动。保留我的修改，还是使用别处保存的版本？`,
+            okText: '保留我的修改',
+            cancelText: '使用别处的版本',
+            onOk: () => resolve(true),
+            onCancel: () => resolve(false),
+        });
+    });
+
+interface SaveOptions<T> {
+    what: string; // the section, as shown to the user
+    base: T; // what the edit started from
+    mine: T;
+    save: (v: T) => Promise<unknown>;
+    load: () => Promise<T>;
+    // Called with the merged version once a conflict has been resolved
+    onMerged: (v: T) => void;
+}
+
+// saveMerged saves a section edited from base. When someone else saved it
+// first, the edit is merged with the section as the conflict sent it, or as
+// reloaded if it did not; either way its new revision is picked up. If both
+// changed the same entry the user chooses which wins. The merge is then
+// saved in turn.
+const saveMerged = async <T>(opts: SaveOptions<T>, toMap: (v: T) => Map<string, any>, fromMap: (m: Map<string, any>) => T) => {
+    let theirs: T | undefined;
+    try {
+        await opts.save(opts.mine);
+        return;
+    } catch (err) {
+        if (!(err instanceof ConflictError)) {
+            throw err;
+        }
+        theirs = takeCurrent<T>(err);
+    }
+    if (theirs === undefined) {
+        theirs = await opts.load();
+    }
+    const base = toMap(opts.base), mine = toMap(opts.mine), other = toMap(theirs);
+    const { clashes } = merge3(base, mine, other, true);
+    const preferMine = clashes.length === 0 || await confirmKeepMine(opts.what, clashes);
+    const merged = fromMap(merge3(base, mine, other, preferMine).merged);
+    opts.onMerged(merged);
+    if (!same(merged, theirs)) {
+        await opts.save(merged);
+    }
+    message.info(`${opts.what}已与别处的修改合并`);
+};
+
+// saveList saves a list section, merging items by id on a conflict
+export const saveList = <T extends { id: string }>(opts: SaveOptions<T[]>) =>
+    saveMerged(opts, (items) => new Map((items || []).map((item) => [item.id, item])), (m) => [...m.values()]);
+
+// saveValue saves a value section like the config, merging its fields on a conflict
+export const saveValue = <T extends object>(opts: SaveOptions<T>) =>
+    saveMerged(opts, (v) => new Map(Object.entries(v || {})), (m) => Object.fromEntries(m) as T);